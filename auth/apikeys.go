@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// APIKeyPrefix marks bearer tokens that are API keys rather than JWTs
+const APIKeyPrefix = "bb_"
+
+// API key scopes. Read allows safe methods, write everything else and admin
+// lets an admin's key reach the admin API.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// APIKeyScopes lists every scope a key can be granted
+var APIKeyScopes = []string{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// apiKeyUsageInterval throttles last_used_at writes for busy keys
+const apiKeyUsageInterval = time.Minute
+
+// hashAPIKeySecret returns the stored form of a key's secret
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns n random bytes hex encoded
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ValidateScopes checks requested scopes and returns them de-duplicated
+func ValidateScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool, len(scopes))
+	var valid []string
+	for _, scope := range scopes {
+		known := false
+		for _, allowed := range APIKeyScopes {
+			known = known || scope == allowed
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown scope: %s", scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			valid = append(valid, scope)
+		}
+	}
+
+	if len(valid) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return valid, nil
+}
+
+// GenerateAPIKey creates and stores a key for a user. The returned plaintext
+// key has the form bb_<prefix>_<secret> and is never stored.
+func GenerateAPIKey(db *gorm.DB, userID uint, name string, scopes []string, expiresAt *time.Time) (string, *models.APIKey, error) {
+	prefix, err := randomHex(6)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate key prefix: %v", err)
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate key secret: %v", err)
+	}
+
+	apiKey := models.APIKey{
+		UserID:     userID,
+		Name:       name,
+		Prefix:     APIKeyPrefix + prefix,
+		SecretHash: hashAPIKeySecret(secret),
+		Scopes:     strings.Join(scopes, " "),
+		ExpiresAt:  expiresAt,
+	}
+
+	if err := db.Create(&apiKey).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to store API key: %v", err)
+	}
+
+	return apiKey.Prefix + "_" + secret, &apiKey, nil
+}
+
+// AuthenticateAPIKey validates a plaintext key and returns claims for its
+// user. IsAdmin is only set when the user is an admin and the key has the
+// admin scope.
+func AuthenticateAPIKey(db *gorm.DB, key string) (*Claims, *models.APIKey, error) {
+	rest, ok := strings.CutPrefix(key, APIKeyPrefix)
+	if !ok {
+		return nil, nil, fmt.Errorf("not an API key")
+	}
+
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return nil, nil, fmt.Errorf("malformed API key")
+	}
+
+	var apiKey models.APIKey
+	if err := db.Preload("User").Where("prefix = ?", APIKeyPrefix+prefix).First(&apiKey).Error; err != nil {
+		return nil, nil, fmt.Errorf("unknown API key")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(apiKey.SecretHash), []byte(hashAPIKeySecret(secret))) != 1 {
+		return nil, nil, fmt.Errorf("invalid API key")
+	}
+
+	now := time.Now()
+	if !apiKey.Usable(now) {
+		return nil, nil, fmt.Errorf("API key revoked or expired")
+	}
+	if !apiKey.User.Active {
+		return nil, nil, fmt.Errorf("user is inactive")
+	}
+
+	// Record usage, at most once per interval
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyUsageInterval {
+		db.Model(&apiKey).UpdateColumn("last_used_at", now)
+		apiKey.LastUsedAt = &now
+	}
+
+	// Without the admin scope an admin's key acts with their role below admin
+	role := baseRole(&apiKey.User)
+	if apiKey.HasScope(ScopeAdmin) && hasAdminAccess(db, &apiKey.User) {
+		role = models.RoleAdmin
+	}
+
+	claims := &Claims{
+		UserID:   apiKey.UserID,
+		Username: apiKey.User.Username,
+		IsAdmin:  role == models.RoleAdmin,
+		Role:     role,
+	}
+	if apiKey.ExpiresAt != nil {
+		claims.ExpiresAt = jwt.NewNumericDate(*apiKey.ExpiresAt)
+	}
+
+	return claims, &apiKey, nil
+}
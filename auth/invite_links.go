@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidInviteLink is returned for unknown invite link tokens
+var ErrInvalidInviteLink = errors.New("invalid invite link")
+
+// ErrInviteLinkUsedUp is returned when a link was revoked, expired or used
+// up before it could be redeemed
+var ErrInviteLinkUsedUp = errors.New("this invite link can no longer be used")
+
+// CreateGroupInviteLink stores a new invite link for a group and returns its
+// plaintext token, which is never stored
+func CreateGroupInviteLink(db *gorm.DB, groupID, createdByID uint, expiresAt *time.Time, maxUses int, emailDomain string) (string, *models.GroupInviteLink, error) {
+	token, err := randomHex(24)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to generate invite token: %v", err)
+	}
+
+	link := models.GroupInviteLink{
+		GroupID:     groupID,
+		CreatedByID: createdByID,
+		Prefix:      token[:8],
+		TokenHash:   hashAPIKeySecret(token),
+		ExpiresAt:   expiresAt,
+		MaxUses:     maxUses,
+		EmailDomain: emailDomain,
+	}
+	if err := db.Create(&link).Error; err != nil {
+		return "", nil, fmt.Errorf("failed to store invite link: %v", err)
+	}
+	return token, &link, nil
+}
+
+// FindGroupInviteLink returns the link for a token, with its group, whether
+// or not it can still be used
+func FindGroupInviteLink(db *gorm.DB, token string) (*models.GroupInviteLink, error) {
+	var link models.GroupInviteLink
+	err := db.Preload("Group").Where("token_hash = ?", hashAPIKeySecret(token)).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidInviteLink
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Links of deleted groups lead nowhere
+	if link.Group.ID == 0 {
+		return nil, ErrInvalidInviteLink
+	}
+	return &link, nil
+}
+
+// UseGroupInviteLink counts a use of the link. Only as many concurrent
+// redemptions as the link has uses left succeed.
+func UseGroupInviteLink(db *gorm.DB, link *models.GroupInviteLink) error {
+	now := time.Now()
+	result := db.Model(&models.GroupInviteLink{}).
+		Where("id = ? AND revoked_at IS NULL", link.ID).
+		Where("expires_at IS NULL OR expires_at > ?", now).
+		Where("max_uses = 0 OR uses < max_uses").
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteLinkUsedUp
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"testing"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+)
+
+func TestOIDCStateTokenRoundTrip(t *testing.T) {
+	secretKey = "test-secret"
+
+	token, err := GenerateOIDCStateToken(&OIDCState{
+		State:      "state",
+		Nonce:      "nonce",
+		Verifier:   "verifier",
+		Redirect:   "/groups",
+		LinkUserID: 7,
+	})
+	if err != nil {
+		t.Fatalf("GenerateOIDCStateToken() error = %v", err)
+	}
+
+	state, err := ParseOIDCStateToken(token)
+	if err != nil {
+		t.Fatalf("ParseOIDCStateToken() error = %v", err)
+	}
+	if state.State != "state" || state.Nonce != "nonce" || state.Verifier != "verifier" ||
+		state.Redirect != "/groups" || state.LinkUserID != 7 {
+		t.Errorf("ParseOIDCStateToken() = %+v, want the generated state", state)
+	}
+
+	if _, err := ParseOIDCStateToken(token + "x"); err == nil {
+		t.Error("ParseOIDCStateToken() accepted a tampered token")
+	}
+
+	// Other tokens signed with the same key aren't login states
+	pending, err := GeneratePendingTwoFactorToken(&models.User{ID: 7, Username: "alice"})
+	if err != nil {
+		t.Fatalf("GeneratePendingTwoFactorToken() error = %v", err)
+	}
+	if _, err := ParseOIDCStateToken(pending); err == nil {
+		t.Error("ParseOIDCStateToken() accepted a two-factor login token")
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// PasswordResetTTL is how long a password reset link stays valid
+const PasswordResetTTL = time.Hour
+
+// ErrInvalidResetToken is returned for unknown, used or expired reset tokens
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// CreatePasswordResetToken stores a new reset token for a user and returns
+// the plaintext token. Earlier unused tokens stop working so only the latest
+// email can be used.
+func CreatePasswordResetToken(db *gorm.DB, userID uint) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate reset token: %v", err)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", userID).
+			Update("used_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.PasswordResetToken{
+			UserID:    userID,
+			TokenHash: hashAPIKeySecret(token),
+			ExpiresAt: time.Now().Add(PasswordResetTTL),
+		}).Error
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to store reset token: %v", err)
+	}
+	return token, nil
+}
+
+// FindPasswordResetToken returns a reset token that can still be used
+func FindPasswordResetToken(db *gorm.DB, token string) (*models.PasswordResetToken, error) {
+	var reset models.PasswordResetToken
+	err := db.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashAPIKeySecret(token), time.Now()).
+		First(&reset).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidResetToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &reset, nil
+}
+
+// ConsumePasswordResetToken marks a reset token as used. Only the first of
+// concurrent requests with the same token succeeds.
+func ConsumePasswordResetToken(db *gorm.DB, reset *models.PasswordResetToken) error {
+	result := db.Model(&models.PasswordResetToken{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", reset.ID, time.Now()).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidResetToken
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"errors"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// baseRole returns a user's stored role, which never includes admin
+func baseRole(user *models.User) string {
+	if user.Role == models.RoleModerator {
+		return models.RoleModerator
+	}
+	return models.RoleUser
+}
+
+// UserRole returns a user's global role: admin for active admins who meet
+// their two-factor requirement, otherwise the role stored on the user
+func UserRole(db *gorm.DB, user *models.User) string {
+	if hasAdminAccess(db, user) {
+		return models.RoleAdmin
+	}
+	return baseRole(user)
+}
+
+// EffectiveRole returns the token's role, deriving it from the admin flag for
+// tokens issued before roles existed
+func (c *Claims) EffectiveRole() string {
+	if c.Role != "" {
+		return c.Role
+	}
+	if c.IsAdmin {
+		return models.RoleAdmin
+	}
+	return models.RoleUser
+}
+
+// LoadGroupAccess returns the user's standing in a group
+func LoadGroupAccess(db *gorm.DB, groupID, userID uint, role string) (models.GroupAccess, error) {
+	access := models.GroupAccess{Role: role}
+
+	var membership models.UserGroupMember
+	err := db.Where("group_id = ? AND user_id = ?", groupID, userID).First(&membership).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return access, err
+	}
+	if err == nil {
+		access.GroupRole = membership.Role
+	}
+	return access, nil
+}
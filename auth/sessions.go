@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// RefreshTokenTTL is how long a session lasts without being refreshed
+	RefreshTokenTTL = 14 * 24 * time.Hour
+	// refreshReuseGrace lets concurrent requests that present the same
+	// refresh token get an access token instead of tripping reuse detection
+	refreshReuseGrace = 10 * time.Second
+)
+
+// ErrSessionRevoked is returned when a refresh token's session was revoked,
+// expired or caught reusing an already rotated token
+var ErrSessionRevoked = errors.New("session revoked")
+
+// TokenPair is the result of a login or refresh. RefreshToken is empty when
+// only a new access token was issued within the reuse grace period.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	Claims       *Claims
+}
+
+// issueRefreshToken stores a new refresh token for a session
+func issueRefreshToken(db *gorm.DB, sessionID string) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate refresh token: %v", err)
+	}
+
+	refresh := models.RefreshToken{
+		SessionID: sessionID,
+		TokenHash: hashAPIKeySecret(token),
+		ExpiresAt: time.Now().Add(RefreshTokenTTL),
+	}
+	if err := db.Create(&refresh).Error; err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %v", err)
+	}
+	return token, nil
+}
+
+// StartSession creates a session for a user who just logged in
+func StartSession(db *gorm.DB, user *models.User, userAgent, ipAddress string) (*TokenPair, error) {
+	session := models.AuthSession{
+		ID:         uuid.New().String(),
+		UserID:     user.ID,
+		UserAgent:  truncate(userAgent, 512),
+		IPAddress:  truncate(ipAddress, 64),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  time.Now().Add(RefreshTokenTTL),
+	}
+	if err := db.Create(&session).Error; err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+
+	refresh, err := issueRefreshToken(db, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	access, claims, err := GenerateToken(user, db, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{AccessToken: access, RefreshToken: refresh, Claims: claims}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new token pair. Presenting
+// a token that was already rotated revokes the whole session.
+func RefreshSession(db *gorm.DB, token string) (*TokenPair, error) {
+	var refresh models.RefreshToken
+	if err := db.Preload("Session").Where("token_hash = ?", hashAPIKeySecret(token)).First(&refresh).Error; err != nil {
+		return nil, fmt.Errorf("unknown refresh token")
+	}
+
+	now := time.Now()
+	session := refresh.Session
+	if session.RevokedAt != nil || now.After(session.ExpiresAt) || now.After(refresh.ExpiresAt) {
+		return nil, ErrSessionRevoked
+	}
+
+	var user models.User
+	if err := db.First(&user, session.UserID).Error; err != nil || !user.Active {
+		RevokeSession(db, session.ID)
+		return nil, ErrSessionRevoked
+	}
+
+	// Claim the token; losing the race means another request just rotated it
+	rotated := false
+	if refresh.UsedAt == nil {
+		result := db.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", refresh.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return nil, fmt.Errorf("failed to rotate refresh token: %v", result.Error)
+		}
+		rotated = result.RowsAffected == 1
+		if !rotated {
+			refresh.UsedAt = &now
+		}
+	}
+
+	if !rotated && now.Sub(*refresh.UsedAt) > refreshReuseGrace {
+		RevokeSession(db, session.ID)
+		return nil, ErrSessionRevoked
+	}
+
+	pair := &TokenPair{}
+	if rotated {
+		newRefresh, err := issueRefreshToken(db, session.ID)
+		if err != nil {
+			return nil, err
+		}
+		pair.RefreshToken = newRefresh
+
+		// Drop tokens rotated long enough ago that they only matter for reuse detection
+		db.Where("session_id = ? AND used_at < ?", session.ID, now.Add(-RefreshTokenTTL)).Delete(&models.RefreshToken{})
+		db.Model(&session).Updates(map[string]interface{}{
+			"last_used_at": now,
+			"expires_at":   now.Add(RefreshTokenTTL),
+		})
+	}
+
+	access, claims, err := GenerateToken(&user, db, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	pair.AccessToken = access
+	pair.Claims = claims
+
+	return pair, nil
+}
+
+// RevokeSession ends a single session
+func RevokeSession(db *gorm.DB, sessionID string) error {
+	return db.Model(&models.AuthSession{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeSessionByRefreshToken ends the session a refresh token belongs to
+func RevokeSessionByRefreshToken(db *gorm.DB, token string) error {
+	var refresh models.RefreshToken
+	if err := db.Where("token_hash = ?", hashAPIKeySecret(token)).First(&refresh).Error; err != nil {
+		return err
+	}
+	return RevokeSession(db, refresh.SessionID)
+}
+
+// RevokeUserSessions ends every session of a user, e.g. after a password,
+// admin or activity change. Access tokens stop working on their next request.
+func RevokeUserSessions(db *gorm.DB, userID uint) error {
+	return db.Model(&models.AuthSession{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeOtherSessions ends every session of a user except the given one,
+// e.g. after they change their own password
+func RevokeOtherSessions(db *gorm.DB, userID uint, keepSessionID string) error {
+	return db.Model(&models.AuthSession{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, keepSessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeAccessToken denylists an access token's jti until it expires
+func RevokeAccessToken(db *gorm.DB, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	// Expired entries can't match a valid token anymore
+	db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{})
+
+	return db.Create(&models.RevokedToken{
+		JTI:       claims.ID,
+		ExpiresAt: claims.ExpiresAt.Time,
+	}).Error
+}
+
+// IsRevoked reports whether an access token was denylisted or its session ended
+func IsRevoked(db *gorm.DB, claims *Claims) (bool, error) {
+	var revoked bool
+	err := db.Raw(
+		`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+			OR EXISTS (SELECT 1 FROM auth_sessions WHERE id = ? AND revoked_at IS NOT NULL)`,
+		claims.ID, claims.SessionID,
+	).Scan(&revoked).Error
+	return revoked, err
+}
+
+// truncate shortens a string to fit its column
+func truncate(value string, max int) string {
+	if len(value) > max {
+		return value[:max]
+	}
+	return value
+}
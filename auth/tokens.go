@@ -0,0 +1,161 @@
+// Package auth issues and checks what users authenticate with: access
+// tokens and the sessions behind them, API keys and two-factor codes. It also
+// stores the single-use tokens of invite links, password resets and email
+// verification. The HTTP middleware built on it is in package middleware.
+package auth
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Key constants for JWT
+const (
+	// TokenTTL is the lifetime of an access token; sessions last longer by
+	// exchanging refresh tokens
+	TokenTTL = 15 * time.Minute
+	// WebSocketTicketTTL bounds how long a ticket can wait before it's used to connect
+	WebSocketTicketTTL = 30 * time.Second
+	webSocketAudience  = "websocket"
+)
+
+var secretKey string
+
+func InitSecretKey() {
+	secretKey = os.Getenv("JWT_SECRET")
+	if secretKey == "" {
+		panic("JWT_SECRET environment variable is not set")
+	}
+}
+
+// Claims struct for JWT. The token's jti is the registered ID claim and
+// SessionID ties it to the login session it was issued for.
+type Claims struct {
+	UserID    uint   `json:"user_id"`
+	Username  string `json:"username"`
+	IsAdmin   bool   `json:"is_admin"`
+	Role      string `json:"role,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateToken creates a new access token for a user's session
+func GenerateToken(user *models.User, db *gorm.DB, sessionID string) (string, *Claims, error) {
+	// Check if user is an admin, and has two-factor enabled if that's required
+	role := UserRole(db, user)
+
+	// Create claims with user information
+	claims := &Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		IsAdmin:   role == models.RoleAdmin,
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(TokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	// Create the token
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString([]byte(secretKey))
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// WebSocketTicket is a short-lived token for clients that can't send cookies
+// or headers on the WebSocket upgrade. It carries the expiry of the session
+// it was issued from so the connection can be closed when that expires.
+type WebSocketTicket struct {
+	Claims
+	SessionExpiresAt *jwt.NumericDate `json:"session_exp,omitempty"`
+}
+
+// keyFunc returns the HMAC secret after checking the signing method
+func keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return []byte(secretKey), nil
+}
+
+// ParseToken validates a session token and returns its claims
+func ParseToken(token string) (*Claims, error) {
+	claims := &Claims{}
+	jwtToken, err := jwt.ParseWithClaims(token, claims, keyFunc)
+	if err != nil {
+		return nil, err
+	}
+	if !jwtToken.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	// WebSocket tickets and pending two-factor tokens carry an audience and
+	// must not be usable as session tokens
+	if len(claims.Audience) > 0 {
+		return nil, fmt.Errorf("invalid token audience")
+	}
+
+	return claims, nil
+}
+
+// GenerateWebSocketTicket issues a short-lived WebSocket ticket for a session
+// and returns it with its ID, which the caller records so the ticket can only
+// be redeemed once
+func GenerateWebSocketTicket(session *Claims) (string, string, error) {
+	now := time.Now()
+	ticket := &WebSocketTicket{
+		Claims: Claims{
+			UserID:    session.UserID,
+			Username:  session.Username,
+			IsAdmin:   session.IsAdmin,
+			Role:      session.Role,
+			SessionID: session.SessionID,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        uuid.New().String(),
+				Audience:  jwt.ClaimStrings{webSocketAudience},
+				ExpiresAt: jwt.NewNumericDate(now.Add(WebSocketTicketTTL)),
+				IssuedAt:  jwt.NewNumericDate(now),
+				NotBefore: jwt.NewNumericDate(now),
+			},
+		},
+		SessionExpiresAt: session.ExpiresAt,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, ticket)
+	signed, err := token.SignedString([]byte(secretKey))
+	if err != nil {
+		return "", "", err
+	}
+	return signed, ticket.ID, nil
+}
+
+// ParseWebSocketTicket validates a WebSocket ticket and returns the session
+// claims and the ticket's ID
+func ParseWebSocketTicket(ticket string) (*Claims, string, error) {
+	claims := &WebSocketTicket{}
+	jwtToken, err := jwt.ParseWithClaims(ticket, claims, keyFunc, jwt.WithAudience(webSocketAudience))
+	if err != nil {
+		return nil, "", err
+	}
+	if !jwtToken.Valid || claims.ID == "" {
+		return nil, "", fmt.Errorf("invalid ticket")
+	}
+
+	session := claims.Claims
+	session.ID = ""
+	session.Audience = nil
+	session.ExpiresAt = claims.SessionExpiresAt
+	return &session, claims.ID, nil
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator app
+// supports, so they're also what the provisioning URI advertises.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew accepts codes from one step either side for clock drift
+	totpSkew = 1
+	// TOTPIssuer names the account in authenticator apps
+	TOTPIssuer = "BingBong"
+
+	// RecoveryCodeCount is how many recovery codes a user gets at a time
+	RecoveryCodeCount = 10
+
+	// PendingTwoFactorTTL is how long a user has to enter their code after
+	// the password step of a login
+	PendingTwoFactorTTL = 5 * time.Minute
+	twoFactorAudience   = "2fa"
+)
+
+// totpEncoding is the unpadded base32 authenticator apps expect
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random TOTP secret, base32 encoded
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate TOTP secret: %v", err)
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI authenticator apps scan
+// from a QR code to add the account
+func TOTPProvisioningURI(secret, username string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTPIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(TOTPIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// totpCode computes the code for a time step
+func totpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("invalid TOTP secret: %v", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo), nil
+}
+
+// ValidateTOTP checks a code against a secret and returns the time step it
+// matched, so callers can refuse the same step twice
+func ValidateTOTP(secret, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode makes recovery codes case and dash insensitive
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// GenerateRecoveryCodes replaces a user's recovery codes and returns the new
+// ones in plaintext; only their hashes are stored
+func GenerateRecoveryCodes(db *gorm.DB, userID uint) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	records := make([]models.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		raw, err := randomHex(8)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		codes[i] = raw[:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:]
+		records[i] = models.RecoveryCode{UserID: userID, CodeHash: hashAPIKeySecret(raw)}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to store recovery codes: %v", err)
+	}
+	return codes, nil
+}
+
+// RemainingRecoveryCodes counts a user's unused recovery codes
+func RemainingRecoveryCodes(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+// VerifyTwoFactor checks a TOTP code or an unused recovery code for a user
+// with two-factor enabled. Either is consumed, so it can't be replayed.
+func VerifyTwoFactor(db *gorm.DB, user *models.User, code string) (bool, error) {
+	if !user.TOTPEnabled {
+		return false, nil
+	}
+
+	if step, ok := ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		// Claim the step; a code already used for this or a later step fails
+		result := db.Model(&models.User{}).
+			Where("id = ? AND totp_last_counter < ?", user.ID, step).
+			UpdateColumn("totp_last_counter", step)
+		if result.Error != nil {
+			return false, fmt.Errorf("failed to record TOTP use: %v", result.Error)
+		}
+		if result.RowsAffected == 1 {
+			user.TOTPLastCounter = step
+		}
+		return result.RowsAffected == 1, nil
+	}
+
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return false, nil
+	}
+
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashAPIKeySecret(normalized)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", result.Error)
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// TwoFactorRequired reports whether an admin has to enable two-factor
+// authentication before admin access is granted
+func TwoFactorRequired(db *gorm.DB, userID uint) bool {
+	return db.Where("user_id = ? AND active = ? AND require_2fa = ?", userID, true, true).
+		First(&models.AdminGroupMember{}).Error == nil
+}
+
+// hasAdminAccess reports whether a user is an active admin who meets the
+// two-factor requirement, if one is set for them
+func hasAdminAccess(db *gorm.DB, user *models.User) bool {
+	var adminAccess models.AdminGroupMember
+	if db.Where("user_id = ? AND active = ?", user.ID, true).First(&adminAccess).Error != nil {
+		return false
+	}
+	return !adminAccess.Require2FA || user.TOTPEnabled
+}
+
+// GeneratePendingTwoFactorToken issues the short-lived token a login holds
+// between the password and the two-factor step
+func GeneratePendingTwoFactorToken(user *models.User) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Audience:  jwt.ClaimStrings{twoFactorAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(PendingTwoFactorTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secretKey))
+}
+
+// ParsePendingTwoFactorToken validates a pending two-factor token and
+// returns the user it was issued for
+func ParsePendingTwoFactorToken(token string) (*Claims, error) {
+	claims := &Claims{}
+	jwtToken, err := jwt.ParseWithClaims(token, claims, keyFunc, jwt.WithAudience(twoFactorAudience))
+	if err != nil {
+		return nil, err
+	}
+	if !jwtToken.Valid {
+		return nil, fmt.Errorf("invalid two-factor token")
+	}
+	return claims, nil
+}
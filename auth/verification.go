@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// EmailVerificationTTL is how long a verification link stays valid
+	EmailVerificationTTL = 48 * time.Hour
+	emailVerifyAudience  = "email-verify"
+)
+
+// EmailVerificationClaims identify the account and the address a link verifies
+type EmailVerificationClaims struct {
+	UserID uint   `json:"user_id"`
+	Email  string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// GenerateEmailVerificationToken signs the token of a verification link
+func GenerateEmailVerificationToken(user *models.User) (string, error) {
+	now := time.Now()
+	claims := &EmailVerificationClaims{
+		UserID: user.ID,
+		Email:  user.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{emailVerifyAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(EmailVerificationTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secretKey))
+}
+
+// ParseEmailVerificationToken validates the token of a verification link
+func ParseEmailVerificationToken(token string) (*EmailVerificationClaims, error) {
+	claims := &EmailVerificationClaims{}
+	jwtToken, err := jwt.ParseWithClaims(token, claims, keyFunc, jwt.WithAudience(emailVerifyAudience))
+	if err != nil {
+		return nil, err
+	}
+	if !jwtToken.Valid {
+		return nil, fmt.Errorf("invalid verification token")
+	}
+	return claims, nil
+}
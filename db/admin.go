@@ -8,7 +8,7 @@ import (
 	"time"
 
 	"git.ssy.dk/noob/bingbong-go/models"
-	"golang.org/x/crypto/bcrypt"
+	"git.ssy.dk/noob/bingbong-go/passwords"
 	"gorm.io/gorm"
 )
 
@@ -22,8 +22,12 @@ func (db *Database) InitializeAdminAccount() error {
 		return fmt.Errorf("missing required admin environment variables")
 	}
 
+	if err := passwords.Validate(adminPassword, adminUsername); err != nil {
+		return fmt.Errorf("ADMIN_PASSWORD does not meet the password policy: %v", err)
+	}
+
 	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
+	hashedPassword, err := passwords.Hash(adminPassword)
 	if err != nil {
 		return fmt.Errorf("failed to hash admin password: %v", err)
 	}
@@ -40,12 +44,14 @@ func (db *Database) InitializeAdminAccount() error {
 			}
 
 			// Create new admin user if not found
+			now := time.Now()
 			user = models.User{
-				Username:  adminUsername,
-				Email:     adminEmail,
-				Password:  string(hashedPassword),
-				Active:    true,
-				LastLogin: time.Now(),
+				Username:        adminUsername,
+				Email:           adminEmail,
+				Password:        hashedPassword,
+				Active:          true,
+				LastLogin:       now,
+				EmailVerifiedAt: &now,
 			}
 
 			if err := tx.Create(&user).Error; err != nil {
@@ -57,7 +63,7 @@ func (db *Database) InitializeAdminAccount() error {
 			// Update existing admin user
 			updates := map[string]interface{}{
 				"username":   adminUsername,
-				"password":   string(hashedPassword),
+				"password":   hashedPassword,
 				"active":     true,
 				"updated_at": time.Now(),
 			}
@@ -19,6 +19,26 @@ type Database struct {
 
 // InitDB initializes and returns a new Database instance
 func InitDB() (*Database, error) {
+	database, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.setupDatabase(); err != nil {
+		return nil, err
+	}
+
+	// Initialize admin account
+	if err := database.InitializeAdminAccount(); err != nil {
+		log.Printf("Warning: Failed to initialize admin account: %v", err)
+	}
+
+	return database, nil
+}
+
+// Connect opens the database connection without running migrations or
+// seeding the admin account
+func Connect() (*Database, error) {
 	// Read environment variables
 	host := os.Getenv("DB_HOST")
 	user := os.Getenv("DB_USER")
@@ -41,15 +61,6 @@ func InitDB() (*Database, error) {
 		return nil, err
 	}
 
-	if err := database.setupDatabase(); err != nil {
-		return nil, err
-	}
-
-	// Initialize admin account
-	if err := database.InitializeAdminAccount(); err != nil {
-		log.Printf("Warning: Failed to initialize admin account: %v", err)
-	}
-
 	return database, nil
 }
 
@@ -85,11 +96,17 @@ func (db *Database) setupDatabase() error {
 	}
 
 	// Log migration status
-	migrations, err := runner.Status()
+	statuses, err := runner.Status()
 	if err != nil {
 		log.Printf("Warning: couldn't fetch migration status: %v", err)
 	} else {
-		log.Printf("Applied %d migrations", len(migrations))
+		applied := 0
+		for _, status := range statuses {
+			if status.Applied {
+				applied++
+			}
+		}
+		log.Printf("Applied %d of %d migrations", applied, len(statuses))
 	}
 
 	return nil
@@ -1,36 +1,34 @@
 package handlers
 
 import (
-	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"git.ssy.dk/noob/bingbong-go/templates"
 	"git.ssy.dk/noob/bingbong-go/timing"
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
 // AdminDashboardHandler renders the admin dashboard
-func AdminDashboardHandler(c *gin.Context) {
-	// Get timing object from context
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	db := c.MustGet("db").(*gorm.DB)
+func AdminDashboardHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get timing object from context
+		t := c.MustGet("timing").(*timing.RenderTiming)
 
-	// Explicitly set content type for HTML
-	c.Header("Content-Type", "text/html; charset=utf-8")
+		// Explicitly set content type for HTML
+		c.Header("Content-Type", "text/html; charset=utf-8")
 
-	// Get all users with their admin access records
-	var users []models.User
-	db.Preload("AdminAccess").Find(&users)
+		// Get all users with their admin access records
+		allUsers, _, _ := users.ListUsers(services.UserQuery{})
 
-	// Get all groups with related data
-	var groups []models.UserGroup
-	db.Preload("Creator").Preload("Members").Find(&groups)
+		// Get all groups with related data
+		allGroups, _, _ := groups.ListGroups(services.GroupQuery{})
 
-	// Start template timing
-	t.StartTemplate()
+		// Start template timing
+		t.StartTemplate()
 
-	// Render the admin dashboard
-	templates.AdminDashboard(t, users, groups).Render(c.Request.Context(), c.Writer)
+		// Render the admin dashboard
+		templates.AdminDashboard(t, allUsers, allGroups).Render(c.Request.Context(), c.Writer)
 
-	// End template timing
-	t.EndTemplate()
+		// End template timing
+		t.EndTemplate()
+	}
 }
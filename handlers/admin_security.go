@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// recentSecurityEvents bounds the audit log shown next to the lockouts
+const recentSecurityEvents = 50
+
+// loadSecurityOverview returns the current lockouts and the latest security events
+func loadSecurityOverview(c *gin.Context, security services.SecurityService, limiter *loginlimit.Limiter) ([]models.LoginLockout, []models.SecurityEvent, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	lockouts, err := limiter.Lockouts(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list lockouts: %v", err)
+	}
+
+	events, err := security.RecentEvents(recentSecurityEvents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch security events: %v", err)
+	}
+
+	return lockouts, events, nil
+}
+
+// renderSecurityOverview answers with the lockouts and security events,
+// as the admin panel fragment for HTMX requests and as JSON otherwise
+func renderSecurityOverview(c *gin.Context, security services.SecurityService, limiter *loginlimit.Limiter) {
+	lockouts, events, err := loadSecurityOverview(c, security, limiter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.GetHeader("HX-Request") != "" {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		t.StartTemplate()
+		templates.AdminSecurity(lockouts, events).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+		return
+	}
+
+	result := make([]map[string]interface{}, len(events))
+	for i := range events {
+		result[i] = events[i].ToDict()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"lockouts": lockouts,
+		"events":   result,
+	})
+}
+
+// AdminGetLockoutsHandler lists locked usernames and recent security events
+func AdminGetLockoutsHandler(security services.SecurityService, limiter *loginlimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Login limits are unavailable without Redis"})
+			return
+		}
+
+		renderSecurityOverview(c, security, limiter)
+	}
+}
+
+// AdminClearLockoutHandler unlocks a username before its lockout expires
+func AdminClearLockoutHandler(security services.SecurityService, limiter *loginlimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		adminName := c.MustGet("username").(string)
+
+		if limiter == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Login limits are unavailable without Redis"})
+			return
+		}
+
+		username := c.Param("username")
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+		defer cancel()
+
+		cleared, err := limiter.ClearLockout(ctx, username)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear lockout"})
+			return
+		}
+		if !cleared {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Username is not locked"})
+			return
+		}
+
+		security.RecordEvent(username, c.ClientIP(), services.SecurityEventLockoutCleared, "Cleared by "+adminName)
+
+		if c.GetHeader("HX-Request") != "" {
+			renderSecurityOverview(c, security, limiter)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared"})
+	}
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// renderAPIKeys answers HTMX requests with the key list fragment
+func renderAPIKeys(c *gin.Context, apiKeys services.APIKeyService, userID uint, newKey string) {
+	keys, err := apiKeys.APIKeys(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+
+	t := c.MustGet("timing").(*timing.RenderTiming)
+	t.StartTemplate()
+	templates.UserAPIKeys(keys, newKey, auth.APIKeyScopes).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// GetAPIKeysHandler lists the user's API keys
+func GetAPIKeysHandler(apiKeys services.APIKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		if c.GetHeader("HX-Request") != "" {
+			renderAPIKeys(c, apiKeys, userID, "")
+			return
+		}
+
+		keys, err := apiKeys.APIKeys(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+			return
+		}
+
+		result := make([]map[string]interface{}, len(keys))
+		for i := range keys {
+			result[i] = keys[i].ToDict()
+		}
+
+		c.JSON(http.StatusOK, gin.H{"api_keys": result})
+	}
+}
+
+// CreateAPIKeyHandler issues a new API key. The plaintext key is only
+// returned in this response.
+func CreateAPIKeyHandler(apiKeys services.APIKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		var keyRequest struct {
+			Name          string   `form:"name" json:"name" binding:"required,max=255"`
+			Scopes        []string `form:"scopes[]" json:"scopes"`
+			ExpiresInDays int      `form:"expires_in_days" json:"expires_in_days" binding:"min=0,max=3650"`
+		}
+
+		if err := c.ShouldBind(&keyRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		plaintext, apiKey, err := apiKeys.CreateAPIKey(services.NewAPIKey{
+			UserID:    userID,
+			Name:      keyRequest.Name,
+			Scopes:    keyRequest.Scopes,
+			ExpiresIn: time.Duration(keyRequest.ExpiresInDays) * 24 * time.Hour,
+			IsAdmin:   c.MustGet("isAdmin").(bool),
+		})
+		var inputErr *services.InputError
+		switch {
+		case errors.As(err, &inputErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": inputErr.Error()})
+			return
+		case errors.Is(err, services.ErrAdminScope):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create keys with the admin scope"})
+			return
+		case errors.Is(err, services.ErrTooManyAPIKeys):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many active API keys, revoke one first"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderAPIKeys(c, apiKeys, userID, plaintext)
+			return
+		}
+
+		response := apiKey.ToDict()
+		response["key"] = plaintext
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+// RevokeAPIKeyHandler revokes one of the user's API keys
+func RevokeAPIKeyHandler(apiKeys services.APIKeyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		keyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+			return
+		}
+
+		err = apiKeys.RevokeAPIKey(userID, uint(keyID))
+		if errors.Is(err, services.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderAPIKeys(c, apiKeys, userID, "")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+	}
+}
@@ -1,87 +1,233 @@
 package handlers
 
 import (
+	"log"
 	"net/http"
 	"time"
 
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
 	"git.ssy.dk/noob/bingbong-go/middleware"
 	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/oidc"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"git.ssy.dk/noob/bingbong-go/templates"
 	"git.ssy.dk/noob/bingbong-go/timing"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 // LoginPageHandler renders the login page
-func LoginPageHandler(c *gin.Context) {
-	// Get the timing object from the context
-	t, exists := c.Get("timing")
-	if !exists {
-		t = timing.NewRenderTiming() // Fallback if timing middleware isn't available
-	}
-	renderTiming := t.(*timing.RenderTiming)
+func LoginPageHandler(provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the timing object from the context
+		t, exists := c.Get("timing")
+		if !exists {
+			t = timing.NewRenderTiming() // Fallback if timing middleware isn't available
+		}
+		renderTiming := t.(*timing.RenderTiming)
 
-	// Get redirect URL from query parameter
-	redirect := c.Query("redirect")
+		// Get redirect URL from query parameter
+		redirect := localRedirect(c.Query("redirect"))
 
-	// Set content type explicitly to ensure proper handling
-	c.Header("Content-Type", "text/html; charset=utf-8")
+		// Set content type explicitly to ensure proper handling
+		c.Header("Content-Type", "text/html; charset=utf-8")
 
-	// Start template timing
-	renderTiming.StartTemplate()
+		// Start template timing
+		renderTiming.StartTemplate()
 
-	// Render the login template
-	templates.Login(renderTiming, redirect).Render(c.Request.Context(), c.Writer)
+		// Render the login template
+		templates.Login(renderTiming, redirect, "", ssoName(provider), "").Render(c.Request.Context(), c.Writer)
 
-	// End template timing
-	renderTiming.EndTemplate()
+		// End template timing
+		renderTiming.EndTemplate()
+	}
 }
 
-// LoginHandler handles user authentication and token generation
-func LoginHandler(c *gin.Context) {
-	var loginRequest struct {
-		Username string `form:"username" binding:"required"`
-		Password string `form:"password" binding:"required"`
-	}
-	if err := c.ShouldBind(&loginRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
-		return
+// renderLoginPage shows the code step of the login page to browsers that
+// submitted the password form without HTMX or came back from single sign-on,
+// or the login page with an error
+func renderLoginPage(c *gin.Context, provider *oidc.Provider, redirect, twoFactorToken, loginError string) {
+	t := c.MustGet("timing").(*timing.RenderTiming)
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	t.StartTemplate()
+	templates.Login(t, redirect, twoFactorToken, ssoName(provider), loginError).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// ssoName returns the label of the single sign-on button, or "" without one
+func ssoName(provider *oidc.Provider) string {
+	if provider != nil {
+		return provider.Config().DisplayName
 	}
+	return ""
+}
 
-	// Get the redirect URL from query parameter
-	redirect := c.Query("redirect")
+// LoginHandler handles user authentication and token generation
+func LoginHandler(db *gorm.DB, security services.SecurityService, limiter *loginlimit.Limiter, provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var loginRequest struct {
+			Username string `form:"username" binding:"required"`
+			Password string `form:"password" binding:"required"`
+		}
+		if err := c.ShouldBind(&loginRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
 
-	// Get the database instance
-	db := c.MustGet("db").(*gorm.DB)
+		// Get the redirect URL from query parameter
+		redirect := localRedirect(c.Query("redirect"))
 
-	// Find the user
-	var user models.User
-	if err := db.Where("username = ? AND active = ?", loginRequest.Username, true).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
+		// Refuse locked usernames and throttled addresses before checking anything
+		if !checkLoginAllowed(c, limiter, loginRequest.Username) {
+			return
+		}
+
+		// Find the user
+		var user models.User
+		if err := db.Where("username = ?", loginRequest.Username).First(&user).Error; err != nil {
+			loginFailed(c, security, limiter, loginRequest.Username)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		// Compare the password
+		passwordOK, needsRehash := passwords.Verify(user.Password, loginRequest.Password)
+		if !passwordOK {
+			loginFailed(c, security, limiter, loginRequest.Username)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		// Only tell the owner, who knows the password, why their account is inactive
+		if !user.Active {
+			if user.EmailVerifiedAt == nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Verify your email address before logging in"})
+				return
+			}
+			loginFailed(c, security, limiter, loginRequest.Username)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		// Upgrade hashes made with an older algorithm or parameters while the
+		// plaintext is at hand
+		if needsRehash {
+			if err := setUserPassword(db, &user, loginRequest.Password); err != nil {
+				log.Printf("Failed to rehash password of user %d: %v", user.ID, err)
+			}
+		}
+
+		// With two-factor enabled the password only earns a pending token, which
+		// LoginTwoFactorHandler exchanges for a session along with a code
+		if user.TOTPEnabled {
+			pending, err := auth.GeneratePendingTwoFactorToken(&user)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+				return
+			}
+
+			if c.ContentType() != "application/json" && c.GetHeader("HX-Request") == "" {
+				// Regular form submission - show the code step of the login page
+				renderLoginPage(c, provider, redirect, pending, "")
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"two_factor_required": true,
+				"two_factor_token":    pending,
+				"expires_in":          int(auth.PendingTwoFactorTTL.Seconds()),
+			})
+			return
+		}
+
+		completeLogin(c, db, limiter, &user, redirect)
 	}
+}
 
-	// Compare the password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginRequest.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
+// LoginTwoFactorHandler finishes a login with a TOTP or recovery code and
+// the pending token issued by LoginHandler
+func LoginTwoFactorHandler(db *gorm.DB, security services.SecurityService, limiter *loginlimit.Limiter, provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var twoFactorRequest struct {
+			Token string `form:"two_factor_token" json:"two_factor_token" binding:"required"`
+			Code  string `form:"code" json:"code" binding:"required"`
+		}
+		if err := c.ShouldBind(&twoFactorRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+
+		redirect := localRedirect(c.Query("redirect"))
+
+		claims, err := auth.ParsePendingTwoFactorToken(twoFactorRequest.Token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+			return
+		}
+
+		// Codes are guessed far more easily than passwords, so they share its limits
+		if !checkLoginAllowed(c, limiter, claims.Username) {
+			return
+		}
+
+		var user models.User
+		if err := db.Where("id = ? AND active = ?", claims.UserID, true).First(&user).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+
+		valid, err := auth.VerifyTwoFactor(db, &user, twoFactorRequest.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		if !valid {
+			loginFailed(c, security, limiter, claims.Username)
+			if c.ContentType() != "application/json" && c.GetHeader("HX-Request") == "" {
+				renderLoginPage(c, provider, redirect, twoFactorRequest.Token, "")
+				return
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication code"})
+			return
+		}
+
+		completeLogin(c, db, limiter, &user, redirect)
 	}
+}
+
+// completeLogin starts a session for an authenticated user and answers in
+// the form the client asked for
+func completeLogin(c *gin.Context, db *gorm.DB, limiter *loginlimit.Limiter, user *models.User, redirect string) {
+	loginSucceeded(c, limiter, user.Username)
+
+	// Every login flow ends here, so check the redirect whichever one it came through
+	redirect = localRedirect(redirect)
 
 	// Update last login time
-	db.Model(&user).Update("last_login", time.Now())
+	db.Model(user).Update("last_login", time.Now())
 
-	// Generate JWT token
-	token, err := middleware.GenerateToken(&user, db)
+	// Start a session with an access and refresh token
+	pair, err := auth.StartSession(db, user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
+	token := pair.AccessToken
 
 	// Check if it's an API request or a form submission
-	if c.GetHeader("HX-Request") != "" {
+	if c.ContentType() == "application/json" && c.GetHeader("HX-Request") == "" {
+		// API client - return both tokens, it refreshes via /api/v1/auth/refresh
+		c.JSON(http.StatusOK, gin.H{
+			"token":         token,
+			"refresh_token": pair.RefreshToken,
+			"expires_in":    int(auth.TokenTTL.Seconds()),
+		})
+	} else if c.GetHeader("HX-Request") != "" {
 		// HTMX request - set cookie and return JSON
-		c.SetCookie("auth_token", token, int(middleware.TokenTTL.Seconds()), "/", "", false, true)
+		middleware.SetSessionCookies(c, pair)
 
 		response := gin.H{
 			"token": token,
@@ -101,7 +247,7 @@ func LoginHandler(c *gin.Context) {
 		c.JSON(http.StatusOK, response)
 	} else {
 		// Regular form submission - set cookie and redirect
-		c.SetCookie("auth_token", token, int(middleware.TokenTTL.Seconds()), "/", "", false, true)
+		middleware.SetSessionCookies(c, pair)
 
 		// Redirect to the provided URL or default to home
 		if redirect != "" {
@@ -113,10 +259,134 @@ func LoginHandler(c *gin.Context) {
 }
 
 // LogoutHandler handles user logout
-func LogoutHandler(c *gin.Context) {
-	// Clear the auth cookie
-	c.SetCookie("auth_token", "", -1, "/", "", false, true)
+func LogoutHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// End the server-side session so its tokens stop working
+		if refreshToken := middleware.RefreshTokenFromRequest(c); refreshToken != "" {
+			auth.RevokeSessionByRefreshToken(db, refreshToken)
+		}
+		if tokenCookie, err := c.Cookie("auth_token"); err == nil {
+			if claims, err := auth.ParseToken(tokenCookie); err == nil {
+				auth.RevokeSession(db, claims.SessionID)
+				auth.RevokeAccessToken(db, claims)
+			}
+		}
+
+		// Clear the auth cookies
+		middleware.ClearSessionCookies(c)
+
+		// Redirect to login page
+		c.Redirect(http.StatusFound, "/login")
+	}
+}
+
+// RefreshTokenHandler exchanges a refresh token, from the JSON body or the
+// refresh cookie, for a new access and refresh token
+func RefreshTokenHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var refreshRequest struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		_ = c.ShouldBindJSON(&refreshRequest)
+
+		fromCookie := refreshRequest.RefreshToken == ""
+		token := refreshRequest.RefreshToken
+		if fromCookie {
+			token = middleware.RefreshTokenFromRequest(c)
+		}
+
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token required"})
+			return
+		}
+
+		pair, err := auth.RefreshSession(db, token)
+		if err != nil {
+			if fromCookie {
+				middleware.ClearSessionCookies(c)
+			}
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+			return
+		}
+
+		if fromCookie {
+			middleware.SetSessionCookies(c, pair)
+		}
+
+		response := gin.H{
+			"token":      pair.AccessToken,
+			"expires_in": int(auth.TokenTTL.Seconds()),
+		}
+		if !fromCookie {
+			response["refresh_token"] = pair.RefreshToken
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// LogoutSessionHandler ends the current session
+func LogoutSessionHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*auth.Claims)
+
+		if err := auth.RevokeSession(db, claims.SessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end session"})
+			return
+		}
+		if err := auth.RevokeAccessToken(db, claims); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+			return
+		}
 
-	// Redirect to login page
-	c.Redirect(http.StatusFound, "/login")
+		middleware.ClearSessionCookies(c)
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	}
+}
+
+// LogoutAllSessionsHandler ends every session of the current user
+func LogoutAllSessionsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+		claims := c.MustGet("claims").(*auth.Claims)
+
+		if err := auth.RevokeUserSessions(db, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end sessions"})
+			return
+		}
+		if err := auth.RevokeAccessToken(db, claims); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+			return
+		}
+
+		middleware.ClearSessionCookies(c)
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+	}
+}
+
+// WebSocketTicketHandler issues a short-lived, single-use ticket for
+// connecting to /ws with ?ticket= when cookies or headers can't be sent
+func WebSocketTicketHandler(hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims := c.MustGet("claims").(*auth.Claims)
+
+		if hub == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "WebSocket hub not available"})
+			return
+		}
+
+		ticket, ticketID, err := auth.GenerateWebSocketTicket(claims)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate ticket"})
+			return
+		}
+		if err := hub.storeWebSocketTicket(ticketID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate ticket"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"ticket":     ticket,
+			"expires_in": int(auth.WebSocketTicketTTL.Seconds()),
+		})
+	}
 }
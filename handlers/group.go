@@ -1,25 +1,259 @@
 package handlers
 
 import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/middleware"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"github.com/gin-gonic/gin"
 )
 
-func CreateGroup(c *gin.Context) {
-	// Implementation
+// GroupMemberResponse is the JSON form of a group membership
+type GroupMemberResponse struct {
+	UserID   uint      `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// GroupResponse is the JSON form of a group
+type GroupResponse struct {
+	ID            uint                  `json:"id"`
+	Name          string                `json:"name"`
+	Description   string                `json:"description"`
+	Visibility    string                `json:"visibility"`
+	CreatedByID   uint                  `json:"created_by_id"`
+	CreatedByName string                `json:"created_by_username"`
+	MemberCount   int                   `json:"member_count"`
+	Members       []GroupMemberResponse `json:"members,omitempty"`
+	CreatedAt     time.Time             `json:"created_at"`
+	UpdatedAt     time.Time             `json:"updated_at"`
 }
 
-func GetGroups(c *gin.Context) {
-	// Implementation
+// groupSortFields maps the ?sort= values of GetGroups to columns
+var groupSortFields = map[string]string{
+	"id":         "user_groups.id",
+	"name":       "user_groups.name",
+	"created_at": "user_groups.created_at",
 }
 
-func GetGroup(c *gin.Context) {
-	// Implementation
+// newGroupResponse builds the DTO for a group with Creator and Members.User
+// preloaded; the member list is only included when withMembers is set
+func newGroupResponse(group models.UserGroup, withMembers bool) GroupResponse {
+	response := GroupResponse{
+		ID:            group.ID,
+		Name:          group.Name,
+		Description:   group.Description,
+		Visibility:    group.Visibility,
+		CreatedByID:   group.CreatedByID,
+		CreatedByName: group.Creator.Username,
+		MemberCount:   len(group.Members),
+		CreatedAt:     group.CreatedAt,
+		UpdatedAt:     group.UpdatedAt,
+	}
+
+	if withMembers {
+		response.Members = make([]GroupMemberResponse, len(group.Members))
+		for i, member := range group.Members {
+			response.Members[i] = GroupMemberResponse{
+				UserID:   member.UserID,
+				Username: member.User.Username,
+				Role:     member.Role,
+				JoinedAt: member.CreatedAt,
+			}
+		}
+	}
+
+	return response
 }
 
-func UpdateGroup(c *gin.Context) {
-	// Implementation
+// CreateGroup creates a group owned by the caller, who also becomes a member
+func CreateGroup(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		var groupRequest struct {
+			Name        string `json:"name" binding:"required,max=255"`
+			Description string `json:"description" binding:"max=1024"`
+			Visibility  string `json:"visibility"`
+		}
+
+		if err := c.ShouldBindJSON(&groupRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if groupRequest.Visibility == "" {
+			groupRequest.Visibility = models.GroupVisibilityPrivate
+		}
+		if !models.ValidGroupVisibility(groupRequest.Visibility) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid visibility"})
+			return
+		}
+
+		group, err := groups.CreateGroup(services.NewGroup{
+			Name:        groupRequest.Name,
+			Description: groupRequest.Description,
+			Visibility:  groupRequest.Visibility,
+			OwnerID:     userID,
+		})
+		if errors.Is(err, services.ErrGroupNameTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Group name already exists"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+			return
+		}
+
+		if loaded, err := groups.GetGroup(group.ID); err == nil {
+			group = loaded
+		}
+		c.JSON(http.StatusCreated, newGroupResponse(*group, true))
+	}
 }
 
-func DeleteGroup(c *gin.Context) {
-	// Implementation
+// GetGroups lists the groups the caller created or belongs to (every group
+// for admins and moderators) with pagination, ?q= name search and ?sort= ordering
+func GetGroups(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		params, err := parseListParams(c.Query("page"), c.Query("per_page"), c.Query("sort"), groupSortFields, "name")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		query := services.GroupQuery{Search: c.Query("q"), Page: params.page()}
+		if !middleware.HasPermission(c, models.PermViewAllGroups) {
+			query.MemberID = userID
+		}
+		if createdBy := c.Query("created_by"); createdBy != "" {
+			creatorID, err := strconv.ParseUint(createdBy, 10, 32)
+			if err != nil || creatorID == 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid created_by filter"})
+				return
+			}
+			query.CreatedByID = uint(creatorID)
+		}
+
+		found, total, err := groups.ListGroups(query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
+			return
+		}
+
+		result := make([]GroupResponse, len(found))
+		for i, group := range found {
+			result[i] = newGroupResponse(group, false)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"groups": result,
+			"meta":   params.meta(total),
+		})
+	}
+}
+
+// GetGroup returns a group with its members to anyone who may view it
+func GetGroup(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		group, err := groups.GetGroup(uint(groupID))
+		if errors.Is(err, services.ErrGroupNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newGroupResponse(*group, true))
+	}
+}
+
+// groupUpdateError answers a GroupService error from updating a group; it
+// reports whether there was one
+func groupUpdateError(c *gin.Context, err error, conflict int) bool {
+	var inputErr *services.InputError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, services.ErrGroupNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+	case errors.Is(err, services.ErrGroupNameTaken):
+		c.JSON(conflict, gin.H{"error": "Group name already exists"})
+	case errors.As(err, &inputErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": inputErr.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update group"})
+	}
+	return true
+}
+
+// UpdateGroup partially updates a group's name and description
+func UpdateGroup(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		var groupRequest struct {
+			Name        *string `json:"name" binding:"omitempty,min=1,max=255"`
+			Description *string `json:"description" binding:"omitempty,max=1024"`
+			Visibility  *string `json:"visibility"`
+		}
+
+		if err := c.ShouldBindJSON(&groupRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		group, err := groups.UpdateGroup(uint(groupID), services.GroupChanges{
+			Name:        groupRequest.Name,
+			Description: groupRequest.Description,
+			Visibility:  groupRequest.Visibility,
+		})
+		if groupUpdateError(c, err, http.StatusConflict) {
+			return
+		}
+
+		c.JSON(http.StatusOK, newGroupResponse(*group, true))
+	}
+}
+
+// DeleteGroup deletes a group; its owner or an admin only
+func DeleteGroup(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		err = groups.DeleteGroup(uint(groupID))
+		if errors.Is(err, services.ErrGroupNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
 }
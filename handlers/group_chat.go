@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.ssy.dk/noob/bingbong-go/services"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMessagePageSize = 50
+	maxMessagePageSize     = 100
+)
+
+// GetGroupMessagesHandler lists a group's messages, newest page first.
+// Pass the returned next_cursor as ?before= to fetch older messages.
+func GetGroupMessagesHandler(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		limit := defaultMessagePageSize
+		if limitParam := c.Query("limit"); limitParam != "" {
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			if limit > maxMessagePageSize {
+				limit = maxMessagePageSize
+			}
+		}
+
+		var before uint64
+		if beforeParam := c.Query("before"); beforeParam != "" {
+			before, err = strconv.ParseUint(beforeParam, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+				return
+			}
+		}
+
+		// Fetch one extra row to know whether there is an older page
+		messages, err := groups.Messages(uint(groupID), uint(before), limit+1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch messages"})
+			return
+		}
+
+		hasMore := len(messages) > limit
+		if hasMore {
+			messages = messages[:limit]
+		}
+
+		// Return the page oldest first so it can be appended as-is
+		result := make([]map[string]interface{}, len(messages))
+		for i := range messages {
+			result[len(messages)-1-i] = messages[i].ToDict()
+		}
+
+		var nextCursor interface{}
+		if hasMore {
+			nextCursor = messages[len(messages)-1].ID
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"messages":    result,
+			"next_cursor": nextCursor,
+		})
+	}
+}
+
+// PostGroupMessageHandler stores a new group message and delivers it to online members
+func PostGroupMessageHandler(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		var messageRequest struct {
+			Content string `form:"content" json:"content" binding:"required"`
+		}
+
+		if err := c.ShouldBind(&messageRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var inputErr *services.InputError
+		message, err := groups.PostMessage(uint(groupID), userID, messageRequest.Content)
+		if errors.As(err, &inputErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": inputErr.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, message.ToDict())
+	}
+}
@@ -0,0 +1,287 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// GroupDirectoryHandler renders the directory of listed and open groups
+func GroupDirectoryHandler(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
+
+		query := c.Query("q")
+		listings, err := groups.SearchDirectory(userID, query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
+			return
+		}
+
+		t.StartTemplate()
+		templates.GroupDirectory(t, query, listings).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
+}
+
+// SearchGroupDirectoryHandler returns the directory groups matching ?q=
+func SearchGroupDirectoryHandler(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		listings, err := groups.SearchDirectory(userID, c.Query("q"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			t := c.MustGet("timing").(*timing.RenderTiming)
+			t.StartTemplate()
+			templates.GroupDirectoryResults(listings).Render(c.Request.Context(), c.Writer)
+			t.EndTemplate()
+			return
+		}
+
+		result := make([]map[string]interface{}, len(listings))
+		for i := range listings {
+			result[i] = listings[i].ToDict()
+		}
+
+		c.JSON(http.StatusOK, gin.H{"groups": result})
+	}
+}
+
+// renderGroupListing answers with the group's directory entry after the
+// user joined it or changed their request
+func renderGroupListing(c *gin.Context, groups services.GroupService, userID uint, group *models.UserGroup, status int, message string) {
+	listing, err := groups.DirectoryListing(userID, group)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+		return
+	}
+
+	if c.GetHeader("HX-Request") != "" {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		t.StartTemplate()
+		templates.GroupListingCard(*listing).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+		return
+	}
+
+	response := listing.ToDict()
+	response["message"] = message
+	c.JSON(status, response)
+}
+
+// JoinDirectoryGroupHandler joins an open group, or asks the managers of a
+// listed group to let the user in
+func JoinDirectoryGroupHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		var joinRequest struct {
+			Message string `form:"message" json:"message" binding:"max=500"`
+		}
+
+		if err := c.ShouldBind(&joinRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Private groups can only be joined by invitation
+		group, err := groups.GetGroup(uint(groupID))
+		if errors.Is(err, services.ErrGroupNotFound) || (err == nil && !group.Discoverable()) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+			return
+		}
+
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
+
+		if group.Visibility == models.GroupVisibilityOpen {
+			err := groups.JoinOpenGroup(group, user)
+			if errors.Is(err, services.ErrAlreadyMember) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "You are already a member of this group"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join group"})
+				return
+			}
+
+			renderGroupListing(c, groups, userID, group, http.StatusOK, "You joined "+group.Name)
+			return
+		}
+
+		_, err = groups.RequestToJoin(group, user, strings.TrimSpace(joinRequest.Message))
+		switch {
+		case errors.Is(err, services.ErrAlreadyMember):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You are already a member of this group"})
+			return
+		case errors.Is(err, services.ErrJoinRequestPending):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You already asked to join this group"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send join request"})
+			return
+		}
+
+		renderGroupListing(c, groups, userID, group, http.StatusCreated, "Your request to join "+group.Name+" was sent")
+	}
+}
+
+// CancelJoinRequestHandler withdraws the user's pending request to join a group
+func CancelJoinRequestHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		group, err := groups.GetGroup(uint(groupID))
+		if errors.Is(err, services.ErrGroupNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+			return
+		}
+
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
+
+		err = groups.CancelJoinRequest(group, user)
+		if errors.Is(err, services.ErrNoJoinRequest) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "You have no pending request to join this group"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to withdraw join request"})
+			return
+		}
+
+		renderGroupListing(c, groups, userID, group, http.StatusOK, "Your request to join "+group.Name+" was withdrawn")
+	}
+}
+
+// GetGroupJoinRequestsHandler lists the group's pending join requests
+func GetGroupJoinRequestsHandler(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		requests, err := groups.PendingJoinRequests(uint(groupID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch join requests"})
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			t := c.MustGet("timing").(*timing.RenderTiming)
+			t.StartTemplate()
+			templates.GroupJoinRequests(uint(groupID), requests).Render(c.Request.Context(), c.Writer)
+			t.EndTemplate()
+			return
+		}
+
+		result := make([]map[string]interface{}, len(requests))
+		for i := range requests {
+			result[i] = requests[i].ToDict()
+		}
+
+		c.JSON(http.StatusOK, gin.H{"join_requests": result})
+	}
+}
+
+// decideJoinRequest approves or rejects a pending join request; approved
+// requesters become members
+func decideJoinRequest(c *gin.Context, groups services.GroupService, hub *DistributedHub, status string) {
+	userID := c.MustGet("userID").(uint)
+
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	requestID, err := strconv.ParseUint(c.Param("request_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid join request ID"})
+		return
+	}
+
+	request, err := groups.GetJoinRequest(uint(groupID), uint(requestID))
+	if errors.Is(err, services.ErrJoinRequestNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Join request not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch join request"})
+		return
+	}
+
+	// Answer the request and add the membership together, so only one of
+	// several managers answering at once gets through
+	err = groups.AnswerJoinRequest(request, userID, status)
+	if errors.Is(err, services.ErrJoinRequestAnswered) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This join request was already answered"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to answer join request"})
+		return
+	}
+
+	if c.GetHeader("HX-Request") != "" {
+		renderGroupDetail(c, groups, hub, uint(groupID))
+		return
+	}
+
+	c.JSON(http.StatusOK, request.ToDict())
+}
+
+// ApproveJoinRequestHandler lets a requester into the group
+func ApproveJoinRequestHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		decideJoinRequest(c, groups, hub, models.JoinRequestStatusApproved)
+	}
+}
+
+// RejectJoinRequestHandler turns a requester away
+func RejectJoinRequestHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		decideJoinRequest(c, groups, hub, models.JoinRequestStatusRejected)
+	}
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// inviteExpiryInterval is how often stale invitations are expired
+const inviteExpiryInterval = 10 * time.Minute
+
+// expireInvites periodically expires invitations nobody answered in time
+func (h *DistributedHub) expireInvites() {
+	invites := services.NewInviteService(&db.Database{GormDB: h.db}, NewNotificationService(h))
+
+	ticker := time.NewTicker(inviteExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			count, err := invites.ExpireStale()
+			if err != nil {
+				log.Printf("Invite expiry failed: %v", err)
+			} else if count > 0 {
+				log.Printf("Expired %d group invitations", count)
+			}
+		}
+	}
+}
+
+// renderUserInvites renders the invites tab: pending invites first, then
+// the history of answered ones
+func renderUserInvites(c *gin.Context, users services.UserService, invites services.InviteService, userID uint) {
+	user, err := users.GetUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	sentInvites, receivedInvites, err := invites.UserInvites(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invites"})
+		return
+	}
+
+	t := c.MustGet("timing").(*timing.RenderTiming)
+	t.StartTemplate()
+	templates.UserInvites(*user, sentInvites, receivedInvites).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// bindNewOwner reads the user_id of the member who should own the group
+func bindNewOwner(c *gin.Context) (uint, bool) {
+	var ownerRequest struct {
+		UserID uint `form:"user_id" json:"user_id" binding:"required"`
+	}
+	if err := c.ShouldBind(&ownerRequest); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return ownerRequest.UserID, true
+}
+
+// groupAccessIn returns a user's access to a group whose members are loaded
+func groupAccessIn(group *models.UserGroup, userID uint, role string) models.GroupAccess {
+	access := models.GroupAccess{Role: role}
+	for _, member := range group.Members {
+		if member.UserID == userID {
+			access.GroupRole = member.Role
+		}
+	}
+	return access
+}
+
+// transferOwnership hands the group named by the :id route parameter to
+// another member and returns it reloaded; it answers errors itself
+func transferOwnership(c *gin.Context, groups services.GroupService) (*models.UserGroup, bool) {
+	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return nil, false
+	}
+
+	newOwnerID, ok := bindNewOwner(c)
+	if !ok {
+		return nil, false
+	}
+
+	group, err := groups.GetGroup(uint(groupID))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return nil, false
+	}
+
+	err = groups.TransferOwnership(group, newOwnerID)
+	if errors.Is(err, services.ErrNewOwnerNotMember) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The new owner must be a member of the group"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer ownership"})
+		return nil, false
+	}
+
+	if group, err = groups.GetGroup(group.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reload group data"})
+		return nil, false
+	}
+	return group, true
+}
+
+// TransferGroupOwnershipHandler hands the group to another member; the
+// previous owner becomes a group admin
+func TransferGroupOwnershipHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
+
+		group, ok := transferOwnership(c, groups)
+		if !ok {
+			return
+		}
+
+		// The caller's own role may have changed along with the owner
+		access := groupAccessIn(group, userID, c.GetString("role"))
+
+		t.StartTemplate()
+		templates.GroupDetail(*group, userID, access, groupPresence(hub, *group)).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
+}
+
+// LeaveGroupHandler removes the caller from a group. Owners have to hand the
+// group to someone else first.
+func LeaveGroupHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		err = groups.LeaveGroup(uint(groupID), userID)
+		switch {
+		case errors.Is(err, services.ErrNotMember):
+			c.JSON(http.StatusNotFound, gin.H{"error": "You are not a member of this group"})
+			return
+		case errors.Is(err, services.ErrOwnerCannotLeave):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Transfer ownership to another member before leaving the group"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to leave group"})
+			return
+		}
+
+		renderUserGroups(c, users, groups, userID)
+	}
+}
+
+// renderUserGroups renders the list of groups the user created or belongs to
+func renderUserGroups(c *gin.Context, users services.UserService, groups services.GroupService, userID uint) {
+	user, err := users.GetUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+		return
+	}
+
+	memberOf, _, err := groups.ListGroups(services.GroupQuery{MemberID: userID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
+		return
+	}
+
+	t := c.MustGet("timing").(*timing.RenderTiming)
+	t.StartTemplate()
+	templates.UserGroups(*user, memberOf).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// TransferGroupOwnership hands the group to another member over the JSON API
+func TransferGroupOwnership(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		group, ok := transferOwnership(c, groups)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, newGroupResponse(*group, true))
+	}
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// renderGroupInviteLinks answers HTMX requests with the invite link fragment
+func renderGroupInviteLinks(c *gin.Context, invites services.InviteService, groupID uint, newLink string) {
+	links, err := invites.InviteLinks(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invite links"})
+		return
+	}
+
+	t := c.MustGet("timing").(*timing.RenderTiming)
+	t.StartTemplate()
+	templates.GroupInviteLinks(groupID, links, newLink).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// GetGroupInviteLinksHandler lists a group's invite links
+func GetGroupInviteLinksHandler(invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderGroupInviteLinks(c, invites, uint(groupID), "")
+			return
+		}
+
+		links, err := invites.InviteLinks(uint(groupID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch invite links"})
+			return
+		}
+
+		result := make([]map[string]interface{}, len(links))
+		for i := range links {
+			result[i] = links[i].ToDict()
+		}
+
+		c.JSON(http.StatusOK, gin.H{"invite_links": result})
+	}
+}
+
+// CreateGroupInviteLinkHandler creates a shareable invite link. The link is
+// only returned in this response.
+func CreateGroupInviteLinkHandler(invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		var linkRequest struct {
+			ExpiresInHours int    `form:"expires_in_hours" json:"expires_in_hours" binding:"min=0,max=8760"`
+			MaxUses        int    `form:"max_uses" json:"max_uses" binding:"min=0,max=10000"`
+			EmailDomain    string `form:"email_domain" json:"email_domain" binding:"max=255"`
+		}
+
+		if err := c.ShouldBind(&linkRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		token, link, err := invites.CreateInviteLink(services.NewInviteLink{
+			GroupID:     uint(groupID),
+			CreatedByID: userID,
+			ExpiresIn:   time.Duration(linkRequest.ExpiresInHours) * time.Hour,
+			MaxUses:     linkRequest.MaxUses,
+			EmailDomain: linkRequest.EmailDomain,
+		})
+		var inputErr *services.InputError
+		switch {
+		case errors.As(err, &inputErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": inputErr.Error()})
+			return
+		case errors.Is(err, services.ErrTooManyInviteLinks):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many active invite links, revoke one first"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite link"})
+			return
+		}
+
+		joinURL := absoluteURL(c, "/join/"+token)
+
+		if c.GetHeader("HX-Request") != "" {
+			renderGroupInviteLinks(c, invites, uint(groupID), joinURL)
+			return
+		}
+
+		response := link.ToDict()
+		response["url"] = joinURL
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+// RevokeGroupInviteLinkHandler stops an invite link from working
+func RevokeGroupInviteLinkHandler(invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		linkID, err := strconv.ParseUint(c.Param("link_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite link ID"})
+			return
+		}
+
+		err = invites.RevokeInviteLink(uint(groupID), uint(linkID))
+		if errors.Is(err, services.ErrInviteLinkNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invite link not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke invite link"})
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderGroupInviteLinks(c, invites, uint(groupID), "")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Invite link revoked"})
+	}
+}
+
+// inviteLinkProblem explains why a user can't join through a link, or
+// returns an empty string when they can
+func inviteLinkProblem(link *models.GroupInviteLink, user *models.User) string {
+	if !link.Usable(time.Now()) {
+		return "This invite link has expired, been used up or been revoked."
+	}
+	if link.EmailDomain != "" && (user.EmailVerifiedAt == nil || !link.AllowsEmail(user.Email)) {
+		return "This invite link is only for users with a verified @" + link.EmailDomain + " email address."
+	}
+	return ""
+}
+
+// renderJoinGroup renders the join page for an invite link
+func renderJoinGroup(c *gin.Context, status int, token string, group *models.UserGroup, alreadyMember bool, problem string) {
+	t := c.MustGet("timing").(*timing.RenderTiming)
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(status)
+	t.StartTemplate()
+	templates.JoinGroup(t, token, group, alreadyMember, problem).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// JoinGroupPageHandler shows which group an invite link leads to and lets
+// the logged in user join it. AuthMiddleware sends anonymous visitors
+// through the login page first.
+func JoinGroupPageHandler(users services.UserService, groups services.GroupService, invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+		token := c.Param("token")
+
+		link, err := invites.FindInviteLink(token)
+		if err != nil {
+			renderJoinGroup(c, http.StatusNotFound, token, nil, false, "This invite link is not valid.")
+			return
+		}
+
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
+
+		member, err := groups.IsMember(link.GroupID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group"})
+			return
+		}
+		if member {
+			renderJoinGroup(c, http.StatusOK, token, &link.Group, true, "")
+			return
+		}
+
+		if problem := inviteLinkProblem(link, user); problem != "" {
+			renderJoinGroup(c, http.StatusForbidden, token, &link.Group, false, problem)
+			return
+		}
+
+		renderJoinGroup(c, http.StatusOK, token, &link.Group, false, "")
+	}
+}
+
+// JoinGroupHandler adds the logged in user to the group of an invite link
+func JoinGroupHandler(users services.UserService, groups services.GroupService, invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		link, err := invites.FindInviteLink(c.Param("token"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "This invite link is not valid."})
+			return
+		}
+
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
+
+		if problem := inviteLinkProblem(link, user); problem != "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": problem})
+			return
+		}
+
+		// Count the use and add the membership together, so a link that runs
+		// out midway doesn't let anyone in
+		err = groups.JoinWithInviteLink(link, userID)
+		if errors.Is(err, services.ErrAlreadyMember) {
+			c.JSON(http.StatusOK, gin.H{"message": "You are already a member of this group", "redirect": "/dashboard/groups"})
+			return
+		}
+		if errors.Is(err, auth.ErrInviteLinkUsedUp) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This invite link has expired, been used up or been revoked."})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to join group"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "You joined " + link.Group.Name, "redirect": "/dashboard/groups"})
+	}
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"github.com/gin-gonic/gin"
+)
+
+// checkLoginAllowed answers 429 and returns false while the username or the
+// client's address is locked out. Without a limiter logins are not limited,
+// and if Redis fails the login is allowed; see the loginlimit package.
+func checkLoginAllowed(c *gin.Context, limiter *loginlimit.Limiter, username string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	wait, err := limiter.Blocked(ctx, username, c.ClientIP())
+	if err != nil {
+		log.Printf("Failed to check login limits for %s: %v", username, err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	tooManyRequests(c, wait, "Too many failed login attempts, try again later")
+	return false
+}
+
+// tooManyRequests answers 429 with how long the client has to wait
+func tooManyRequests(c *gin.Context, wait time.Duration, message string) {
+	seconds := int(wait.Round(time.Second).Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       message,
+		"retry_after": seconds,
+	})
+}
+
+// loginFailed counts a failed password or code and records a security event
+// when it locks the username
+func loginFailed(c *gin.Context, security services.SecurityService, limiter *loginlimit.Limiter, username string) {
+	if limiter == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	duration, lockouts, err := limiter.RecordFailure(ctx, username, c.ClientIP())
+	if err != nil {
+		log.Printf("Failed to record login failure for %s: %v", username, err)
+		return
+	}
+	if duration > 0 {
+		security.RecordEvent(username, c.ClientIP(), services.SecurityEventLoginLockout,
+			fmt.Sprintf("Locked for %s after %d failed logins (lockout %d)", duration, loginlimit.MaxUsernameFailures, lockouts))
+	}
+}
+
+// loginSucceeded resets the username's failures once it has logged in
+func loginSucceeded(c *gin.Context, limiter *loginlimit.Limiter, username string) {
+	if limiter == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := limiter.ClearFailures(ctx, username); err != nil {
+		log.Printf("Failed to clear login failures for %s: %v", username, err)
+	}
+}
@@ -10,15 +10,17 @@ func PingHandler(c *gin.Context) {
 	})
 }
 
-func HealthzHandler(c *gin.Context) {
-	// Check if the hub is healthy
-	if c.MustGet("hub").(*DistributedHub).IsHealthy() {
-		c.JSON(200, gin.H{
-			"status": "ok",
-		})
-	} else {
-		c.JSON(500, gin.H{
-			"status": "error",
-		})
+func HealthzHandler(hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Check if the hub is healthy
+		if hub != nil && hub.IsHealthy() {
+			c.JSON(200, gin.H{
+				"status": "ok",
+			})
+		} else {
+			c.JSON(500, gin.H{
+				"status": "error",
+			})
+		}
 	}
 }
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultNotificationPageSize = 50
+	maxNotificationPageSize     = 100
+)
+
+// saveNotification stores a notification for a user
+func saveNotification(db *gorm.DB, userID uint, notification WebSocketNotification) (*models.Notification, error) {
+	content, err := json.Marshal(map[string]any{
+		"title":   notification.Title,
+		"message": notification.Message,
+		"data":    notification.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stored := models.Notification{
+		UserID:  userID,
+		Type:    string(notification.Type),
+		Content: string(content),
+	}
+
+	if err := db.Create(&stored).Error; err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// notificationError answers a UserService error about a notification; it
+// reports whether there was one
+func notificationError(c *gin.Context, err error, fallback string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, services.ErrNotificationNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+	return true
+}
+
+// GetNotificationsHandler lists the user's notifications, newest first.
+// Use ?unread=true to only list unread ones and ?before=<id> to page.
+func GetNotificationsHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		limit := defaultNotificationPageSize
+		if limitParam := c.Query("limit"); limitParam != "" {
+			parsed, err := strconv.Atoi(limitParam)
+			if err != nil || parsed < 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+				return
+			}
+			limit = min(parsed, maxNotificationPageSize)
+		}
+
+		var before uint64
+		if beforeParam := c.Query("before"); beforeParam != "" {
+			var err error
+			before, err = strconv.ParseUint(beforeParam, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+				return
+			}
+		}
+
+		// Fetch one extra row to know whether there is an older page
+		notifications, err := users.ListNotifications(userID, c.Query("unread") == "true", uint(before), limit+1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch notifications"})
+			return
+		}
+
+		hasMore := len(notifications) > limit
+		if hasMore {
+			notifications = notifications[:limit]
+		}
+
+		result := make([]map[string]interface{}, len(notifications))
+		for i := range notifications {
+			result[i] = notifications[i].ToDict()
+		}
+
+		var nextCursor interface{}
+		if hasMore {
+			nextCursor = notifications[len(notifications)-1].ID
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"notifications": result,
+			"next_cursor":   nextCursor,
+		})
+	}
+}
+
+// GetUnreadNotificationCountHandler returns the number of unread notifications
+func GetUnreadNotificationCountHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		count, err := users.CountUnreadNotifications(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count notifications"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"count": count})
+	}
+}
+
+// MarkNotificationReadHandler marks one of the user's notifications as read
+func MarkNotificationReadHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		notificationID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+			return
+		}
+
+		if notificationError(c, users.MarkNotificationRead(userID, uint(notificationID)), "Failed to update notification") {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+	}
+}
+
+// MarkAllNotificationsReadHandler marks all of the user's notifications as read
+func MarkAllNotificationsReadHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		updated, err := users.MarkAllNotificationsRead(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "All notifications marked as read",
+			"updated": updated,
+		})
+	}
+}
+
+// DeleteNotificationHandler deletes one of the user's notifications
+func DeleteNotificationHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		notificationID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification ID"})
+			return
+		}
+
+		if notificationError(c, users.DeleteNotification(userID, uint(notificationID)), "Failed to delete notification") {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Notification deleted"})
+	}
+}
@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/oidc"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	// oidcStateCookie holds the signed state of a login at the provider
+	oidcStateCookie = "oidc_state"
+	oidcCookiePath  = "/auth/oidc"
+)
+
+// usernameUnsafeChars are replaced when deriving a username from IdP claims
+var usernameUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// OIDCLoginHandler sends the browser to the provider to log in
+func OIDCLoginHandler(provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider == nil {
+			c.String(http.StatusNotFound, "Single sign-on is not configured")
+			return
+		}
+
+		startOIDC(c, provider, &auth.OIDCState{Redirect: localRedirect(c.Query("redirect"))})
+	}
+}
+
+// OIDCLinkHandler sends a logged in user to the provider to link the account
+// they have there to their own
+func OIDCLinkHandler(provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider == nil {
+			c.String(http.StatusNotFound, "Single sign-on is not configured")
+			return
+		}
+
+		startOIDC(c, provider, &auth.OIDCState{
+			Redirect:   "/dashboard",
+			LinkUserID: c.MustGet("userID").(uint),
+		})
+	}
+}
+
+// startOIDC remembers the state of a login or link in the browser and
+// redirects to the provider
+func startOIDC(c *gin.Context, provider *oidc.Provider, state *auth.OIDCState) {
+	var err error
+	for _, value := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		if *value, err = oidc.RandomString(); err != nil {
+			c.String(http.StatusInternalServerError, "Failed to start single sign-on")
+			return
+		}
+	}
+
+	token, err := auth.GenerateOIDCStateToken(state)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to start single sign-on")
+		return
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, token, int(auth.OIDCStateTTL.Seconds()), oidcCookiePath, "", false, true)
+	c.Redirect(http.StatusFound, provider.AuthCodeURL(state.State, state.Nonce, state.Verifier))
+}
+
+// OIDCCallbackHandler finishes a login at the provider and starts a session
+// for the linked, matched or newly provisioned account
+func OIDCCallbackHandler(db *gorm.DB, limiter *loginlimit.Limiter, provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if provider == nil {
+			c.String(http.StatusNotFound, "Single sign-on is not configured")
+			return
+		}
+
+		// The state is single use
+		cookie, _ := c.Cookie(oidcStateCookie)
+		c.SetCookie(oidcStateCookie, "", -1, oidcCookiePath, "", false, true)
+
+		state, err := auth.ParseOIDCStateToken(cookie)
+		if err != nil || subtle.ConstantTimeCompare([]byte(state.State), []byte(c.Query("state"))) != 1 {
+			renderLoginPage(c, provider, "", "", "Your single sign-on login expired, please try again.")
+			return
+		}
+
+		if errorCode := c.Query("error"); errorCode != "" {
+			log.Printf("Single sign-on failed at the provider: %s %s", errorCode, c.Query("error_description"))
+			renderLoginPage(c, provider, state.Redirect, "", "Single sign-on was cancelled or failed at the provider.")
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+		defer cancel()
+
+		rawIDToken, err := provider.Exchange(ctx, c.Query("code"), state.Verifier)
+		if err != nil {
+			log.Printf("Single sign-on code exchange failed: %v", err)
+			renderLoginPage(c, provider, state.Redirect, "", "Single sign-on failed, please try again.")
+			return
+		}
+		claims, err := provider.VerifyIDToken(ctx, rawIDToken, state.Nonce)
+		if err != nil {
+			log.Printf("Single sign-on ID token rejected: %v", err)
+			renderLoginPage(c, provider, state.Redirect, "", "Single sign-on failed, please try again.")
+			return
+		}
+
+		if state.LinkUserID != 0 {
+			linkOIDCAccount(c, db, provider, claims, state)
+			return
+		}
+
+		user, err := findOrProvisionOIDCUser(c, db, provider, claims)
+		if err != nil {
+			var loginErr *oidcLoginError
+			if errors.As(err, &loginErr) {
+				renderLoginPage(c, provider, state.Redirect, "", loginErr.message)
+				return
+			}
+			log.Printf("Single sign-on for subject %s failed: %v", claims.Subject, err)
+			renderLoginPage(c, provider, state.Redirect, "", "Single sign-on failed, please try again.")
+			return
+		}
+
+		if !user.Active {
+			renderLoginPage(c, provider, state.Redirect, "", "Your account is disabled.")
+			return
+		}
+
+		if provider.Config().GroupsClaim != "" {
+			if err := syncOIDCGroups(db, provider.Config(), user, claims.Groups); err != nil {
+				log.Printf("Failed to map IdP groups for user %d: %v", user.ID, err)
+			}
+		}
+
+		// Accounts with two-factor enabled still need their code
+		if user.TOTPEnabled {
+			pending, err := auth.GeneratePendingTwoFactorToken(user)
+			if err != nil {
+				renderLoginPage(c, provider, state.Redirect, "", "Failed to start two-factor authentication.")
+				return
+			}
+			renderLoginPage(c, provider, state.Redirect, pending, "")
+			return
+		}
+
+		completeLogin(c, db, limiter, user, state.Redirect)
+	}
+}
+
+// GetSingleSignOnHandler renders the single sign-on card of the account
+// settings, listing the provider accounts linked to the user. It renders
+// nothing when single sign-on isn't configured.
+func GetSingleSignOnHandler(db *gorm.DB, provider *oidc.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		if provider == nil {
+			c.Status(http.StatusOK)
+			return
+		}
+
+		var identities []models.UserIdentity
+		if err := db.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch linked accounts"})
+			return
+		}
+
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		t.StartTemplate()
+		templates.UserSingleSignOn(ssoName(provider), identities).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
+}
+
+// linkOIDCAccount finishes linking the provider account to the user who
+// started the link from their account settings
+func linkOIDCAccount(c *gin.Context, db *gorm.DB, provider *oidc.Provider, claims *oidc.Claims, state *auth.OIDCState) {
+	var user models.User
+	if err := db.First(&user, state.LinkUserID).Error; err != nil {
+		c.String(http.StatusNotFound, "User not found")
+		return
+	}
+
+	var identity models.UserIdentity
+	err := db.Where("issuer = ? AND subject = ?", provider.Issuer(), claims.Subject).First(&identity).Error
+	switch {
+	case err == nil && identity.UserID == user.ID:
+		c.Redirect(http.StatusFound, state.Redirect)
+		return
+	case err == nil:
+		c.String(http.StatusConflict, "This single sign-on account is already linked to another user")
+		return
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		log.Printf("Failed to look up identity for subject %s: %v", claims.Subject, err)
+		c.String(http.StatusInternalServerError, "Failed to link single sign-on")
+		return
+	}
+
+	if err := linkOIDCIdentity(db, provider, claims, user.ID); err != nil {
+		log.Printf("Single sign-on link for user %d failed: %v", user.ID, err)
+		c.String(http.StatusInternalServerError, "Failed to link single sign-on")
+		return
+	}
+	services.RecordSecurityEvent(db, user.Username, c.ClientIP(), services.SecurityEventSSOLinked, "Linked to "+provider.Issuer())
+
+	c.Redirect(http.StatusFound, state.Redirect)
+}
+
+// oidcLoginError is a failed single sign-on with a message for the user
+type oidcLoginError struct {
+	message string
+}
+
+func (e *oidcLoginError) Error() string {
+	return e.message
+}
+
+// findOrProvisionOIDCUser returns the account linked to the provider's
+// subject. Without a link it links the account with the same email address
+// when both the provider and the account have verified it, or creates a new
+// account.
+func findOrProvisionOIDCUser(c *gin.Context, db *gorm.DB, provider *oidc.Provider, claims *oidc.Claims) (*models.User, error) {
+	var identity models.UserIdentity
+	err := db.Where("issuer = ? AND subject = ?", provider.Issuer(), claims.Subject).First(&identity).Error
+	if err == nil {
+		var user models.User
+		if err := db.First(&user, identity.UserID).Error; err == nil {
+			db.Model(&identity).Updates(map[string]interface{}{"email": claims.Email, "last_login_at": time.Now()})
+			return &user, nil
+		}
+		// The linked account was deleted; start over with a fresh one
+		db.Delete(&identity)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to look up identity: %v", err)
+	}
+
+	if claims.Email == "" {
+		return nil, &oidcLoginError{"Your identity provider did not share an email address."}
+	}
+
+	var user models.User
+	err = db.Where("LOWER(email) = LOWER(?)", claims.Email).First(&user).Error
+	if err == nil {
+		if err := checkOIDCEmailLink(claims, &user); err != nil {
+			return nil, err
+		}
+		if err := linkOIDCIdentity(db, provider, claims, user.ID); err != nil {
+			return nil, err
+		}
+		services.RecordSecurityEvent(db, user.Username, c.ClientIP(), services.SecurityEventSSOLinked, "Linked to "+provider.Issuer())
+		return &user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("failed to look up user: %v", err)
+	}
+
+	return provisionOIDCUser(c, db, provider, claims)
+}
+
+// checkOIDCEmailLink decides whether a login may link the account with the
+// same email address. The provider must vouch for the address; otherwise
+// anyone able to set an email there could take the account over. The account
+// must have verified it too, or someone could register it with the victim's
+// address ahead of time and keep the password.
+func checkOIDCEmailLink(claims *oidc.Claims, user *models.User) error {
+	if !claims.EmailVerified {
+		return &oidcLoginError{"An account with your email address exists, but your identity provider has not verified the address. Log in with your password instead."}
+	}
+	if user.EmailVerifiedAt == nil {
+		return &oidcLoginError{"An account with your email address exists, but its address hasn't been verified. Log in with your password, then link single sign-on from your account settings."}
+	}
+	return nil
+}
+
+// linkOIDCIdentity records that the provider's subject logs into the account
+func linkOIDCIdentity(db *gorm.DB, provider *oidc.Provider, claims *oidc.Claims, userID uint) error {
+	identity := models.UserIdentity{
+		UserID:      userID,
+		Issuer:      provider.Issuer(),
+		Subject:     claims.Subject,
+		Email:       claims.Email,
+		LastLoginAt: time.Now(),
+	}
+	if err := db.Create(&identity).Error; err != nil {
+		return fmt.Errorf("failed to link identity: %v", err)
+	}
+	return nil
+}
+
+// provisionOIDCUser creates an account for a first-time single sign-on user.
+// It gets an unguessable password that can be replaced with a password reset.
+func provisionOIDCUser(c *gin.Context, db *gorm.DB, provider *oidc.Provider, claims *oidc.Claims) (*models.User, error) {
+	// Soft-deleted accounts still hold on to their address
+	if db.Unscoped().Where("LOWER(email) = LOWER(?)", claims.Email).First(&models.User{}).Error == nil {
+		return nil, &oidcLoginError{"An account with your email address was deleted. Ask an admin to restore it."}
+	}
+
+	username, err := uniqueUsername(db, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := oidc.RandomString()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate password: %v", err)
+	}
+	hashedPassword, err := passwords.Hash(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	user := models.User{
+		Username: username,
+		Email:    claims.Email,
+		Password: hashedPassword,
+		Active:   true,
+	}
+	if claims.EmailVerified {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		return linkOIDCIdentity(tx, provider, claims, user.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	services.RecordSecurityEvent(db, user.Username, c.ClientIP(), services.SecurityEventSSOProvisioned, "Created from "+provider.Issuer())
+	return &user, nil
+}
+
+// uniqueUsername derives a free username from the preferred username or
+// the email address, adding a number when it's taken
+func uniqueUsername(db *gorm.DB, claims *oidc.Claims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = strings.Trim(usernameUnsafeChars.ReplaceAllString(base, "-"), "-.")
+	if len(base) > 50 {
+		base = base[:50]
+	}
+	if len(base) < 3 {
+		base = "user-" + base
+	}
+
+	for i := 1; i <= 100; i++ {
+		candidate := base
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", base, i)
+		}
+		err := db.Unscoped().Where("LOWER(username) = LOWER(?)", candidate).First(&models.User{}).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to check username: %v", err)
+		}
+	}
+	return "", fmt.Errorf("no free username for %s", base)
+}
+
+// syncOIDCGroups maps the user's IdP groups onto admin access, when admin
+// groups are configured, and onto memberships of the configured sync groups
+// with the same name. Group sync only adds memberships.
+func syncOIDCGroups(db *gorm.DB, cfg *oidc.Config, user *models.User, groups []string) error {
+	if len(cfg.AdminGroups) > 0 {
+		shouldBeAdmin := cfg.IsAdmin(groups)
+
+		var adminAccess models.AdminGroupMember
+		err := db.Where("user_id = ?", user.ID).First(&adminAccess).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("failed to check admin access: %v", err)
+		}
+		isAdmin := err == nil && adminAccess.Active
+
+		if shouldBeAdmin != isAdmin {
+			if err == nil {
+				err = db.Model(&adminAccess).Update("active", shouldBeAdmin).Error
+			} else {
+				err = db.Create(&models.AdminGroupMember{UserID: user.ID, Active: true}).Error
+			}
+			if err != nil {
+				return fmt.Errorf("failed to update admin access: %v", err)
+			}
+
+			// Tokens from other sessions still carry the old admin flag
+			if err := auth.RevokeUserSessions(db, user.ID); err != nil {
+				return fmt.Errorf("failed to revoke sessions: %v", err)
+			}
+		}
+	}
+
+	if synced := cfg.SyncedGroups(groups); len(synced) > 0 {
+		var userGroups []models.UserGroup
+		if err := db.Where("name IN ?", synced).Find(&userGroups).Error; err != nil {
+			return fmt.Errorf("failed to fetch groups: %v", err)
+		}
+		for _, group := range userGroups {
+			if _, err := services.AddMember(db, group.ID, user.ID, models.GroupRoleMember); err != nil {
+				return fmt.Errorf("failed to add membership of group %d: %v", group.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
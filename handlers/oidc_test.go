@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/oidc"
+)
+
+func TestCheckOIDCEmailLink(t *testing.T) {
+	verifiedAt := time.Now()
+
+	tests := []struct {
+		name          string
+		idpVerified   bool
+		accountVerify *time.Time
+		wantLink      bool
+	}{
+		{"both verified", true, &verifiedAt, true},
+		{"provider hasn't verified", false, &verifiedAt, false},
+		{"account hasn't verified", true, nil, false},
+		{"neither verified", false, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &oidc.Claims{Subject: "subject-1", Email: "alice@example.com", EmailVerified: tt.idpVerified}
+			user := &models.User{Email: "Alice@example.com", EmailVerifiedAt: tt.accountVerify}
+
+			err := checkOIDCEmailLink(claims, user)
+			if (err == nil) != tt.wantLink {
+				t.Fatalf("checkOIDCEmailLink() error = %v, want link %v", err, tt.wantLink)
+			}
+			if _, ok := err.(*oidcLoginError); err != nil && !ok {
+				t.Errorf("checkOIDCEmailLink() error = %T, want a message for the user", err)
+			}
+		})
+	}
+}
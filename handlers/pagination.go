@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"git.ssy.dk/noob/bingbong-go/services"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// listParams holds the page and sort order requested for a JSON list endpoint
+type listParams struct {
+	Page    int
+	PerPage int
+	Order   string
+}
+
+// parseListParams reads ?page=, ?per_page= and ?sort= from the query.
+// sort names one of the allowed fields, prefixed with "-" for descending.
+func parseListParams(page, perPage, sort string, sortable map[string]string, defaultSort string) (listParams, error) {
+	params := listParams{Page: 1, PerPage: defaultPageSize}
+
+	if page != "" {
+		parsed, err := strconv.Atoi(page)
+		if err != nil || parsed < 1 {
+			return params, fmt.Errorf("invalid page")
+		}
+		params.Page = parsed
+	}
+
+	if perPage != "" {
+		parsed, err := strconv.Atoi(perPage)
+		if err != nil || parsed < 1 {
+			return params, fmt.Errorf("invalid per_page")
+		}
+		params.PerPage = min(parsed, maxPageSize)
+	}
+
+	if sort == "" {
+		sort = defaultSort
+	}
+
+	direction := "ASC"
+	if field, ok := strings.CutPrefix(sort, "-"); ok {
+		sort = field
+		direction = "DESC"
+	}
+
+	column, ok := sortable[sort]
+	if !ok {
+		return params, fmt.Errorf("invalid sort field: %s", sort)
+	}
+	params.Order = column + " " + direction
+
+	return params, nil
+}
+
+// page returns the ordering and page window for a service query
+func (p listParams) page() services.Page {
+	return services.Page{Order: p.Order, Offset: (p.Page - 1) * p.PerPage, Limit: p.PerPage}
+}
+
+// meta describes the page for the response body
+func (p listParams) meta(total int64) map[string]interface{} {
+	return map[string]interface{}{
+		"page":     p.Page,
+		"per_page": p.PerPage,
+		"total":    total,
+	}
+}
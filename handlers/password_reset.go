@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	"git.ssy.dk/noob/bingbong-go/mailer"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// passwordResetSentMessage answers every forgotten password request, so it
+// can't be used to find out which addresses have accounts
+const passwordResetSentMessage = "If an account uses that address, we've sent it a link to reset the password."
+
+// ForgotPasswordPageHandler renders the form to request a reset link
+func ForgotPasswordPageHandler(c *gin.Context) {
+	t := c.MustGet("timing").(*timing.RenderTiming)
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	t.StartTemplate()
+	templates.ForgotPassword(t).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+const (
+	// passwordResetWindow is the window reset requests are counted in
+	passwordResetWindow = time.Hour
+	// maxResetsPerEmail limits how many links one address can be sent
+	maxResetsPerEmail = 3
+	// maxResetsPerIP limits how many addresses one client can ask links for
+	maxResetsPerIP = 10
+)
+
+// checkPasswordResetAllowed answers 429 and returns false once the address
+// or the client asked for too many reset links. Like logins it fails open.
+func checkPasswordResetAllowed(c *gin.Context, limiter *loginlimit.Limiter, email string) bool {
+	if limiter == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+
+	keys := map[string]int64{
+		"reset:email:" + loginlimit.NormalizeName(email): maxResetsPerEmail,
+		"reset:ip:" + c.ClientIP():                       maxResetsPerIP,
+	}
+	var wait time.Duration
+	for key, limit := range keys {
+		keyWait, err := limiter.Hit(ctx, key, limit, passwordResetWindow)
+		if err != nil {
+			log.Printf("Failed to check password reset limits: %v", err)
+			continue
+		}
+		if keyWait > wait {
+			wait = keyWait
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	tooManyRequests(c, wait, "Too many password reset requests, try again later")
+	return false
+}
+
+// ForgotPasswordHandler emails a reset link to the account with the address
+func ForgotPasswordHandler(db *gorm.DB, limiter *loginlimit.Limiter, mail mailer.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var forgotRequest struct {
+			Email string `form:"email" json:"email" binding:"required,email"`
+		}
+		if err := c.ShouldBind(&forgotRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !checkPasswordResetAllowed(c, limiter, forgotRequest.Email) {
+			return
+		}
+
+		// Look the account up, create the token and send the mail in the
+		// background, so the response takes as long whether or not the
+		// address has an account
+		link := absoluteURL(c, "/reset-password?token=")
+		go sendPasswordReset(db, mail, strings.TrimSpace(forgotRequest.Email), link)
+
+		c.JSON(http.StatusOK, gin.H{"message": passwordResetSentMessage})
+	}
+}
+
+// sendPasswordReset mails a reset link to the account with the address, if
+// there is one. Only active accounts with a verified address get a link.
+func sendPasswordReset(db *gorm.DB, mail mailer.Mailer, email, link string) {
+	var user models.User
+	err := db.Where("LOWER(email) = LOWER(?) AND active = ? AND email_verified_at IS NOT NULL",
+		email, true).First(&user).Error
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Failed to look up account for password reset: %v", err)
+		}
+		return
+	}
+
+	token, err := auth.CreatePasswordResetToken(db, user.ID)
+	if err != nil {
+		log.Printf("Failed to create password reset token for user %d: %v", user.ID, err)
+		return
+	}
+
+	sendPasswordResetEmail(mail, user, link+token)
+}
+
+// sendPasswordResetEmail mails a user their reset link
+func sendPasswordResetEmail(m mailer.Mailer, user models.User, link string) {
+	body := fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your bingbong account. Follow this link to choose a new one:\n\n%s\n\nThe link expires in %d minutes and can be used once. If you didn't ask for it, ignore this email; your password stays the same.\n",
+		user.Username, link, int(auth.PasswordResetTTL.Minutes()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := m.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+	}
+}
+
+// ResetPasswordPageHandler renders the form to choose a new password
+func ResetPasswordPageHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+
+		token := c.Query("token")
+		_, err := auth.FindPasswordResetToken(db, token)
+
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		if err != nil {
+			c.Status(http.StatusBadRequest)
+		}
+		t.StartTemplate()
+		templates.ResetPassword(t, token, err == nil).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
+}
+
+// ResetPasswordHandler sets a new password with a reset token and logs the
+// account out everywhere
+func ResetPasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resetRequest struct {
+			Token           string `form:"token" json:"token" binding:"required"`
+			Password        string `form:"password" json:"password" binding:"required"`
+			ConfirmPassword string `form:"confirm_password" json:"confirm_password" binding:"required"`
+		}
+		if err := c.ShouldBind(&resetRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if resetRequest.Password != resetRequest.ConfirmPassword {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords do not match"})
+			return
+		}
+
+		reset, err := auth.FindPasswordResetToken(db, resetRequest.Token)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This reset link is invalid or has expired"})
+			return
+		}
+
+		var user models.User
+		if err := db.Where("id = ? AND active = ?", reset.UserID, true).First(&user).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This reset link is invalid or has expired"})
+			return
+		}
+
+		if err := passwords.Validate(resetRequest.Password, user.Username); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := auth.ConsumePasswordResetToken(tx, reset); err != nil {
+				return err
+			}
+			return setUserPassword(tx, &user, resetRequest.Password)
+		})
+		if err == auth.ErrInvalidResetToken {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This reset link is invalid or has expired"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
+			return
+		}
+
+		// Whoever knew the old password is logged out
+		if err := auth.RevokeUserSessions(db, user.ID); err != nil {
+			log.Printf("Failed to revoke sessions of user %d after password reset: %v", user.ID, err)
+		}
+		services.RecordSecurityEvent(db, user.Username, c.ClientIP(), services.SecurityEventPasswordReset, "Password reset by email link")
+
+		c.JSON(http.StatusOK, gin.H{"message": "Your password has been reset. You can now log in."})
+	}
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import "strings"
+
+// localRedirect only lets logins continue to paths on this site. Anything
+// else, including protocol-relative URLs and paths browsers would rewrite
+// into one, becomes the empty string.
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return ""
+	}
+	// Browsers drop tabs and newlines, so "/\t/evil.example" means "//evil.example"
+	if strings.ContainsAny(redirect, "\t\r\n") {
+		return ""
+	}
+	return redirect
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import "testing"
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		redirect string
+		want     string
+	}{
+		{"", ""},
+		{"/user/dashboard", "/user/dashboard"},
+		{"/groups/1?tab=members", "/groups/1?tab=members"},
+		{"https://evil.example", ""},
+		{"//evil.example", ""},
+		{"/\\evil.example", ""},
+		{"/\t/evil.example", ""},
+		{"javascript:alert(1)", ""},
+		{"user/dashboard", ""},
+	}
+
+	for _, tt := range tests {
+		if got := localRedirect(tt.redirect); got != tt.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", tt.redirect, got, tt.want)
+		}
+	}
+}
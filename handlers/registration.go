@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/mailer"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// verificationSentMessage is shown after registering or asking for a new
+// link; it never reveals whether the address belongs to an account
+const verificationSentMessage = "If the address needs verifying, we've sent a link to it. Follow it to activate your account."
+
+// absoluteURL builds a link for emails. APP_BASE_URL should be set in
+// production so links can't be pointed elsewhere through the Host header.
+func absoluteURL(c *gin.Context, path string) string {
+	if base := strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/"); base != "" {
+		return base + path
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + path
+}
+
+// sendVerificationEmail mails a user the link that activates their account
+func sendVerificationEmail(c *gin.Context, mail mailer.Mailer, user *models.User) error {
+	token, err := auth.GenerateEmailVerificationToken(user)
+	if err != nil {
+		return fmt.Errorf("failed to generate verification token: %v", err)
+	}
+
+	link := absoluteURL(c, "/verify-email?token="+token)
+	body := fmt.Sprintf("Hi %s,\n\nConfirm your email address to activate your bingbong account:\n\n%s\n\nThe link expires in %d hours. If you didn't sign up, ignore this email.\n",
+		user.Username, link, int(auth.EmailVerificationTTL.Hours()))
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+
+	return mail.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body:    body,
+	})
+}
+
+// RegisterPageHandler renders the registration form
+func RegisterPageHandler(c *gin.Context) {
+	t := c.MustGet("timing").(*timing.RenderTiming)
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	t.StartTemplate()
+	templates.Register(t).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// RegisterHandler creates an inactive account and emails its verification link
+func RegisterHandler(db *gorm.DB, mail mailer.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var registerRequest struct {
+			Username        string `form:"username" json:"username" binding:"required,min=3,max=255"`
+			Email           string `form:"email" json:"email" binding:"required,email,max=255"`
+			Password        string `form:"password" json:"password" binding:"required"`
+			ConfirmPassword string `form:"confirm_password" json:"confirm_password" binding:"required"`
+		}
+
+		if err := c.ShouldBind(&registerRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		registerRequest.Username = strings.TrimSpace(registerRequest.Username)
+		registerRequest.Email = strings.TrimSpace(registerRequest.Email)
+
+		if registerRequest.Password != registerRequest.ConfirmPassword {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords do not match"})
+			return
+		}
+		if err := passwords.Validate(registerRequest.Password, registerRequest.Username); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Check if username or email already exists
+		var existingUser models.User
+		if db.Unscoped().Where("LOWER(username) = LOWER(?)", registerRequest.Username).First(&existingUser).Error == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username is already taken"})
+			return
+		}
+		if db.Unscoped().Where("LOWER(email) = LOWER(?)", registerRequest.Email).First(&existingUser).Error == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is already registered"})
+			return
+		}
+
+		hashedPassword, err := passwords.Hash(registerRequest.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+
+		// The account stays inactive until the address is verified
+		user := models.User{
+			Username: registerRequest.Username,
+			Email:    registerRequest.Email,
+			Password: hashedPassword,
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+			// Active defaults to true in the schema, so it's cleared explicitly
+			return tx.Model(&user).Update("active", false).Error
+		})
+		if err != nil {
+			// Most likely lost a race against another registration for the same name or address
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already exists"})
+			return
+		}
+
+		if err := sendVerificationEmail(c, mail, &user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"message": "Account created. Check your email for a link to activate it."})
+	}
+}
+
+// ResendVerificationHandler sends a new verification link to an account
+// that hasn't been verified yet
+func ResendVerificationHandler(db *gorm.DB, mail mailer.Mailer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resendRequest struct {
+			Email string `form:"email" json:"email" binding:"required,email"`
+		}
+		if err := c.ShouldBind(&resendRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var user models.User
+		err := db.Where("LOWER(email) = LOWER(?) AND email_verified_at IS NULL", strings.TrimSpace(resendRequest.Email)).First(&user).Error
+		if err == nil {
+			if err := sendVerificationEmail(c, mail, &user); err != nil {
+				log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": verificationSentMessage})
+	}
+}
+
+// VerifyEmailHandler activates an account from its emailed link
+func VerifyEmailHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+
+		render := func(status int, verified bool, message string) {
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			c.Status(status)
+			t.StartTemplate()
+			templates.VerifyEmail(t, verified, message).Render(c.Request.Context(), c.Writer)
+			t.EndTemplate()
+		}
+
+		claims, err := auth.ParseEmailVerificationToken(c.Query("token"))
+		if err != nil {
+			render(http.StatusBadRequest, false, "This verification link is invalid or has expired. Request a new one below.")
+			return
+		}
+
+		// The link only verifies the address it was sent to
+		var user models.User
+		if err := db.Where("id = ? AND email = ?", claims.UserID, claims.Email).First(&user).Error; err != nil {
+			render(http.StatusBadRequest, false, "This verification link is no longer valid. Request a new one below.")
+			return
+		}
+
+		if user.EmailVerifiedAt != nil {
+			render(http.StatusOK, true, "Your email address is already verified. You can log in.")
+			return
+		}
+
+		// Only activate accounts still waiting for verification, so an old link
+		// can't reactivate an account an admin has since disabled
+		result := db.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", user.ID).
+			Updates(map[string]interface{}{
+				"email_verified_at": time.Now(),
+				"active":            true,
+			})
+		if result.Error != nil {
+			render(http.StatusInternalServerError, false, "We couldn't verify your email address. Please try again.")
+			return
+		}
+
+		render(http.StatusOK, true, "Your email address is verified and your account is active. You can log in.")
+	}
+}
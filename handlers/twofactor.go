@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	"git.ssy.dk/noob/bingbong-go/middleware"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"git.ssy.dk/noob/bingbong-go/templates"
+	"git.ssy.dk/noob/bingbong-go/timing"
+	"github.com/gin-gonic/gin"
+)
+
+// renderTwoFactor answers HTMX requests with the two-factor settings card.
+// setupURI is set while enrolling and recoveryCodes right after they're issued.
+func renderTwoFactor(c *gin.Context, twoFactor services.TwoFactorService, setupURI string, recoveryCodes []string) {
+	status, err := twoFactor.TwoFactorStatus(c.MustGet("userID").(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch two-factor settings"})
+		return
+	}
+
+	t := c.MustGet("timing").(*timing.RenderTiming)
+	t.StartTemplate()
+	templates.UserTwoFactor(status.User, status.Required, setupURI, recoveryCodes, status.RecoveryCodesRemaining).Render(c.Request.Context(), c.Writer)
+	t.EndTemplate()
+}
+
+// twoFactorError answers with the status and message for a TwoFactorService error
+func twoFactorError(c *gin.Context, err error, failure string) {
+	switch {
+	case errors.Is(err, services.ErrTwoFactorEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is already enabled"})
+	case errors.Is(err, services.ErrTwoFactorNotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+	case errors.Is(err, services.ErrTwoFactorNotStarted):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start two-factor setup first"})
+	case errors.Is(err, services.ErrTwoFactorRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your account"})
+	case errors.Is(err, services.ErrWrongPassword):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+	case errors.Is(err, services.ErrInvalidCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authentication code"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": failure})
+	}
+}
+
+// GetTwoFactorHandler shows whether two-factor authentication is enabled
+func GetTwoFactorHandler(twoFactor services.TwoFactorService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("HX-Request") != "" {
+			renderTwoFactor(c, twoFactor, "", nil)
+			return
+		}
+
+		status, err := twoFactor.TwoFactorStatus(c.MustGet("userID").(uint))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch two-factor settings"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":                  status.User.TOTPEnabled,
+			"required":                 status.Required,
+			"recovery_codes_remaining": status.RecoveryCodesRemaining,
+		})
+	}
+}
+
+// BeginTwoFactorSetupHandler generates a new TOTP secret for the user to add
+// to their authenticator app. It isn't used for login until confirmed with
+// EnableTwoFactorHandler.
+func BeginTwoFactorSetupHandler(twoFactor services.TwoFactorService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		secret, uri, err := twoFactor.BeginTwoFactorSetup(c.MustGet("userID").(uint))
+		if err != nil {
+			twoFactorError(c, err, "Failed to generate secret")
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderTwoFactor(c, twoFactor, uri, nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret":           secret,
+			"provisioning_uri": uri,
+		})
+	}
+}
+
+// EnableTwoFactorHandler confirms enrollment with a code from the app, then
+// issues recovery codes. Other sessions are logged out and this one gets a
+// fresh token, which picks up admin access if it was waiting on two-factor.
+func EnableTwoFactorHandler(twoFactor services.TwoFactorService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var enableRequest struct {
+			Code string `form:"code" json:"code" binding:"required"`
+		}
+		if err := c.ShouldBind(&enableRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		recoveryCodes, pair, err := twoFactor.EnableTwoFactor(c.MustGet("userID").(uint), enableRequest.Code,
+			c.Request.UserAgent(), c.ClientIP())
+		if errors.Is(err, services.ErrInvalidCode) {
+			// A wrong code here only fails enrollment, it doesn't log anyone in
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid authentication code"})
+			return
+		}
+		if err != nil {
+			twoFactorError(c, err, "Failed to enable two-factor authentication")
+			return
+		}
+		middleware.SetSessionCookies(c, pair)
+		c.Header("X-Access-Token", pair.AccessToken)
+
+		if c.GetHeader("HX-Request") != "" {
+			renderTwoFactor(c, twoFactor, "", recoveryCodes)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"recovery_codes": recoveryCodes,
+			"token":          pair.AccessToken,
+			"refresh_token":  pair.RefreshToken,
+			"expires_in":     int(auth.TokenTTL.Seconds()),
+		})
+	}
+}
+
+// DisableTwoFactorHandler turns two-factor authentication off after checking
+// the password and a current code. Admins required to use it can't.
+func DisableTwoFactorHandler(twoFactor services.TwoFactorService, security services.SecurityService, limiter *loginlimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var disableRequest struct {
+			Password string `form:"password" json:"password" binding:"required"`
+			Code     string `form:"code" json:"code" binding:"required"`
+		}
+		if err := c.ShouldBind(&disableRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A stolen session shouldn't get unlimited guesses at the password and code
+		username := c.MustGet("username").(string)
+		if !checkLoginAllowed(c, limiter, username) {
+			return
+		}
+
+		err := twoFactor.DisableTwoFactor(c.MustGet("userID").(uint), disableRequest.Password, disableRequest.Code)
+		if errors.Is(err, services.ErrWrongPassword) || errors.Is(err, services.ErrInvalidCode) {
+			loginFailed(c, security, limiter, username)
+		}
+		if err != nil {
+			twoFactorError(c, err, "Failed to disable two-factor authentication")
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderTwoFactor(c, twoFactor, "", nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// RegenerateRecoveryCodesHandler replaces the user's recovery codes after
+// checking a current code
+func RegenerateRecoveryCodesHandler(twoFactor services.TwoFactorService, security services.SecurityService, limiter *loginlimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var regenerateRequest struct {
+			Code string `form:"code" json:"code" binding:"required"`
+		}
+		if err := c.ShouldBind(&regenerateRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		username := c.MustGet("username").(string)
+		if !checkLoginAllowed(c, limiter, username) {
+			return
+		}
+
+		recoveryCodes, err := twoFactor.RegenerateRecoveryCodes(c.MustGet("userID").(uint), regenerateRequest.Code)
+		if errors.Is(err, services.ErrInvalidCode) {
+			loginFailed(c, security, limiter, username)
+		}
+		if err != nil {
+			twoFactorError(c, err, "Failed to generate recovery codes")
+			return
+		}
+
+		if c.GetHeader("HX-Request") != "" {
+			renderTwoFactor(c, twoFactor, "", recoveryCodes)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": recoveryCodes})
+	}
+}
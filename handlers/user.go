@@ -2,25 +2,285 @@
 package handlers
 
 import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"github.com/gin-gonic/gin"
 )
 
-func CreateUser(c *gin.Context) {
-	// Implementation
+// UserResponse is the JSON form of a user; it never carries the password.
+// Email, activity and admin details are only filled in for admins and the user themselves.
+type UserResponse struct {
+	ID        uint       `json:"id"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email,omitempty"`
+	PublicKey string     `json:"public_key,omitempty"`
+	Active    *bool      `json:"active,omitempty"`
+	Role      string     `json:"role,omitempty"`
+	IsAdmin   *bool      `json:"is_admin,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+}
+
+// userSortFields maps the ?sort= values of GetUsers to columns
+var userSortFields = map[string]string{
+	"id":         "id",
+	"username":   "username",
+	"created_at": "created_at",
+	"last_login": "last_login",
+}
+
+// newUserResponse builds the DTO for a user with AdminAccess preloaded
+func newUserResponse(user models.User, private bool) UserResponse {
+	response := UserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		PublicKey: user.PublicKey,
+		CreatedAt: user.CreatedAt,
+	}
+
+	if private {
+		isAdmin := false
+		for _, access := range user.AdminAccess {
+			isAdmin = isAdmin || access.Active
+		}
+
+		response.Email = user.Email
+		response.Active = &user.Active
+		response.Role = user.Role
+		response.IsAdmin = &isAdmin
+		if !user.LastLogin.IsZero() {
+			response.LastLogin = &user.LastLogin
+		}
+	}
+
+	return response
+}
+
+// userError answers a UserService error; it reports whether there was one
+func userError(c *gin.Context, err error, conflict int, fallback string) bool {
+	var inputErr *services.InputError
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, services.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, services.ErrUserExists):
+		c.JSON(conflict, gin.H{"error": "Username or email already exists"})
+	case errors.Is(err, services.ErrInvalidRole):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Role must be user or moderator"})
+	case errors.As(err, &inputErr):
+		c.JSON(http.StatusBadRequest, gin.H{"error": inputErr.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+	return true
 }
 
-func GetUsers(c *gin.Context) {
-	// Implementation
+// CreateUser creates a user; admins only
+func CreateUser(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.MustGet("isAdmin").(bool) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+
+		var userRequest struct {
+			Username  string `json:"username" binding:"required,min=3,max=255"`
+			Email     string `json:"email" binding:"required,email,max=255"`
+			Password  string `json:"password" binding:"required"`
+			PublicKey string `json:"public_key"`
+			Role      string `json:"role"`
+			IsAdmin   bool   `json:"is_admin"`
+		}
+
+		if err := c.ShouldBindJSON(&userRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := users.CreateUser(services.NewUser{
+			Username:  userRequest.Username,
+			Email:     userRequest.Email,
+			Password:  userRequest.Password,
+			PublicKey: userRequest.PublicKey,
+			Role:      userRequest.Role,
+			IsAdmin:   userRequest.IsAdmin,
+		})
+		if userError(c, err, http.StatusConflict, "Failed to create user") {
+			return
+		}
+
+		c.JSON(http.StatusCreated, newUserResponse(*user, true))
+	}
+}
+
+// GetUsers lists users with pagination, ?q= search and ?sort= ordering.
+// Non-admins only see active users and only search by username.
+func GetUsers(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+		isAdmin := c.MustGet("isAdmin").(bool)
+
+		params, err := parseListParams(c.Query("page"), c.Query("per_page"), c.Query("sort"), userSortFields, "username")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		query := services.UserQuery{Search: c.Query("q"), SearchEmail: isAdmin, Page: params.page()}
+		if !isAdmin {
+			active := true
+			query.Active = &active
+		} else if active := c.Query("active"); active != "" {
+			parsed, err := strconv.ParseBool(active)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid active filter"})
+				return
+			}
+			query.Active = &parsed
+		}
+
+		found, total, err := users.ListUsers(query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
+
+		result := make([]UserResponse, len(found))
+		for i, user := range found {
+			result[i] = newUserResponse(user, isAdmin || user.ID == userID)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"users": result,
+			"meta":  params.meta(total),
+		})
+	}
 }
 
-func GetUser(c *gin.Context) {
-	// Implementation
+// GetUser returns a single user
+func GetUser(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+		isAdmin := c.MustGet("isAdmin").(bool)
+
+		targetID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		user, err := users.GetUser(uint(targetID))
+		if userError(c, err, http.StatusConflict, "Failed to fetch user") {
+			return
+		}
+
+		private := isAdmin || user.ID == userID
+		if !user.Active && !private {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newUserResponse(*user, private))
+	}
 }
 
-func UpdateUser(c *gin.Context) {
-	// Implementation
+// UpdateUser partially updates a user. Users may change their own username
+// and public key; only admins may change other users, email addresses,
+// passwords, the active flag, the role and admin access. A verified address
+// lets users into email-restricted groups, so users can't swap it for one
+// they haven't verified.
+func UpdateUser(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+		isAdmin := c.MustGet("isAdmin").(bool)
+
+		targetID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		if !isAdmin && uint(targetID) != userID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to edit this user"})
+			return
+		}
+
+		var userRequest struct {
+			Username  *string `json:"username" binding:"omitempty,min=3,max=255"`
+			Email     *string `json:"email" binding:"omitempty,email,max=255"`
+			Password  *string `json:"password"`
+			PublicKey *string `json:"public_key"`
+			Active    *bool   `json:"active"`
+			Role      *string `json:"role"`
+			IsAdmin   *bool   `json:"is_admin"`
+		}
+
+		if err := c.ShouldBindJSON(&userRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !isAdmin && (userRequest.Email != nil || userRequest.Password != nil || userRequest.Active != nil || userRequest.Role != nil || userRequest.IsAdmin != nil) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can change email addresses, passwords, activity, roles or admin access here"})
+			return
+		}
+
+		changes := services.UserChanges{
+			Username:  userRequest.Username,
+			Email:     userRequest.Email,
+			Password:  userRequest.Password,
+			PublicKey: userRequest.PublicKey,
+			Active:    userRequest.Active,
+			Role:      userRequest.Role,
+			IsAdmin:   userRequest.IsAdmin,
+		}
+		// Admins changing their own password stay logged in here
+		if uint(targetID) == userID {
+			changes.KeepSessionID = c.MustGet("claims").(*auth.Claims).SessionID
+		}
+
+		user, err := users.UpdateUser(uint(targetID), changes)
+		if userError(c, err, http.StatusConflict, "Failed to update user") {
+			return
+		}
+
+		c.JSON(http.StatusOK, newUserResponse(*user, true))
+	}
 }
 
-func DeleteUser(c *gin.Context) {
-	// Implementation
+// DeleteUser deletes a user; admins only
+func DeleteUser(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		if !c.MustGet("isAdmin").(bool) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+
+		targetID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+
+		if uint(targetID) == userID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "You can't delete your own account"})
+			return
+		}
+
+		// Hand the user's groups to other members and delete the user
+		if userError(c, users.DeleteUser(uint(targetID)), http.StatusConflict, "Failed to delete user") {
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
 }
@@ -1,266 +1,199 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/middleware"
 	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"git.ssy.dk/noob/bingbong-go/templates"
 	"git.ssy.dk/noob/bingbong-go/timing"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
 // UserDashboardHandler renders the main user dashboard
-func UserDashboardHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
+func UserDashboardHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
 
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
 
-	t.StartTemplate()
-	templates.UserDashboard(user, "account").Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
+		t.StartTemplate()
+		templates.UserDashboard(*user, "account").Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
 }
 
 // UserGroupsHandler renders the groups tab of the user dashboard
-func UserGroupsHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
+func UserGroupsHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
 
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
 
-	t.StartTemplate()
-	templates.UserDashboard(user, "groups").Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
+		t.StartTemplate()
+		templates.UserDashboard(*user, "groups").Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
 }
 
 // GetUserGroupsDataHandler fetches and renders just the groups list - updated
-func GetUserGroupsDataHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
-
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
-
-	// Get groups where user is a member or creator
-	var groups []models.UserGroup
-	if err := db.Preload("Creator").Preload("Members.User").
-		Joins("LEFT JOIN user_group_members ON user_groups.id = user_group_members.group_id").
-		Where("user_groups.created_by_id = ? OR user_group_members.user_id = ?", userID, userID).
-		Group("user_groups.id").Find(&groups).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
-		return
+func GetUserGroupsDataHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderUserGroups(c, users, groups, c.MustGet("userID").(uint))
 	}
-
-	t.StartTemplate()
-	templates.UserGroups(user, groups).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // DeleteGroupHandler deletes a user group
-func DeleteGroupHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
-
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
-	}
-
-	// Verify the group exists and the user is the creator
-	var group models.UserGroup
-	if err := db.First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
-
-	// Only the creator can delete the group
-	if group.CreatedByID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to delete this group"})
-		return
-	}
+func DeleteGroupHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
 
-	// Delete the group
-	if err := db.Delete(&group).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
-		return
-	}
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	// Get user data
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		// RequireGroupPermission has checked the user may delete the group
+		err = groups.DeleteGroup(uint(groupID))
+		if errors.Is(err, services.ErrGroupNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete group"})
+			return
+		}
 
-	// Return the updated groups list
-	var groups []models.UserGroup
-	if err := db.Preload("Creator").Preload("Members.User").
-		Joins("LEFT JOIN user_group_members ON user_groups.id = user_group_members.group_id").
-		Where("user_groups.created_by_id = ? OR user_group_members.user_id = ?", userID, userID).
-		Group("user_groups.id").Find(&groups).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
-		return
+		// Return the updated groups list
+		renderUserGroups(c, users, groups, userID)
 	}
-
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	t.StartTemplate()
-	templates.UserGroups(user, groups).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // UserInvitesHandler renders the invitations tab of the user dashboard
-func UserInvitesHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
+func UserInvitesHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
 
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
 
-	t.StartTemplate()
-	templates.UserDashboard(user, "invites").Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
+		t.StartTemplate()
+		templates.UserDashboard(*user, "invites").Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
+	}
 }
 
 // GetUserInvitesDataHandler fetches and renders just the invitations lists
-func GetUserInvitesDataHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
-
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
-
-	// Get sent invites
-	var sentInvites []models.UserGroupInvite
-	if err := db.Preload("Group").Preload("Invitee").
-		Where("invite_initiator_id = ?", userID).
-		Find(&sentInvites).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sent invites"})
-		return
-	}
-
-	// Get received invites
-	var receivedInvites []models.UserGroupInvite
-	if err := db.Preload("Group").Preload("Initiator").
-		Where("invitee_id = ? AND accepted = ?", userID, false).
-		Find(&receivedInvites).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch received invites"})
-		return
+func GetUserInvitesDataHandler(users services.UserService, invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderUserInvites(c, users, invites, c.MustGet("userID").(uint))
 	}
-
-	t.StartTemplate()
-	templates.UserInvites(user, sentInvites, receivedInvites).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // UpdateUserPasswordHandler updates the user's password
-func UpdateUserPasswordHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
-
-	var passwordRequest struct {
-		CurrentPassword string `form:"current_password" binding:"required"`
-		NewPassword     string `form:"new_password" binding:"required"`
-		ConfirmPassword string `form:"confirm_password" binding:"required"`
-	}
+func UpdateUserPasswordHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		var passwordRequest struct {
+			CurrentPassword string `form:"current_password" binding:"required"`
+			NewPassword     string `form:"new_password" binding:"required"`
+			ConfirmPassword string `form:"confirm_password" binding:"required"`
+		}
 
-	if err := c.ShouldBind(&passwordRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+		if err := c.ShouldBind(&passwordRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	// Verify passwords match
-	if passwordRequest.NewPassword != passwordRequest.ConfirmPassword {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "New passwords do not match"})
-		return
-	}
+		// Verify passwords match
+		if passwordRequest.NewPassword != passwordRequest.ConfirmPassword {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "New passwords do not match"})
+			return
+		}
 
-	// Get the user
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		// Get the user
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+			return
+		}
 
-	// Verify current password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(passwordRequest.CurrentPassword)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
-		return
-	}
+		// Verify current password
+		if ok, _ := passwords.Verify(user.Password, passwordRequest.CurrentPassword); !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+			return
+		}
 
-	// Hash the new password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(passwordRequest.NewPassword), bcrypt.DefaultCost)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-		return
+		// Validate, hash and update the password, logging out other devices
+		_, err = users.UpdateUser(userID, services.UserChanges{
+			Password:      &passwordRequest.NewPassword,
+			KeepSessionID: c.MustGet("claims").(*auth.Claims).SessionID,
+		})
+		if userError(c, err, http.StatusConflict, "Failed to update password") {
+			return
+		}
+
+		// Return success message
+		c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
 	}
+}
 
-	// Update the password
-	user.Password = string(hashedPassword)
-	if err := db.Save(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password"})
-		return
+// setUserPassword hashes a new password and stores it for the user
+func setUserPassword(db *gorm.DB, user *models.User, password string) error {
+	hashedPassword, err := passwords.Hash(password)
+	if err != nil {
+		return err
 	}
 
-	// Return success message
-	c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
+	user.Password = hashedPassword
+	return db.Model(user).Update("password", user.Password).Error
 }
 
 // UpdateUserPublicKeyHandler updates the user's public key
-func UpdateUserPublicKeyHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
+func UpdateUserPublicKeyHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
 
-	var keyRequest struct {
-		PublicKey string `form:"public_key"`
-	}
+		var keyRequest struct {
+			PublicKey string `form:"public_key"`
+		}
 
-	if err := c.ShouldBind(&keyRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+		if err := c.ShouldBind(&keyRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	// Get the user
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		// Update the public key
+		_, err := users.UpdateUser(userID, services.UserChanges{PublicKey: &keyRequest.PublicKey})
+		if userError(c, err, http.StatusConflict, "Failed to update public key") {
+			return
+		}
 
-	// Update the public key
-	user.PublicKey = keyRequest.PublicKey
-	if err := db.Save(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update public key"})
-		return
+		// Return success message
+		c.JSON(http.StatusOK, gin.H{"message": "Public key updated successfully"})
 	}
-
-	// Return success message
-	c.JSON(http.StatusOK, gin.H{"message": "Public key updated successfully"})
 }
 
 // GetCreateGroupFormHandler returns the form for creating a new group
@@ -273,541 +206,396 @@ func GetCreateGroupFormHandler(c *gin.Context) {
 }
 
 // GetEditGroupFormHandler returns the form for editing a group
-func GetEditGroupFormHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
+func GetEditGroupFormHandler(groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
 
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
-	}
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	var group models.UserGroup
-	if err := db.First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
+		group, err := groups.GetGroup(uint(groupID))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
 
-	// Verify user owns the group
-	if group.CreatedByID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to edit this group"})
-		return
+		t.StartTemplate()
+		templates.EditGroupForm(*group).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
 	}
-
-	t.StartTemplate()
-	templates.EditGroupForm(group).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // GetGroupDetailHandler returns the detailed view of a group
-func GetGroupDetailHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
-
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
-	}
+func GetGroupDetailHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
 
-	var group models.UserGroup
-	if err := db.Preload("Creator").Preload("Members.User").First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	// Verify user is a member of the group or the creator
-	isMember := false
-	if group.CreatedByID == userID {
-		isMember = true
-	} else {
-		for _, member := range group.Members {
-			if member.UserID == userID {
-				isMember = true
-				break
-			}
+		group, err := groups.GetGroup(uint(groupID))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
 		}
-	}
 
-	if !isMember {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to view this group"})
-		return
+		t.StartTemplate()
+		templates.GroupDetail(*group, userID, middleware.GroupAccessFromContext(c), groupPresence(hub, *group)).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
 	}
-
-	t.StartTemplate()
-	templates.GroupDetail(group, userID).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // CreateGroupHandler creates a new group - updated
-func CreateGroupHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
-
-	var groupRequest struct {
-		Name        string `form:"name" binding:"required"`
-		Description string `form:"description"`
-	}
-
-	if err := c.ShouldBind(&groupRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Check if group name already exists
-	var existingGroup models.UserGroup
-	if db.Where("name = ?", groupRequest.Name).First(&existingGroup).Error == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Group name already exists"})
-		return
-	}
-
-	// Create the group
-	group := models.UserGroup{
-		Name:        groupRequest.Name,
-		Description: groupRequest.Description,
-		CreatedByID: userID,
-	}
+func CreateGroupHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		var groupRequest struct {
+			Name        string `form:"name" binding:"required"`
+			Description string `form:"description"`
+			Visibility  string `form:"visibility"`
+		}
 
-	if err := db.Create(&group).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
-		return
-	}
+		if err := c.ShouldBind(&groupRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	// Add creator as a member
-	membership := models.UserGroupMember{
-		UserID:  userID,
-		GroupID: group.ID,
-	}
-	if err := db.Create(&membership).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add you as a member"})
-		return
-	}
+		if groupRequest.Visibility == "" {
+			groupRequest.Visibility = models.GroupVisibilityPrivate
+		}
+		if !models.ValidGroupVisibility(groupRequest.Visibility) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid visibility"})
+			return
+		}
 
-	// Get user data
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		// Create the group with its creator as owner
+		_, err := groups.CreateGroup(services.NewGroup{
+			Name:        groupRequest.Name,
+			Description: groupRequest.Description,
+			Visibility:  groupRequest.Visibility,
+			OwnerID:     userID,
+		})
+		if errors.Is(err, services.ErrGroupNameTaken) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Group name already exists"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
+			return
+		}
 
-	// Return the updated groups list
-	var groups []models.UserGroup
-	if err := db.Preload("Creator").Preload("Members.User").
-		Joins("LEFT JOIN user_group_members ON user_groups.id = user_group_members.group_id").
-		Where("user_groups.created_by_id = ? OR user_group_members.user_id = ?", userID, userID).
-		Group("user_groups.id").Find(&groups).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
-		return
+		// Return the updated groups list
+		renderUserGroups(c, users, groups, userID)
 	}
-
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	t.StartTemplate()
-	templates.UserGroups(user, groups).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // UpdateGroupHandler updates an existing group - updated
-func UpdateGroupHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
+func UpdateGroupHandler(users services.UserService, groups services.GroupService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
 
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
-	}
-
-	var groupRequest struct {
-		Name        string `form:"name" binding:"required"`
-		Description string `form:"description"`
-	}
-
-	if err := c.ShouldBind(&groupRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Get the existing group
-	var group models.UserGroup
-	if err := db.First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	// Verify user owns the group
-	if group.CreatedByID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to edit this group"})
-		return
-	}
+		var groupRequest struct {
+			Name        string `form:"name" binding:"required"`
+			Description string `form:"description"`
+			Visibility  string `form:"visibility"`
+		}
 
-	// Update group fields
-	group.Name = groupRequest.Name
-	group.Description = groupRequest.Description
+		if err := c.ShouldBind(&groupRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	// Update the group
-	if err := db.Save(&group).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update group"})
-		return
-	}
+		changes := services.GroupChanges{
+			Name:        &groupRequest.Name,
+			Description: &groupRequest.Description,
+		}
+		if groupRequest.Visibility != "" {
+			changes.Visibility = &groupRequest.Visibility
+		}
 
-	// Get user data for the response
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
-		return
-	}
+		_, err = groups.UpdateGroup(uint(groupID), changes)
+		if groupUpdateError(c, err, http.StatusBadRequest) {
+			return
+		}
 
-	// Return the updated groups list
-	var groups []models.UserGroup
-	if err := db.Preload("Creator").Preload("Members.User").
-		Joins("LEFT JOIN user_group_members ON user_groups.id = user_group_members.group_id").
-		Where("user_groups.created_by_id = ? OR user_group_members.user_id = ?", userID, userID).
-		Group("user_groups.id").Find(&groups).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch groups"})
-		return
+		// Return the updated groups list
+		renderUserGroups(c, users, groups, userID)
 	}
-
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	t.StartTemplate()
-	templates.UserGroups(user, groups).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // GetInviteUserFormHandler returns the form for inviting a user to a group
-func GetInviteUserFormHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
-
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
-	}
+func GetInviteUserFormHandler(invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		t := c.MustGet("timing").(*timing.RenderTiming)
+		userID := c.MustGet("userID").(uint)
 
-	// Verify user owns the group
-	var group models.UserGroup
-	if err := db.First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	if group.CreatedByID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to invite users to this group"})
-		return
-	}
+		// Users who aren't members and have no pending invitation
+		users, err := invites.InviteCandidates(uint(groupID), userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
 
-	// Get users who are not already members of the group
-	var users []models.User
-	if err := db.Where("id NOT IN (SELECT user_id FROM user_group_members WHERE group_id = ?)", groupID).
-		Where("id NOT IN (SELECT invitee_id FROM user_group_invites WHERE group_id = ? AND accepted = ?)", groupID, false).
-		Where("id != ?", userID). // Exclude current user
-		Find(&users).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
-		return
+		t.StartTemplate()
+		templates.InviteUserForm(uint(groupID), users).Render(c.Request.Context(), c.Writer)
+		t.EndTemplate()
 	}
-
-	t.StartTemplate()
-	templates.InviteUserForm(uint(groupID), users).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
-// InviteUserToGroupHandler invites a user to a group - Updated with notifications
-func InviteUserToGroupHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	hubInterface, hubExists := c.Get("hub")
-	userID := c.MustGet("userID").(uint)
-
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+// respondInvite answers HTMX requests with the invites tab and API clients
+// with the invite
+func respondInvite(c *gin.Context, users services.UserService, invites services.InviteService, status int, invite *models.UserGroupInvite) {
+	if c.GetHeader("HX-Request") != "" {
+		renderUserInvites(c, users, invites, c.MustGet("userID").(uint))
 		return
 	}
+	c.JSON(status, invite.ToDict())
+}
 
-	var inviteRequest struct {
-		InviteeID string `form:"invitee_id" binding:"required"`
-	}
-
-	if err := c.ShouldBind(&inviteRequest); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	inviteeID, err := strconv.ParseUint(inviteRequest.InviteeID, 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitee ID"})
-		return
-	}
-
-	// Get the current user
-	var currentUser models.User
-	if err := db.First(&currentUser, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch current user"})
-		return
-	}
-
-	// Verify user owns the group
-	var group models.UserGroup
-	if err := db.First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
-	}
-
-	if group.CreatedByID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to invite users to this group"})
-		return
-	}
+// InviteUserToGroupHandler invites a user to a group and notifies them
+func InviteUserToGroupHandler(users services.UserService, invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
 
-	// Check if user is already a member
-	var existingMembership models.UserGroupMember
-	if err := db.Where("user_id = ? AND group_id = ?", inviteeID, groupID).First(&existingMembership).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User is already a member of this group"})
-		return
-	}
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	// Check if invitation already exists
-	var existingInvite models.UserGroupInvite
-	if err := db.Where("invitee_id = ? AND group_id = ? AND accepted = ?", inviteeID, groupID, false).
-		First(&existingInvite).Error; err == nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User has already been invited to this group"})
-		return
-	}
+		var inviteRequest struct {
+			InviteeID string `form:"invitee_id" json:"invitee_id" binding:"required"`
+		}
 
-	// Create the invitation
-	invite := models.UserGroupInvite{
-		GroupID:           uint(groupID),
-		InviteInitiatorID: userID,
-		InviteeID:         uint(inviteeID),
-		Accepted:          false,
-	}
+		if err := c.ShouldBind(&inviteRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	if err := db.Create(&invite).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
-		return
-	}
+		inviteeID, err := strconv.ParseUint(inviteRequest.InviteeID, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitee ID"})
+			return
+		}
 
-	// Send a WebSocket notification if hub exists
-	if hubExists {
-		if hub, ok := hubInterface.(*DistributedHub); ok {
-			hub.SendGroupInviteNotification(
-				uint(inviteeID),
-				currentUser.Username,
-				group.Name,
-				invite.ID,
-			)
+		invite, err := invites.Invite(uint(groupID), userID, uint(inviteeID))
+		switch {
+		case errors.Is(err, services.ErrGroupNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		case errors.Is(err, services.ErrAlreadyMember):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User is already a member of this group"})
+			return
+		case errors.Is(err, services.ErrAlreadyInvited):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User has already been invited to this group"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invitation"})
+			return
 		}
-	}
 
-	// Return the updated sent invites list
-	var sentInvites []models.UserGroupInvite
-	if err := db.Preload("Group").Preload("Invitee").
-		Where("invite_initiator_id = ?", userID).
-		Find(&sentInvites).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sent invites"})
-		return
+		respondInvite(c, users, invites, http.StatusCreated, invite)
 	}
-
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	t.StartTemplate()
-	templates.UserInvites(models.User{ID: userID}, sentInvites, nil).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
 // AcceptInviteHandler accepts a group invitation
-func AcceptInviteHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
-
-	inviteID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
-		return
-	}
-
-	// Get the invitation
-	var invite models.UserGroupInvite
-	if err := db.Preload("Group").First(&invite, inviteID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
-		return
-	}
+func AcceptInviteHandler(users services.UserService, invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
 
-	// Verify user is the invitee
-	if invite.InviteeID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to accept this invitation"})
-		return
-	}
-
-	// Mark the invitation as accepted
-	invite.Accepted = true
-	if err := db.Save(&invite).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
-		return
-	}
+		inviteID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
+			return
+		}
 
-	// Add user to the group
-	membership := models.UserGroupMember{
-		UserID:  userID,
-		GroupID: invite.GroupID,
-	}
-	if err := db.Create(&membership).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add you to the group"})
-		return
-	}
+		// Accept the invitation and add the membership together
+		invite, err := invites.Accept(uint(inviteID), userID)
+		switch {
+		case errors.Is(err, services.ErrInviteNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+			return
+		case errors.Is(err, services.ErrNotInvitee):
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to accept this invitation"})
+			return
+		case errors.Is(err, services.ErrInviteNotPending):
+			c.JSON(http.StatusConflict, gin.H{"error": "This invitation is no longer pending"})
+			return
+		case errors.Is(err, services.ErrInviteExpired):
+			c.JSON(http.StatusGone, gin.H{"error": "This invitation has expired"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept invitation"})
+			return
+		}
 
-	// Return the updated received invites list
-	var receivedInvites []models.UserGroupInvite
-	if err := db.Preload("Group").Preload("Initiator").
-		Where("invitee_id = ? AND accepted = ?", userID, false).
-		Find(&receivedInvites).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch received invites"})
-		return
+		respondInvite(c, users, invites, http.StatusOK, invite)
 	}
-
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	t.StartTemplate()
-	templates.UserInvites(models.User{ID: userID}, nil, receivedInvites).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
 
-// DeclineInviteHandler declines a group invitation
-func DeclineInviteHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	userID := c.MustGet("userID").(uint)
-
-	inviteID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
-		return
-	}
-
-	// Get the invitation
-	var invite models.UserGroupInvite
-	if err := db.First(&invite, inviteID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
-		return
-	}
-
-	// Verify user is the invitee or the initiator
-	if invite.InviteeID != userID && invite.InviteInitiatorID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to decline this invitation"})
-		return
-	}
+// DeclineInviteHandler answers a pending invitation without joining: the
+// invitee declines it, the user who sent it revokes it
+func DeclineInviteHandler(users services.UserService, invites services.InviteService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
 
-	// Delete the invitation
-	if err := db.Delete(&invite).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decline invitation"})
-		return
-	}
+		inviteID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invite ID"})
+			return
+		}
 
-	// Determine which list to refresh based on who declined
-	if invite.InviteeID == userID {
-		// User is declining an invitation they received
-		var receivedInvites []models.UserGroupInvite
-		if err := db.Preload("Group").Preload("Initiator").
-			Where("invitee_id = ? AND accepted = ?", userID, false).
-			Find(&receivedInvites).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch received invites"})
+		invite, err := invites.Decline(uint(inviteID), userID)
+		switch {
+		case errors.Is(err, services.ErrInviteNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+			return
+		case errors.Is(err, services.ErrNotInviteParty):
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to decline this invitation"})
+			return
+		case errors.Is(err, services.ErrInviteNotPending):
+			c.JSON(http.StatusConflict, gin.H{"error": "This invitation is no longer pending"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update invitation"})
 			return
 		}
 
+		respondInvite(c, users, invites, http.StatusOK, invite)
+	}
+}
+
+// GetUserAccountHandler fetches and renders just the account settings
+func GetUserAccountHandler(users services.UserService) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		t := c.MustGet("timing").(*timing.RenderTiming)
-		t.StartTemplate()
-		templates.UserInvites(models.User{ID: userID}, nil, receivedInvites).Render(c.Request.Context(), c.Writer)
-		t.EndTemplate()
-	} else {
-		// User is canceling an invitation they sent
-		var sentInvites []models.UserGroupInvite
-		if err := db.Preload("Group").Preload("Invitee").
-			Where("invite_initiator_id = ?", userID).
-			Find(&sentInvites).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sent invites"})
+		userID := c.MustGet("userID").(uint)
+
+		user, err := users.GetUser(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
 			return
 		}
 
-		t := c.MustGet("timing").(*timing.RenderTiming)
 		t.StartTemplate()
-		templates.UserInvites(models.User{ID: userID}, sentInvites, nil).Render(c.Request.Context(), c.Writer)
+		templates.UserAccountSettings(*user).Render(c.Request.Context(), c.Writer)
 		t.EndTemplate()
 	}
 }
 
-// GetUserAccountHandler fetches and renders just the account settings
-func GetUserAccountHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
-
-	var user models.User
-	if err := db.First(&user, userID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user"})
+// renderGroupDetail reloads a group after a membership change and renders
+// its detail view
+func renderGroupDetail(c *gin.Context, groups services.GroupService, hub *DistributedHub, groupID uint) {
+	group, err := groups.GetGroup(groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reload group data"})
 		return
 	}
 
+	t := c.MustGet("timing").(*timing.RenderTiming)
 	t.StartTemplate()
-	templates.UserAccountSettings(user).Render(c.Request.Context(), c.Writer)
+	templates.GroupDetail(*group, c.MustGet("userID").(uint), middleware.GroupAccessFromContext(c), groupPresence(hub, *group)).Render(c.Request.Context(), c.Writer)
 	t.EndTemplate()
 }
 
 // RemoveGroupMemberHandler removes a member from a group
-func RemoveGroupMemberHandler(c *gin.Context) {
-	db := c.MustGet("db").(*gorm.DB)
-	t := c.MustGet("timing").(*timing.RenderTiming)
-	userID := c.MustGet("userID").(uint)
+func RemoveGroupMemberHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
-		return
-	}
+		memberID, err := strconv.ParseUint(c.Param("member_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
+			return
+		}
 
-	memberID, err := strconv.ParseUint(c.Param("member_id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
-		return
-	}
+		// Members can only be removed by someone who outranks them in the group
+		err = groups.RemoveMember(uint(groupID), uint(memberID), middleware.GroupAccessFromContext(c))
+		switch {
+		case errors.Is(err, services.ErrNotMember):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found in this group"})
+			return
+		case errors.Is(err, services.ErrOwnerMembership):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Cannot remove the group owner"})
+			return
+		case errors.Is(err, services.ErrCannotManageMember):
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to remove this member"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
+			return
+		}
 
-	// Verify the group exists and the current user is the creator
-	var group models.UserGroup
-	if err := db.First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
-		return
+		// Render the updated group detail
+		renderGroupDetail(c, groups, hub, uint(groupID))
 	}
+}
 
-	// Only the creator can remove members
-	if group.CreatedByID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to manage this group's members"})
-		return
-	}
+// UpdateGroupMemberRoleHandler makes a member a group admin or back into a
+// regular member. Ownership can't be handed over here.
+func UpdateGroupMemberRoleHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
 
-	// Cannot remove the creator (owner)
-	if uint(memberID) == group.CreatedByID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot remove the group owner"})
-		return
-	}
+		memberID, err := strconv.ParseUint(c.Param("member_id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid member ID"})
+			return
+		}
 
-	// Delete the membership
-	result := db.Where("user_id = ? AND group_id = ?", memberID, groupID).Delete(&models.UserGroupMember{})
-	if result.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove member"})
-		return
-	}
+		var roleRequest struct {
+			Role string `form:"role" json:"role" binding:"required"`
+		}
+		if err := c.ShouldBind(&roleRequest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
-	if result.RowsAffected == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Member not found in this group"})
-		return
-	}
+		err = groups.SetMemberRole(uint(groupID), uint(memberID), roleRequest.Role)
+		var inputErr *services.InputError
+		switch {
+		case errors.As(err, &inputErr):
+			c.JSON(http.StatusBadRequest, gin.H{"error": inputErr.Error()})
+			return
+		case errors.Is(err, services.ErrNotMember):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Member not found in this group"})
+			return
+		case errors.Is(err, services.ErrOwnerMembership):
+			c.JSON(http.StatusForbidden, gin.H{"error": "The group owner's role can't be changed"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update member role"})
+			return
+		}
 
-	// Reload the group with members
-	if err := db.Preload("Creator").Preload("Members.User").First(&group, groupID).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reload group data"})
-		return
+		renderGroupDetail(c, groups, hub, uint(groupID))
 	}
-
-	// Render the updated group detail
-	t.StartTemplate()
-	templates.GroupDetail(group, userID).Render(c.Request.Context(), c.Writer)
-	t.EndTemplate()
 }
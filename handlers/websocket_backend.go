@@ -6,13 +6,19 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 )
 
 // Message represents a websocket message with metadata
@@ -22,21 +28,35 @@ type Message struct {
 	Timestamp time.Time `json:"timestamp"`
 	SessionID string    `json:"session_id"`
 	UserID    uint      `json:"user_id,omitempty"`
+	GroupID   uint      `json:"group_id,omitempty"`
+	Control   string    `json:"control,omitempty"`
 }
 
 // DistributedHub manages websocket connections across multiple pods
 type DistributedHub struct {
-	clients    map[string]*Client
-	broadcast  chan Message
-	register   chan *Client
-	unregister chan *Client
-	mu         sync.RWMutex
-	redis      *redis.Client
-	podID      string
-	ctx        context.Context
-	cancel     context.CancelFunc
-	errorCount int
-	maxRetries int
+	clients       map[string]*Client
+	userSessions  map[uint]map[string]*Client
+	groupSessions map[uint]map[string]*Client
+	broadcast     chan Message
+	register      chan *Client
+	unregister    chan *Client
+	presence      chan presenceUpdate
+	mu            sync.RWMutex
+	subMu         sync.Mutex // orders changes to the Redis subscription
+	redis         *redis.Client
+	db            *gorm.DB
+	groups        services.GroupService // posts chat messages sent over WebSocket; set with SetGroupService
+	pubsub        *redis.PubSub
+	upgrader      websocket.Upgrader
+	origins       []string
+	podID         string
+	ctx           context.Context
+	cancel        context.CancelFunc
+	errorCount    int
+	maxRetries    int
+	// Retention of the per-user and per-group event streams used for replay
+	streamMaxLen    int64
+	streamRetention time.Duration
 }
 
 // HubConfig holds the configuration for DistributedHub
@@ -45,6 +65,15 @@ type HubConfig struct {
 	MaxRetries      int
 	SessionDuration time.Duration
 	BufferSize      int
+	// AllowedOrigins lists the browser origins allowed to connect.
+	// When empty only same-origin connections are accepted.
+	AllowedOrigins []string
+	// DB is used to persist notifications; they are only delivered live when nil
+	DB *gorm.DB
+	// StreamMaxLen and StreamRetention bound the event streams replayed to
+	// reconnecting clients, by approximate length and by idle time
+	StreamMaxLen    int64
+	StreamRetention time.Duration
 }
 
 // NewDistributedHub creates a new hub instance
@@ -58,6 +87,12 @@ func NewDistributedHub(config HubConfig) (*DistributedHub, error) {
 	if config.BufferSize == 0 {
 		config.BufferSize = 256
 	}
+	if config.StreamMaxLen == 0 {
+		config.StreamMaxLen = 1000
+	}
+	if config.StreamRetention == 0 {
+		config.StreamRetention = 24 * time.Hour
+	}
 
 	opt, err := redis.ParseURL(config.RedisURL)
 	if err != nil {
@@ -67,15 +102,30 @@ func NewDistributedHub(config HubConfig) (*DistributedHub, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	hub := &DistributedHub{
-		clients:    make(map[string]*Client),
-		broadcast:  make(chan Message, config.BufferSize),
-		register:   make(chan *Client, config.BufferSize),
-		unregister: make(chan *Client, config.BufferSize),
-		redis:      redis.NewClient(opt),
-		podID:      uuid.New().String(),
-		ctx:        ctx,
-		cancel:     cancel,
-		maxRetries: config.MaxRetries,
+		clients:         make(map[string]*Client),
+		userSessions:    make(map[uint]map[string]*Client),
+		groupSessions:   make(map[uint]map[string]*Client),
+		broadcast:       make(chan Message, config.BufferSize),
+		register:        make(chan *Client, config.BufferSize),
+		unregister:      make(chan *Client, config.BufferSize),
+		presence:        make(chan presenceUpdate, config.BufferSize),
+		redis:           redis.NewClient(opt),
+		db:              config.DB,
+		origins:         config.AllowedOrigins,
+		podID:           uuid.New().String(),
+		ctx:             ctx,
+		cancel:          cancel,
+		maxRetries:      config.MaxRetries,
+		streamMaxLen:    config.StreamMaxLen,
+		streamRetention: config.StreamRetention,
+	}
+
+	hub.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return hub.checkOrigin(r, false)
+		},
 	}
 
 	// log pod ID
@@ -106,6 +156,15 @@ func (h *DistributedHub) Run() {
 	// Start health check
 	go h.healthCheck()
 
+	// Keep this pod's sessions present
+	go h.persistPresence()
+	go h.refreshPresence()
+
+	// Expire group invitations nobody answered in time
+	if h.db != nil {
+		go h.expireInvites()
+	}
+
 	for {
 		select {
 		case <-h.ctx.Done():
@@ -142,8 +201,30 @@ func (h *DistributedHub) subscribeToRedis() {
 }
 
 func (h *DistributedHub) subscribeOnce() error {
-	pubsub := h.redis.Subscribe(h.ctx, "broadcast")
-	defer pubsub.Close()
+	// Subscribe to the broadcast channel plus every user and group channel
+	// with local sessions, so nothing is missed after a reconnect. subMu
+	// holds back channel changes until the subscription is published; h.mu
+	// is only held to read the channels, not during the Redis call.
+	h.subMu.Lock()
+	h.mu.RLock()
+	channels := h.subscribedChannels()
+	h.mu.RUnlock()
+
+	pubsub := h.redis.Subscribe(h.ctx, channels...)
+
+	h.mu.Lock()
+	h.pubsub = pubsub
+	h.mu.Unlock()
+	h.subMu.Unlock()
+
+	defer func() {
+		h.subMu.Lock()
+		h.mu.Lock()
+		h.pubsub = nil
+		h.mu.Unlock()
+		h.subMu.Unlock()
+		pubsub.Close()
+	}()
 
 	for {
 		select {
@@ -163,7 +244,7 @@ func (h *DistributedHub) subscribeOnce() error {
 			}
 
 			if message.PodID != h.podID {
-				h.broadcastToLocalClients(message)
+				h.deliverToLocalClients(message)
 			}
 		}
 	}
@@ -175,50 +256,44 @@ func (h *DistributedHub) handleRegister(client *Client) {
 	h.mu.Lock()
 	h.clients[sessionID] = client
 	client.sessionID = sessionID
+	channels := h.indexClient(client)
 	h.mu.Unlock()
 
-	// Store session in Redis with retry logic
-	for i := 0; i < h.maxRetries; i++ {
-		ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
-		err := h.redis.Set(ctx,
-			fmt.Sprintf("session:%s", sessionID),
-			h.podID,
-			24*time.Hour,
-		).Err()
-		cancel()
-
-		if err == nil {
-			break
-		}
+	h.syncChannels(channels)
 
-		if i == h.maxRetries-1 {
-			log.Printf("Failed to store session after %d retries: %v", h.maxRetries, err)
-		}
-		time.Sleep(time.Second * time.Duration(i+1))
+	// Let the write pump replay missed events now that live delivery is on
+	if client.registered != nil {
+		close(client.registered)
 	}
+
+	h.queuePresence(client, true)
 }
 
 // handleUnregister processes client disconnections
 func (h *DistributedHub) handleUnregister(client *Client) {
+	var channels []string
+
 	h.mu.Lock()
-	if _, exists := h.clients[client.sessionID]; exists {
+	_, exists := h.clients[client.sessionID]
+	if exists {
 		delete(h.clients, client.sessionID)
+		channels = h.unindexClient(client)
 		close(client.send)
+	}
+	h.mu.Unlock()
 
-		// Clean up Redis session
-		ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
-		defer cancel()
+	h.syncChannels(channels)
 
-		if err := h.redis.Del(ctx, fmt.Sprintf("session:%s", client.sessionID)).Err(); err != nil {
-			log.Printf("Failed to remove session from Redis: %v", err)
-		}
+	if !exists {
+		return
 	}
-	h.mu.Unlock()
+
+	h.queuePresence(client, false)
 }
 
 // handleBroadcast processes messages for broadcasting
 func (h *DistributedHub) handleBroadcast(message Message) {
-	h.broadcastToLocalClients(message)
+	h.deliverToLocalClients(message)
 
 	// Publish to Redis with retry logic
 	jsonMsg, err := json.Marshal(message)
@@ -229,7 +304,7 @@ func (h *DistributedHub) handleBroadcast(message Message) {
 
 	for i := 0; i < h.maxRetries; i++ {
 		ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
-		err := h.redis.Publish(ctx, "broadcast", string(jsonMsg)).Err()
+		err := h.redis.Publish(ctx, channelFor(message), string(jsonMsg)).Err()
 		cancel()
 
 		if err == nil {
@@ -243,12 +318,25 @@ func (h *DistributedHub) handleBroadcast(message Message) {
 	}
 }
 
-// broadcastToLocalClients sends a message to all local clients
-func (h *DistributedHub) broadcastToLocalClients(message Message) {
+// deliverToLocalClients sends a message to the local clients it targets:
+// the user's sessions, the group's sessions or everyone for broadcasts
+func (h *DistributedHub) deliverToLocalClients(message Message) {
+	if message.Control != "" {
+		h.applyControl(message)
+		return
+	}
+
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	for _, client := range h.clients {
+	targets := h.clients
+	if message.UserID != 0 {
+		targets = h.userSessions[message.UserID]
+	} else if message.GroupID != 0 {
+		targets = h.groupSessions[message.GroupID]
+	}
+
+	for _, client := range targets {
 		select {
 		case client.send <- message.Data:
 		default:
@@ -294,8 +382,10 @@ func (h *DistributedHub) shutdown() {
 		close(client.send)
 	}
 
-	// Clear the clients map
+	// Clear the clients map and indexes
 	h.clients = make(map[string]*Client)
+	h.userSessions = make(map[uint]map[string]*Client)
+	h.groupSessions = make(map[uint]map[string]*Client)
 
 	// Close Redis connection
 	if err := h.redis.Close(); err != nil {
@@ -303,49 +393,195 @@ func (h *DistributedHub) shutdown() {
 	}
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Note: In production, implement proper origin checking
-	},
+// checkOrigin accepts same-origin requests and configured origins. Requests
+// without an Origin header are only accepted when allowMissing is set, for
+// non-browser clients that authenticated with an API key; browsers always
+// send one, so a missing Origin on cookie or ticket credentials is refused.
+func (h *DistributedHub) checkOrigin(r *http.Request, allowMissing bool) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return allowMissing
+	}
+
+	if len(h.origins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range h.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
 }
 
-// HandleWebSocket handles incoming WebSocket connections
-func HandleWebSocket(c *gin.Context) {
-	// Get the hub from the context
-	hubInterface, exists := c.Get("hub")
-	if !exists {
-		c.String(http.StatusInternalServerError, "WebSocket hub not available")
-		return
+// webSocketTicketKey returns the key that exists until a ticket is redeemed
+func webSocketTicketKey(ticketID string) string {
+	return fmt.Sprintf("ws:ticket:%s", ticketID)
+}
+
+// storeWebSocketTicket records an issued ticket so it can be redeemed once
+func (h *DistributedHub) storeWebSocketTicket(ticketID string) error {
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	return h.redis.Set(ctx, webSocketTicketKey(ticketID), 1, auth.WebSocketTicketTTL).Err()
+}
+
+// redeemWebSocketTicket consumes an issued ticket. GETDEL makes this atomic,
+// so of two connections racing with the same ticket only one gets through.
+func (h *DistributedHub) redeemWebSocketTicket(ticketID string) error {
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	err := h.redis.GetDel(ctx, webSocketTicketKey(ticketID)).Err()
+	if err == redis.Nil {
+		return fmt.Errorf("ticket has already been used")
 	}
+	return err
+}
 
-	hub, ok := hubInterface.(*DistributedHub)
-	if !ok {
-		c.String(http.StatusInternalServerError, "Invalid hub configuration")
-		return
+// authenticateWebSocket validates the ticket, bearer token or auth cookie
+// presented on the upgrade request and returns the API key if it was one
+func authenticateWebSocket(c *gin.Context, hub *DistributedHub) (*auth.Claims, *models.APIKey, error) {
+	if ticket := c.Query("ticket"); ticket != "" {
+		claims, ticketID, err := auth.ParseWebSocketTicket(ticket)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := hub.redeemWebSocketTicket(ticketID); err != nil {
+			return nil, nil, err
+		}
+		return claims, nil, nil
 	}
 
-	// Upgrade the HTTP connection to WebSocket
-	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-	if err != nil {
-		log.Printf("Failed to upgrade connection: %v", err)
-		return
+	if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+
+		// The sidecar connects with an API key; receiving needs the read scope
+		// and sending frames is checked against the key's scopes in dispatch
+		if strings.HasPrefix(token, auth.APIKeyPrefix) {
+			claims, apiKey, err := auth.AuthenticateAPIKey(hub.db, token)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !apiKey.HasScope(auth.ScopeRead) {
+				return nil, nil, fmt.Errorf("API key is missing the read scope")
+			}
+			return claims, apiKey, nil
+		}
+
+		claims, err := auth.ParseToken(token)
+		return claims, nil, err
 	}
 
-	// Create new client
-	client := &Client{
-		hub:  hub,
-		conn: ws,
-		send: make(chan []byte, 256),
+	if tokenCookie, err := c.Cookie("auth_token"); err == nil && tokenCookie != "" {
+		claims, err := auth.ParseToken(tokenCookie)
+		return claims, nil, err
 	}
 
-	// Register client with hub
-	hub.register <- client
+	return nil, nil, fmt.Errorf("missing credentials")
+}
+
+// HandleWebSocket handles incoming WebSocket connections
+func HandleWebSocket(hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if hub == nil {
+			c.String(http.StatusServiceUnavailable, "WebSocket service not available")
+			return
+		}
 
-	// Start client read/write pumps
-	go client.readPump()
-	go client.writePump()
+		// Authenticate before upgrading so anonymous clients never connect
+		claims, apiKey, err := authenticateWebSocket(c, hub)
+		if err != nil {
+			c.String(http.StatusUnauthorized, "Authentication required")
+			return
+		}
+		viaAPIKey := apiKey != nil
+
+		// Sessions that were logged out or revoked can't connect either
+		if claims.SessionID != "" {
+			if revoked, err := auth.IsRevoked(hub.db, claims); err != nil || revoked {
+				c.String(http.StatusUnauthorized, "Session has been revoked")
+				return
+			}
+		}
+
+		if !hub.checkOrigin(c.Request, viaAPIKey) {
+			c.String(http.StatusForbidden, "Origin not allowed")
+			return
+		}
+
+		// Load the authenticated user's groups for targeted delivery
+		groupIDs, err := loadUserGroupIDs(hub.db, claims.UserID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Failed to load group memberships")
+			return
+		}
+
+		// Clients resuming after a disconnect pass the last event they saw
+		lastEventID := c.Query("last_event_id")
+		if lastEventID != "" {
+			if _, _, err := parseEventID(lastEventID); err != nil {
+				c.String(http.StatusBadRequest, "Invalid last_event_id")
+				return
+			}
+		}
+
+		// Sessions start out subscribed to every group the user belongs to
+		groups := make(map[uint]bool, len(groupIDs))
+		subscriptions := make(map[uint]bool, len(groupIDs))
+		for _, groupID := range groupIDs {
+			groups[groupID] = true
+			subscriptions[groupID] = true
+		}
+
+		// Upgrade the HTTP connection to WebSocket
+		upgrader := hub.upgrader
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			return hub.checkOrigin(r, viaAPIKey)
+		}
+		ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			log.Printf("Failed to upgrade connection: %v", err)
+			return
+		}
+
+		// Create new client
+		client := &Client{
+			hub:           hub,
+			conn:          ws,
+			send:          make(chan []byte, 256),
+			userID:        claims.UserID,
+			claims:        claims,
+			viaAPIKey:     viaAPIKey,
+			groups:        groups,
+			subscriptions: subscriptions,
+			lastEventID:   lastEventID,
+			registered:    make(chan struct{}),
+		}
+
+		if viaAPIKey {
+			client.scopes = apiKey.ScopeList()
+		}
+
+		// Register client with hub
+		hub.register <- client
+
+		// Start client read/write pumps
+		go client.readPump()
+		go client.writePump()
+	}
+}
+
+// SetGroupService sets the service that stores chat messages sent over the
+// WebSocket. The services deliver through the hub, so it's set once both exist.
+func (h *DistributedHub) SetGroupService(groups services.GroupService) {
+	h.groups = groups
 }
 
 // IsHealthy checks the health of the WebSocket hub
@@ -369,6 +605,8 @@ func (h *DistributedHub) GetStats() map[string]interface{} {
 
 	return map[string]interface{}{
 		"active_connections": len(h.clients),
+		"connected_users":    len(h.userSessions),
+		"active_groups":      len(h.groupSessions),
 		"pod_id":             h.podID,
 		"error_count":        h.errorCount,
 	}
@@ -396,12 +634,15 @@ func (h *DistributedHub) Stop() {
 type NotificationType string
 
 const (
-	NotificationTypeInvite NotificationType = "invite"
-	NotificationTypeSystem NotificationType = "system"
+	NotificationTypeInvite       NotificationType = services.NotificationTypeInvite
+	NotificationTypeInviteUpdate NotificationType = services.NotificationTypeInviteUpdate
+	NotificationTypeJoinRequest  NotificationType = services.NotificationTypeJoinRequest
+	NotificationTypeSystem       NotificationType = services.NotificationTypeSystem
 )
 
 // WebSocketNotification represents a notification sent over WebSocket
 type WebSocketNotification struct {
+	ID      uint             `json:"id,omitempty"`
 	Type    NotificationType `json:"type"`
 	Title   string           `json:"title"`
 	Message string           `json:"message"`
@@ -410,40 +651,69 @@ type WebSocketNotification struct {
 
 // SendNotificationToUser sends a notification to a specific user via WebSocket
 func (h *DistributedHub) SendNotificationToUser(userID uint, notification WebSocketNotification) {
-	// Convert the notification to JSON
-	notificationJSON, err := json.Marshal(notification)
-	if err != nil {
-		log.Printf("Failed to marshal notification: %v", err)
+	// Store the notification first so offline users see it later and
+	// clients can mark it read by ID
+	if h.db != nil {
+		stored, err := saveNotification(h.db, userID, notification)
+		if err != nil {
+			log.Printf("Failed to store notification for user %d: %v", userID, err)
+		} else {
+			notification.ID = stored.ID
+		}
+	}
+
+	// Deliver the notification frame only to the target user's sessions
+	h.sendEnvelope(Message{UserID: userID}, EnvelopeNotification, userChannel(userID), notification)
+}
+
+// hubNotifications is the NotificationService delivering through the hub
+type hubNotifications struct {
+	hub *DistributedHub
+}
+
+// NewNotificationService delivers the services' notifications through the
+// hub. Without a hub notifications are dropped.
+func NewNotificationService(hub *DistributedHub) services.NotificationService {
+	return &hubNotifications{hub: hub}
+}
+
+// Notify stores a notification for a user and sends it to their sessions
+func (n *hubNotifications) Notify(userID uint, notification services.Notification) {
+	if n.hub == nil {
 		return
 	}
+	n.hub.SendNotificationToUser(userID, WebSocketNotification{
+		Type:    NotificationType(notification.Type),
+		Title:   notification.Title,
+		Message: notification.Message,
+		Data:    notification.Data,
+	})
+}
 
-	// Create a message with special "notification" prefix to distinguish it from regular messages
-	prefixedMessage := append([]byte("notification:"), notificationJSON...)
+// Subscribe starts delivering a group's messages to a user's sessions
+func (n *hubNotifications) Subscribe(userID, groupID uint) {
+	if n.hub != nil {
+		n.hub.AddUserToGroup(userID, groupID)
+	}
+}
 
-	// Broadcast the message to all clients
-	// The client side will filter messages for the specific user
-	h.broadcast <- Message{
-		PodID:     h.podID,
-		Data:      prefixedMessage,
-		Timestamp: timeNow(),
-		UserID:    userID, // Include the target userID
+// Unsubscribe stops delivering a group's messages to a user's sessions
+func (n *hubNotifications) Unsubscribe(userID, groupID uint) {
+	if n.hub != nil {
+		n.hub.RemoveUserFromGroup(userID, groupID)
 	}
 }
 
-// SendGroupInviteNotification sends an invite notification to a user
-func (h *DistributedHub) SendGroupInviteNotification(userID uint, inviterName, groupName string, inviteID uint) {
-	notification := WebSocketNotification{
-		Type:    NotificationTypeInvite,
-		Title:   "New Group Invitation",
-		Message: inviterName + " has invited you to join group: " + groupName,
-		Data: map[string]any{
-			"inviteId":  inviteID,
-			"groupName": groupName,
-			"inviter":   inviterName,
-		},
+// SendGroupMessage delivers a chat message to the group's online members
+func (n *hubNotifications) SendGroupMessage(message *models.GroupMessage) {
+	if n.hub != nil {
+		n.hub.SendGroupMessage(message.GroupID, message.ToDict())
 	}
+}
 
-	h.SendNotificationToUser(userID, notification)
+// SendGroupMessage delivers a chat message to the online members of a group
+func (h *DistributedHub) SendGroupMessage(groupID uint, message map[string]interface{}) {
+	h.sendEnvelope(Message{GroupID: groupID}, EnvelopeChatMessage, groupChannel(groupID), message)
 }
 
 var timeNow = func() time.Time {
@@ -1,19 +1,43 @@
 package handlers
 
 import (
+	"encoding/json"
+	"io"
 	"log"
 	"sync"
 	"time"
 
+	"git.ssy.dk/noob/bingbong-go/auth"
 	"github.com/gorilla/websocket"
 )
 
+// maxFrameSize bounds inbound frames; chat messages are the largest
+const maxFrameSize = 16 * 1024
+
 type Client struct {
 	hub       *DistributedHub
 	conn      *websocket.Conn
 	send      chan []byte
 	sessionID string
-	closeOnce sync.Once
+	userID    uint
+	claims    *auth.Claims
+	// viaAPIKey sessions may only send frames their key's scopes allow
+	viaAPIKey bool
+	scopes    []string
+	// groups holds the user's group memberships and subscriptions the group
+	// channels delivered to this session; both are guarded by hub.mu
+	groups        map[uint]bool
+	subscriptions map[uint]bool
+	closeOnce     sync.Once
+	// lastEventID is the resume point requested on connect; registered is
+	// closed once the hub delivers live frames to this session
+	lastEventID string
+	registered  chan struct{}
+	// replayedThrough is the newest replayed event per channel, used to drop
+	// live frames that were already replayed; only touched by the write pump.
+	// Stream IDs are only ordered within a stream, so they aren't compared
+	// across channels.
+	replayedThrough map[string]string
 }
 
 func (c *Client) readPump() {
@@ -24,7 +48,7 @@ func (c *Client) readPump() {
 		})
 	}()
 
-	c.conn.SetReadLimit(512) // Max message size
+	c.conn.SetReadLimit(maxFrameSize)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -40,17 +64,21 @@ func (c *Client) readPump() {
 			break
 		}
 
-		c.hub.broadcast <- Message{
-			PodID:     c.hub.podID,
-			Data:      message,
-			Timestamp: time.Now(),
-			SessionID: c.sessionID,
-		}
+		c.dispatch(message)
 	}
 }
 
 func (c *Client) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
+
+	// Close the connection when the session token expires
+	var expired <-chan time.Time
+	if c.claims != nil && c.claims.ExpiresAt != nil {
+		expiryTimer := time.NewTimer(time.Until(c.claims.ExpiresAt.Time))
+		defer expiryTimer.Stop()
+		expired = expiryTimer.C
+	}
+
 	defer func() {
 		ticker.Stop()
 		c.closeOnce.Do(func() {
@@ -58,6 +86,13 @@ func (c *Client) writePump() {
 		})
 	}()
 
+	if c.lastEventID != "" {
+		if err := c.replay(); err != nil {
+			log.Printf("Failed to replay events for session %s: %v", c.sessionID, err)
+			return
+		}
+	}
+
 	for {
 		select {
 		case message, ok := <-c.send:
@@ -67,17 +102,36 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
 			// Add queued messages to the current websocket message
+			frames := [][]byte{message}
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+				frames = append(frames, <-c.send)
+			}
+
+			written := 0
+			var w io.WriteCloser
+			for _, frame := range frames {
+				if c.alreadyReplayed(frame) {
+					continue
+				}
+
+				if w == nil {
+					var err error
+					if w, err = c.conn.NextWriter(websocket.TextMessage); err != nil {
+						return
+					}
+				}
+
+				if written > 0 {
+					w.Write([]byte{'\n'})
+				}
+				w.Write(frame)
+				written++
+			}
+
+			if w == nil {
+				continue
 			}
 
 			if err := w.Close(); err != nil {
@@ -89,6 +143,77 @@ func (c *Client) writePump() {
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+
+		case <-expired:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			c.conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token expired"))
+			return
+		}
+	}
+}
+
+// replay sends the events recorded since lastEventID, followed by a
+// replay.complete frame, before live frames are written
+func (c *Client) replay() error {
+	// Wait for registration so nothing published during the replay is missed;
+	// anything recorded in between arrives twice and is dropped by alreadyReplayed
+	select {
+	case <-c.registered:
+	case <-c.hub.ctx.Done():
+		return c.hub.ctx.Err()
+	}
+
+	frames, truncated, err := c.hub.replayEvents(c, c.lastEventID)
+	if err != nil {
+		return err
+	}
+
+	c.replayedThrough = make(map[string]string)
+	for _, frame := range frames {
+		data, err := json.Marshal(frame)
+		if err != nil {
+			return err
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
 		}
+		c.replayedThrough[frame.Channel] = frame.Event
+	}
+
+	data, err := encodeEnvelope(EnvelopeReplayComplete, "", "", map[string]interface{}{
+		"replayed":  len(frames),
+		"truncated": truncated,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// alreadyReplayed reports whether a live frame was part of the replay.
+// Durable frames carry the channel of the stream they were recorded on, so
+// each is compared with the newest event replayed from that stream.
+func (c *Client) alreadyReplayed(frame []byte) bool {
+	if len(c.replayedThrough) == 0 {
+		return false
+	}
+
+	var env struct {
+		Channel string `json:"channel"`
+		Event   string `json:"event"`
+	}
+	if err := json.Unmarshal(frame, &env); err != nil || env.Event == "" {
+		return false
+	}
+
+	replayedThrough, ok := c.replayedThrough[env.Channel]
+	if !ok {
+		return false
 	}
+	return compareEventIDs(env.Event, replayedThrough) <= 0
 }
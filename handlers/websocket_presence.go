@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/services"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+// Presence states reported for a user
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+const (
+	// presenceTTL is how long a session stays present without a heartbeat,
+	// so sessions of a crashed pod drop out on their own
+	presenceTTL = 90 * time.Second
+	// presenceHeartbeat is how often live sessions refresh their TTL
+	presenceHeartbeat = 30 * time.Second
+)
+
+// sessionKey returns the Redis hash describing a session
+func sessionKey(sessionID string) string {
+	return fmt.Sprintf("session:%s", sessionID)
+}
+
+// userPresenceKey returns the Redis set of a user's sessions across pods
+func userPresenceKey(userID uint) string {
+	return fmt.Sprintf("presence:user:%d", userID)
+}
+
+// storeSession records a session and its status for the user's presence
+func (h *DistributedHub) storeSession(client *Client, status string) error {
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := h.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, sessionKey(client.sessionID), map[string]interface{}{
+			"pod":     h.podID,
+			"user_id": client.userID,
+			"status":  status,
+		})
+		pipe.Expire(ctx, sessionKey(client.sessionID), presenceTTL)
+		pipe.SAdd(ctx, userPresenceKey(client.userID), client.sessionID)
+		pipe.Expire(ctx, userPresenceKey(client.userID), presenceTTL)
+		return nil
+	})
+	return err
+}
+
+// removeSession drops a session from the user's presence
+func (h *DistributedHub) removeSession(client *Client) error {
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := h.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(client.sessionID))
+		pipe.SRem(ctx, userPresenceKey(client.userID), client.sessionID)
+		return nil
+	})
+	return err
+}
+
+// userPresence aggregates the status of every session of a user on any pod:
+// online if one session is online, away if all are away, offline otherwise
+func (h *DistributedHub) userPresence(ctx context.Context, userID uint) (string, error) {
+	sessionIDs, err := h.redis.SMembers(ctx, userPresenceKey(userID)).Result()
+	if err != nil {
+		return PresenceOffline, err
+	}
+	if len(sessionIDs) == 0 {
+		return PresenceOffline, nil
+	}
+
+	statuses := make([]*redis.StringCmd, len(sessionIDs))
+	if _, err := h.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, sessionID := range sessionIDs {
+			statuses[i] = pipe.HGet(ctx, sessionKey(sessionID), "status")
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return PresenceOffline, err
+	}
+
+	presence := PresenceOffline
+	var stale []interface{}
+	for i, cmd := range statuses {
+		switch cmd.Val() {
+		case PresenceOnline:
+			presence = PresenceOnline
+		case PresenceAway:
+			if presence == PresenceOffline {
+				presence = PresenceAway
+			}
+		default:
+			// The session expired without being removed, e.g. its pod died
+			stale = append(stale, sessionIDs[i])
+		}
+	}
+
+	if len(stale) > 0 {
+		h.redis.SRem(ctx, userPresenceKey(userID), stale...)
+	}
+	return presence, nil
+}
+
+// UserPresence returns the presence of each user; users whose presence
+// cannot be read are reported offline
+func (h *DistributedHub) UserPresence(userIDs []uint) map[uint]string {
+	presence := make(map[uint]string, len(userIDs))
+	if h == nil {
+		for _, userID := range userIDs {
+			presence[userID] = PresenceOffline
+		}
+		return presence
+	}
+
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	for _, userID := range userIDs {
+		status, err := h.userPresence(ctx, userID)
+		if err != nil {
+			log.Printf("Failed to read presence for user %d: %v", userID, err)
+		}
+		presence[userID] = status
+	}
+	return presence
+}
+
+// currentPresence reads a user's presence, logging failures as offline
+func (h *DistributedHub) currentPresence(userID uint) string {
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	status, err := h.userPresence(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to read presence for user %d: %v", userID, err)
+	}
+	return status
+}
+
+// setSessionStatus changes a session's status and announces the user's new
+// presence if it changed
+func (h *DistributedHub) setSessionStatus(client *Client, status string) error {
+	previous := h.currentPresence(client.userID)
+	if err := h.storeSession(client, status); err != nil {
+		return err
+	}
+	h.announcePresence(client, previous)
+	return nil
+}
+
+// announcePresence tells the user's group peers about a presence change
+func (h *DistributedHub) announcePresence(client *Client, previous string) {
+	current := h.currentPresence(client.userID)
+	if current == previous {
+		return
+	}
+
+	username := ""
+	if client.claims != nil {
+		username = client.claims.Username
+	}
+
+	for _, groupID := range h.clientGroups(client) {
+		h.sendEnvelope(Message{GroupID: groupID}, EnvelopePresence, groupChannel(groupID), map[string]interface{}{
+			"user_id":  client.userID,
+			"username": username,
+			"status":   current,
+		})
+	}
+}
+
+// presenceUpdate is a session coming online or going away, for persistPresence
+type presenceUpdate struct {
+	client *Client
+	online bool
+}
+
+// queuePresence hands a session's registration or disconnection to
+// persistPresence, so the hub loop never waits on Redis
+func (h *DistributedHub) queuePresence(client *Client, online bool) {
+	select {
+	case h.presence <- presenceUpdate{client: client, online: online}:
+	case <-h.ctx.Done():
+	}
+}
+
+// persistPresence stores and removes sessions in Redis and announces the
+// resulting presence changes. Updates are applied one at a time, in the order
+// the hub saw them, so a disconnect is never overtaken by its registration.
+func (h *DistributedHub) persistPresence() {
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case update := <-h.presence:
+			previous := h.currentPresence(update.client.userID)
+			if update.online {
+				h.storeSessionWithRetry(update.client)
+			} else if err := h.removeSession(update.client); err != nil {
+				log.Printf("Failed to remove session from Redis: %v", err)
+			}
+
+			// Announcing sends through the hub loop, so it must not block it
+			go h.announcePresence(update.client, previous)
+		}
+	}
+}
+
+// storeSessionWithRetry marks a new session online, backing off between attempts
+func (h *DistributedHub) storeSessionWithRetry(client *Client) {
+	for i := 0; i < h.maxRetries; i++ {
+		err := h.storeSession(client, PresenceOnline)
+		if err == nil {
+			return
+		}
+
+		if i == h.maxRetries-1 {
+			log.Printf("Failed to store session after %d retries: %v", h.maxRetries, err)
+			return
+		}
+
+		select {
+		case <-time.After(time.Second * time.Duration(i+1)):
+		case <-h.ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshPresence periodically extends the TTL of this pod's sessions
+func (h *DistributedHub) refreshPresence() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			h.mu.RLock()
+			keys := make([]string, 0, len(h.clients)+len(h.userSessions))
+			for sessionID := range h.clients {
+				keys = append(keys, sessionKey(sessionID))
+			}
+			for userID := range h.userSessions {
+				keys = append(keys, userPresenceKey(userID))
+			}
+			h.mu.RUnlock()
+
+			if len(keys) == 0 {
+				continue
+			}
+
+			ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+			_, err := h.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for _, key := range keys {
+					pipe.Expire(ctx, key, presenceTTL)
+				}
+				return nil
+			})
+			cancel()
+
+			if err != nil {
+				log.Printf("Failed to refresh presence: %v", err)
+			}
+		}
+	}
+}
+
+// groupPresence returns the presence of the group's members for rendering
+func groupPresence(hub *DistributedHub, group models.UserGroup) map[uint]string {
+	memberIDs := make([]uint, len(group.Members))
+	for i, member := range group.Members {
+		memberIDs[i] = member.UserID
+	}
+
+	return hub.UserPresence(memberIDs)
+}
+
+// GetGroupPresenceHandler returns the presence of a group's creator and members
+func GetGroupPresenceHandler(groups services.GroupService, hub *DistributedHub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			return
+		}
+
+		memberIDs, err := groups.MemberIDs(uint(groupID))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch group members"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"presence": hub.UserPresence(memberIDs)})
+	}
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/services"
+)
+
+// ProtocolVersion is the WebSocket envelope version spoken by the server
+const ProtocolVersion = 1
+
+// Envelope types understood by the server and sent to clients
+const (
+	EnvelopeSubscribe    = "subscribe"
+	EnvelopeUnsubscribe  = "unsubscribe"
+	EnvelopeChatMessage  = "chat.message"
+	EnvelopeTyping       = "typing"
+	EnvelopePresence     = "presence"
+	EnvelopeNotification = "notification"
+	EnvelopeError        = "error"
+	EnvelopeAck          = "ack"
+	// EnvelopeReplayComplete marks the end of replayed frames after a reconnect
+	EnvelopeReplayComplete = "replay.complete"
+)
+
+// Envelope is the JSON frame exchanged over the WebSocket in both directions.
+// Clients set Ack to have the server confirm a frame with an ack of the same ID.
+// Event is the stream ID of recorded frames; clients pass the last one they saw
+// as last_event_id when reconnecting to have the gap replayed.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Channel string          `json:"channel,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Ack     bool            `json:"ack,omitempty"`
+	Event   string          `json:"event,omitempty"`
+}
+
+// ProtocolError is reported back to the client in an error frame
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newProtocolError(code, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// EnvelopeHandler processes an inbound frame of one type
+type EnvelopeHandler func(c *Client, env Envelope) error
+
+// envelopeHandlers is the server-side dispatch table keyed by envelope type
+var envelopeHandlers = map[string]EnvelopeHandler{}
+
+// RegisterEnvelopeHandler adds or replaces the handler for an envelope type
+func RegisterEnvelopeHandler(envelopeType string, handler EnvelopeHandler) {
+	envelopeHandlers[envelopeType] = handler
+}
+
+func init() {
+	RegisterEnvelopeHandler(EnvelopeSubscribe, handleSubscribeEnvelope)
+	RegisterEnvelopeHandler(EnvelopeUnsubscribe, handleUnsubscribeEnvelope)
+	RegisterEnvelopeHandler(EnvelopeChatMessage, handleChatMessageEnvelope)
+	RegisterEnvelopeHandler(EnvelopeTyping, handleTypingEnvelope)
+	RegisterEnvelopeHandler(EnvelopePresence, handlePresenceEnvelope)
+}
+
+// encodeEnvelope builds the wire form of an outbound frame
+func encodeEnvelope(envelopeType, id, channel string, payload interface{}) ([]byte, error) {
+	env := Envelope{
+		Version: ProtocolVersion,
+		Type:    envelopeType,
+		ID:      id,
+		Channel: channel,
+	}
+
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = raw
+	}
+
+	return json.Marshal(env)
+}
+
+// parseGroupChannel extracts the group ID from a "group:<id>" channel
+func parseGroupChannel(channel string) (uint, error) {
+	idStr, ok := strings.CutPrefix(channel, "group:")
+	if !ok {
+		return 0, newProtocolError("bad_channel", "Channel must be group:<id>")
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil || id == 0 {
+		return 0, newProtocolError("bad_channel", "Invalid group ID")
+	}
+	return uint(id), nil
+}
+
+// envelopeScope returns the API key scope needed to send a frame type.
+// Like HTTP requests, only frames that change nothing get by with read.
+func envelopeScope(envelopeType string) string {
+	switch envelopeType {
+	case EnvelopeSubscribe, EnvelopeUnsubscribe:
+		return auth.ScopeRead
+	default:
+		return auth.ScopeWrite
+	}
+}
+
+// hasScope reports whether the session may send frames needing a scope.
+// Logged in users may send anything; API keys only what they were granted.
+func (c *Client) hasScope(scope string) bool {
+	if !c.viaAPIKey {
+		return true
+	}
+	for _, granted := range c.scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch decodes an inbound frame and runs the registered handler
+func (c *Client) dispatch(data []byte) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type == "" {
+		c.replyError("", newProtocolError("bad_request", "Invalid message envelope"))
+		return
+	}
+
+	if env.Version != 0 && env.Version != ProtocolVersion {
+		c.replyError(env.ID, newProtocolError("unsupported_version", fmt.Sprintf("Protocol version %d is not supported", env.Version)))
+		return
+	}
+
+	handler, ok := envelopeHandlers[env.Type]
+	if !ok {
+		c.replyError(env.ID, newProtocolError("unknown_type", "Unknown message type: "+env.Type))
+		return
+	}
+
+	if scope := envelopeScope(env.Type); !c.hasScope(scope) {
+		c.replyError(env.ID, newProtocolError("forbidden", "API key is missing the "+scope+" scope"))
+		return
+	}
+
+	if err := handler(c, env); err != nil {
+		var protocolErr *ProtocolError
+		if !errors.As(err, &protocolErr) {
+			log.Printf("WebSocket %s handler failed: %v", env.Type, err)
+			protocolErr = newProtocolError("internal", "Failed to process message")
+		}
+		c.replyError(env.ID, protocolErr)
+		return
+	}
+
+	if env.Ack {
+		c.reply(EnvelopeAck, env.ID, env.Channel, nil)
+	}
+}
+
+// reply sends a frame to this client's session only
+func (c *Client) reply(envelopeType, id, channel string, payload interface{}) {
+	data, err := encodeEnvelope(envelopeType, id, channel, payload)
+	if err != nil {
+		log.Printf("Failed to encode %s frame: %v", envelopeType, err)
+		return
+	}
+	c.hub.sendToSession(c.sessionID, data)
+}
+
+// replyError sends an error frame to this client's session
+func (c *Client) replyError(id string, err *ProtocolError) {
+	c.reply(EnvelopeError, id, "", err)
+}
+
+// handleSubscribeEnvelope starts delivery of a group channel to this session
+func handleSubscribeEnvelope(c *Client, env Envelope) error {
+	groupID, err := parseGroupChannel(env.Channel)
+	if err != nil {
+		return err
+	}
+	return c.hub.subscribeClient(c, groupID)
+}
+
+// handleUnsubscribeEnvelope stops delivery of a group channel to this session
+func handleUnsubscribeEnvelope(c *Client, env Envelope) error {
+	groupID, err := parseGroupChannel(env.Channel)
+	if err != nil {
+		return err
+	}
+	c.hub.unsubscribeClient(c, groupID)
+	return nil
+}
+
+// handleChatMessageEnvelope stores a chat message and delivers it to the group
+func handleChatMessageEnvelope(c *Client, env Envelope) error {
+	groupID, err := parseGroupChannel(env.Channel)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		Content string `json:"content"`
+	}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return newProtocolError("bad_request", "Invalid chat message payload")
+	}
+
+	if !c.hub.isClientMember(c, groupID) {
+		return newProtocolError("forbidden", "You are not a member of this group")
+	}
+
+	if c.hub.groups == nil {
+		return newProtocolError("unavailable", "Chat is not available")
+	}
+
+	var inputErr *services.InputError
+	_, err = c.hub.groups.PostMessage(groupID, c.userID, payload.Content)
+	if errors.As(err, &inputErr) {
+		return newProtocolError("bad_request", inputErr.Error())
+	}
+	return err
+}
+
+// handleTypingEnvelope relays a typing indicator to the group
+func handleTypingEnvelope(c *Client, env Envelope) error {
+	groupID, err := parseGroupChannel(env.Channel)
+	if err != nil {
+		return err
+	}
+
+	var payload struct {
+		Typing bool `json:"typing"`
+	}
+	if len(env.Payload) > 0 {
+		if err := json.Unmarshal(env.Payload, &payload); err != nil {
+			return newProtocolError("bad_request", "Invalid typing payload")
+		}
+	}
+
+	if !c.hub.isClientMember(c, groupID) {
+		return newProtocolError("forbidden", "You are not a member of this group")
+	}
+
+	c.hub.sendEnvelope(Message{GroupID: groupID}, EnvelopeTyping, env.Channel, map[string]interface{}{
+		"user_id":  c.userID,
+		"username": c.claims.Username,
+		"typing":   payload.Typing,
+	})
+	return nil
+}
+
+// handlePresenceEnvelope sets this session's status; the user's group peers
+// are told when the user's overall presence changes
+func handlePresenceEnvelope(c *Client, env Envelope) error {
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		return newProtocolError("bad_request", "Invalid presence payload")
+	}
+
+	if payload.Status != PresenceOnline && payload.Status != PresenceAway {
+		return newProtocolError("bad_request", "Status must be online or away")
+	}
+
+	return c.hub.setSessionStatus(c, payload.Status)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+)
+
+func TestDispatchRejectsReadOnlyAPIKey(t *testing.T) {
+	for _, envelopeType := range []string{EnvelopeChatMessage, EnvelopeTyping, EnvelopePresence} {
+		client := &Client{
+			sessionID: "session",
+			send:      make(chan []byte, 1),
+			viaAPIKey: true,
+			scopes:    []string{auth.ScopeRead},
+		}
+		client.hub = &DistributedHub{clients: map[string]*Client{"session": client}}
+
+		client.dispatch([]byte(`{"v":1,"type":"` + envelopeType + `","id":"1","channel":"group:1","payload":{}}`))
+
+		select {
+		case data := <-client.send:
+			var env struct {
+				Type    string        `json:"type"`
+				ID      string        `json:"id"`
+				Payload ProtocolError `json:"payload"`
+			}
+			if err := json.Unmarshal(data, &env); err != nil {
+				t.Fatalf("%s: invalid reply: %v", envelopeType, err)
+			}
+			if env.Type != EnvelopeError || env.ID != "1" || env.Payload.Code != "forbidden" {
+				t.Errorf("%s: got %s frame %q with code %q, want forbidden error", envelopeType, env.Type, env.ID, env.Payload.Code)
+			}
+		default:
+			t.Errorf("%s: read-only API key was not rejected", envelopeType)
+		}
+	}
+}
+
+func TestClientHasScope(t *testing.T) {
+	tests := []struct {
+		name   string
+		client *Client
+		scope  string
+		want   bool
+	}{
+		{"login read", &Client{}, auth.ScopeRead, true},
+		{"login write", &Client{}, auth.ScopeWrite, true},
+		{"read key read", &Client{viaAPIKey: true, scopes: []string{auth.ScopeRead}}, auth.ScopeRead, true},
+		{"read key write", &Client{viaAPIKey: true, scopes: []string{auth.ScopeRead}}, auth.ScopeWrite, false},
+		{"write key write", &Client{viaAPIKey: true, scopes: []string{auth.ScopeRead, auth.ScopeWrite}}, auth.ScopeWrite, true},
+		{"key without scopes", &Client{viaAPIKey: true}, auth.ScopeRead, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.client.hasScope(tt.scope); got != tt.want {
+			t.Errorf("%s: hasScope(%q) = %v, want %v", tt.name, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestEnvelopeScope(t *testing.T) {
+	tests := map[string]string{
+		EnvelopeSubscribe:   auth.ScopeRead,
+		EnvelopeUnsubscribe: auth.ScopeRead,
+		EnvelopeChatMessage: auth.ScopeWrite,
+		EnvelopeTyping:      auth.ScopeWrite,
+		EnvelopePresence:    auth.ScopeWrite,
+	}
+
+	for envelopeType, want := range tests {
+		if got := envelopeScope(envelopeType); got != want {
+			t.Errorf("envelopeScope(%q) = %q, want %q", envelopeType, got, want)
+		}
+	}
+}
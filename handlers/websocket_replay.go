@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// replayPageSize is how many events are read from a stream at a time on reconnect
+const replayPageSize = 500
+
+// durableEnvelopes are the frame types recorded for replay; typing and
+// presence are only meaningful live
+var durableEnvelopes = map[string]bool{
+	EnvelopeChatMessage:  true,
+	EnvelopeNotification: true,
+}
+
+// streamKey returns the Redis stream recording events for a channel
+func streamKey(channel string) string {
+	return "stream:" + channel
+}
+
+// parseEventID splits a Redis stream ID of the form <ms>-<seq>
+func parseEventID(id string) (ms, seq uint64, err error) {
+	msPart, seqPart, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid event ID: %s", id)
+	}
+
+	if ms, err = strconv.ParseUint(msPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid event ID: %s", id)
+	}
+	if seq, err = strconv.ParseUint(seqPart, 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid event ID: %s", id)
+	}
+	return ms, seq, nil
+}
+
+// compareEventIDs orders two valid stream IDs like strings.Compare
+func compareEventIDs(a, b string) int {
+	aMs, aSeq, _ := parseEventID(a)
+	bMs, bSeq, _ := parseEventID(b)
+
+	switch {
+	case aMs != bMs:
+		if aMs < bMs {
+			return -1
+		}
+		return 1
+	case aSeq != bSeq:
+		if aSeq < bSeq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// nextEventID returns the smallest stream ID after id, for exclusive ranges
+func nextEventID(id string) string {
+	ms, seq, _ := parseEventID(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// recordEvent appends a frame to the channel's stream and returns its event ID.
+// An empty ID means the frame could not be recorded and is only delivered live.
+func (h *DistributedHub) recordEvent(channel, envelopeType string, payload json.RawMessage) string {
+	ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+	defer cancel()
+
+	key := streamKey(channel)
+	var add *redis.StringCmd
+	_, err := h.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		add = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: h.streamMaxLen,
+			Approx: true,
+			Values: map[string]interface{}{
+				"type":    envelopeType,
+				"channel": channel,
+				"payload": string(payload),
+			},
+		})
+		pipe.Expire(ctx, key, h.streamRetention)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to record %s event on %s: %v", envelopeType, key, err)
+		return ""
+	}
+	return add.Val()
+}
+
+// replayEvents returns the frames recorded after lastEventID on the session's
+// user and group streams, oldest first. Each stream is read in pages until its
+// end, so nothing recorded before the read is left out. truncated is set when a
+// stream was trimmed past lastEventID, meaning some events can't be replayed.
+func (h *DistributedHub) replayEvents(client *Client, lastEventID string) (frames []Envelope, truncated bool, err error) {
+	h.mu.RLock()
+	channels := []string{userChannel(client.userID)}
+	for groupID := range client.subscriptions {
+		channels = append(channels, groupChannel(groupID))
+	}
+	h.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(h.ctx, 30*time.Second)
+	defer cancel()
+
+	start := nextEventID(lastEventID)
+	for _, channel := range channels {
+		key := streamKey(channel)
+
+		trimmed, err := h.streamTrimmedAfter(ctx, key, start)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read stream %s: %v", key, err)
+		}
+		truncated = truncated || trimmed
+
+		for from := start; ; {
+			entries, err := h.redis.XRangeN(ctx, key, from, "+", replayPageSize).Result()
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to read stream %s: %v", key, err)
+			}
+
+			for _, entry := range entries {
+				envelopeType, _ := entry.Values["type"].(string)
+				frameChannel, _ := entry.Values["channel"].(string)
+				payload, _ := entry.Values["payload"].(string)
+				frames = append(frames, Envelope{
+					Version: ProtocolVersion,
+					Type:    envelopeType,
+					Channel: frameChannel,
+					Payload: json.RawMessage(payload),
+					Event:   entry.ID,
+				})
+			}
+
+			if len(entries) < replayPageSize {
+				break
+			}
+			from = nextEventID(entries[len(entries)-1].ID)
+		}
+	}
+
+	// Stream IDs are time based, so sorting merges the streams in order
+	sort.Slice(frames, func(i, j int) bool {
+		return compareEventIDs(frames[i].Event, frames[j].Event) < 0
+	})
+
+	return frames, truncated, nil
+}
+
+// streamTrimmedAfter reports whether a stream at its length cap has dropped
+// events at or after start. Streams below the cap have never been trimmed.
+func (h *DistributedHub) streamTrimmedAfter(ctx context.Context, key, start string) (bool, error) {
+	length, err := h.redis.XLen(ctx, key).Result()
+	if err != nil || length < h.streamMaxLen {
+		return false, err
+	}
+
+	oldest, err := h.redis.XRangeN(ctx, key, "-", "+", 1).Result()
+	if err != nil || len(oldest) == 0 {
+		return false, err
+	}
+	return compareEventIDs(oldest[0].ID, start) > 0, nil
+}
@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// Control messages keep the group indexes on every pod in sync
+const (
+	controlJoinGroup  = "join_group"
+	controlLeaveGroup = "leave_group"
+)
+
+// broadcastChannel is the Redis channel for messages meant for every client
+const broadcastChannel = "broadcast"
+
+// userChannel returns the Redis channel for a single user's sessions
+func userChannel(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// groupChannel returns the Redis channel for a group's member sessions
+func groupChannel(groupID uint) string {
+	return fmt.Sprintf("group:%d", groupID)
+}
+
+// channelFor picks the Redis channel a message is published on
+func channelFor(message Message) string {
+	if message.UserID != 0 {
+		return userChannel(message.UserID)
+	}
+	if message.GroupID != 0 {
+		return groupChannel(message.GroupID)
+	}
+	return broadcastChannel
+}
+
+// subscribedChannels lists every channel this pod needs; callers must hold h.mu
+func (h *DistributedHub) subscribedChannels() []string {
+	channels := []string{broadcastChannel}
+	for userID := range h.userSessions {
+		channels = append(channels, userChannel(userID))
+	}
+	for groupID := range h.groupSessions {
+		channels = append(channels, groupChannel(groupID))
+	}
+	return channels
+}
+
+// wantsChannel reports whether this pod has sessions for a channel; callers must hold h.mu
+func (h *DistributedHub) wantsChannel(channel string) bool {
+	if channel == broadcastChannel {
+		return true
+	}
+
+	var id uint
+	if _, err := fmt.Sscanf(channel, "user:%d", &id); err == nil {
+		return len(h.userSessions[id]) > 0
+	}
+	if _, err := fmt.Sscanf(channel, "group:%d", &id); err == nil {
+		return len(h.groupSessions[id]) > 0
+	}
+	return false
+}
+
+// syncChannels subscribes to or unsubscribes from channels whose local
+// sessions changed. It must be called without h.mu held: the Redis calls
+// would stall every other hub operation. subMu keeps the calls in order,
+// and each channel's state is read again under it, so the latest change
+// wins. When no subscription is active the channels are picked up on the
+// next (re)subscribe.
+func (h *DistributedHub) syncChannels(channels []string) {
+	if len(channels) == 0 {
+		return
+	}
+
+	h.subMu.Lock()
+	defer h.subMu.Unlock()
+
+	for _, channel := range channels {
+		h.mu.RLock()
+		pubsub := h.pubsub
+		wanted := h.wantsChannel(channel)
+		h.mu.RUnlock()
+
+		if pubsub == nil {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(h.ctx, 5*time.Second)
+		if wanted {
+			if err := pubsub.Subscribe(ctx, channel); err != nil {
+				log.Printf("Failed to subscribe to %s: %v", channel, err)
+			}
+		} else if err := pubsub.Unsubscribe(ctx, channel); err != nil {
+			log.Printf("Failed to unsubscribe from %s: %v", channel, err)
+		}
+		cancel()
+	}
+}
+
+// indexClient adds a client to the user and group indexes and returns the
+// channels to subscribe to; callers must hold h.mu
+func (h *DistributedHub) indexClient(client *Client) []string {
+	var channels []string
+	if client.userID != 0 {
+		sessions, exists := h.userSessions[client.userID]
+		if !exists {
+			sessions = make(map[string]*Client)
+			h.userSessions[client.userID] = sessions
+			channels = append(channels, userChannel(client.userID))
+		}
+		sessions[client.sessionID] = client
+	}
+
+	for groupID := range client.subscriptions {
+		channels = append(channels, h.addGroupSession(groupID, client)...)
+	}
+	return channels
+}
+
+// unindexClient removes a client from the user and group indexes and
+// returns the channels to unsubscribe from; callers must hold h.mu
+func (h *DistributedHub) unindexClient(client *Client) []string {
+	var channels []string
+	if sessions, exists := h.userSessions[client.userID]; exists {
+		delete(sessions, client.sessionID)
+		if len(sessions) == 0 {
+			delete(h.userSessions, client.userID)
+			channels = append(channels, userChannel(client.userID))
+		}
+	}
+
+	for groupID := range client.subscriptions {
+		channels = append(channels, h.removeGroupSession(groupID, client)...)
+	}
+	return channels
+}
+
+// addGroupSession adds a client to a group's sessions and returns the
+// channel to subscribe to, if any; callers must hold h.mu
+func (h *DistributedHub) addGroupSession(groupID uint, client *Client) []string {
+	sessions, exists := h.groupSessions[groupID]
+	if !exists {
+		sessions = make(map[string]*Client)
+		h.groupSessions[groupID] = sessions
+	}
+	sessions[client.sessionID] = client
+
+	if !exists {
+		return []string{groupChannel(groupID)}
+	}
+	return nil
+}
+
+// removeGroupSession removes a client from a group's sessions and returns
+// the channel to unsubscribe from, if any; callers must hold h.mu
+func (h *DistributedHub) removeGroupSession(groupID uint, client *Client) []string {
+	sessions, exists := h.groupSessions[groupID]
+	if !exists {
+		return nil
+	}
+
+	delete(sessions, client.sessionID)
+	if len(sessions) == 0 {
+		delete(h.groupSessions, groupID)
+		return []string{groupChannel(groupID)}
+	}
+	return nil
+}
+
+// applyControl updates the local group indexes for a membership change
+func (h *DistributedHub) applyControl(message Message) {
+	var channels []string
+
+	h.mu.Lock()
+	for _, client := range h.userSessions[message.UserID] {
+		switch message.Control {
+		case controlJoinGroup:
+			client.groups[message.GroupID] = true
+			if !client.subscriptions[message.GroupID] {
+				client.subscriptions[message.GroupID] = true
+				channels = append(channels, h.addGroupSession(message.GroupID, client)...)
+			}
+		case controlLeaveGroup:
+			delete(client.groups, message.GroupID)
+			if client.subscriptions[message.GroupID] {
+				delete(client.subscriptions, message.GroupID)
+				channels = append(channels, h.removeGroupSession(message.GroupID, client)...)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	h.syncChannels(channels)
+}
+
+// subscribeClient starts delivering a group channel to one session
+func (h *DistributedHub) subscribeClient(client *Client, groupID uint) error {
+	h.mu.Lock()
+	if !client.groups[groupID] {
+		h.mu.Unlock()
+		return newProtocolError("forbidden", "You are not a member of this group")
+	}
+
+	var channels []string
+	if !client.subscriptions[groupID] {
+		client.subscriptions[groupID] = true
+		channels = h.addGroupSession(groupID, client)
+	}
+	h.mu.Unlock()
+
+	h.syncChannels(channels)
+	return nil
+}
+
+// unsubscribeClient stops delivering a group channel to one session
+func (h *DistributedHub) unsubscribeClient(client *Client, groupID uint) {
+	var channels []string
+
+	h.mu.Lock()
+	if client.subscriptions[groupID] {
+		delete(client.subscriptions, groupID)
+		channels = h.removeGroupSession(groupID, client)
+	}
+	h.mu.Unlock()
+
+	h.syncChannels(channels)
+}
+
+// isClientMember reports whether the session's user belongs to the group
+func (h *DistributedHub) isClientMember(client *Client, groupID uint) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return client.groups[groupID]
+}
+
+// clientGroups returns the IDs of the groups the session's user belongs to
+func (h *DistributedHub) clientGroups(client *Client) []uint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	groupIDs := make([]uint, 0, len(client.groups))
+	for groupID := range client.groups {
+		groupIDs = append(groupIDs, groupID)
+	}
+	return groupIDs
+}
+
+// sendToSession delivers a frame to a single local session
+func (h *DistributedHub) sendToSession(sessionID string, data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	client, exists := h.clients[sessionID]
+	if !exists {
+		return
+	}
+
+	select {
+	case client.send <- data:
+	default:
+		go func(c *Client) {
+			h.unregister <- c
+		}(client)
+	}
+}
+
+// sendEnvelope encodes a frame and hands it to the hub for targeted delivery.
+// Durable frames for a user or group are recorded first so they can be replayed.
+func (h *DistributedHub) sendEnvelope(target Message, envelopeType, channel string, payload interface{}) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode %s frame: %v", envelopeType, err)
+		return
+	}
+
+	env := Envelope{
+		Version: ProtocolVersion,
+		Type:    envelopeType,
+		Channel: channel,
+		Payload: raw,
+	}
+
+	if durableEnvelopes[envelopeType] && (target.UserID != 0 || target.GroupID != 0) {
+		env.Event = h.recordEvent(channelFor(target), envelopeType, raw)
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Failed to encode %s frame: %v", envelopeType, err)
+		return
+	}
+
+	target.PodID = h.podID
+	target.Data = data
+	target.Timestamp = timeNow()
+	h.broadcast <- target
+}
+
+// AddUserToGroup starts delivering a group's messages to the user's sessions on every pod
+func (h *DistributedHub) AddUserToGroup(userID, groupID uint) {
+	h.broadcast <- Message{
+		PodID:     h.podID,
+		Timestamp: timeNow(),
+		UserID:    userID,
+		GroupID:   groupID,
+		Control:   controlJoinGroup,
+	}
+}
+
+// RemoveUserFromGroup stops delivering a group's messages to the user's sessions on every pod
+func (h *DistributedHub) RemoveUserFromGroup(userID, groupID uint) {
+	h.broadcast <- Message{
+		PodID:     h.podID,
+		Timestamp: timeNow(),
+		UserID:    userID,
+		GroupID:   groupID,
+		Control:   controlLeaveGroup,
+	}
+}
+
+// loadUserGroupIDs returns the IDs of every group the user created or joined
+func loadUserGroupIDs(db *gorm.DB, userID uint) ([]uint, error) {
+	var groupIDs []uint
+	err := db.Model(&models.UserGroup{}).
+		Where("created_by_id = ? OR id IN (SELECT group_id FROM user_group_members WHERE user_id = ?)", userID, userID).
+		Pluck("id", &groupIDs).Error
+	return groupIDs, err
+}
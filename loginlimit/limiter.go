@@ -0,0 +1,261 @@
+// Package loginlimit throttles password and code guessing. Failures are
+// counted per username and per client address in Redis, and a username that
+// fails too often is locked out with an exponential backoff. Hit limits
+// other auth requests, such as reset links, by plain request counts.
+//
+// The limiter fails open: callers treat a Redis error as "not blocked" and
+// log it. A Redis outage then disables throttling rather than locking every
+// user out of the application; passwords and 2FA codes are still checked.
+package loginlimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+const (
+	// loginFailureWindow is the sliding window failed logins are counted in
+	loginFailureWindow = 15 * time.Minute
+	// MaxUsernameFailures locks a username after this many failures in the window
+	MaxUsernameFailures = 5
+	// maxIPFailures throttles an address after this many failures in the
+	// window, whichever usernames it tried
+	maxIPFailures = 20
+	// lockoutBaseDuration is the first lockout; each further lockout within
+	// lockoutMemory doubles it, up to lockoutMaxDuration
+	lockoutBaseDuration = time.Minute
+	lockoutMaxDuration  = 24 * time.Hour
+	lockoutMemory       = 24 * time.Hour
+)
+
+// NormalizeName makes limits apply regardless of case and padding
+func NormalizeName(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// loginFailuresUserKey returns the sorted set of a username's recent failures
+func loginFailuresUserKey(username string) string {
+	return fmt.Sprintf("login:failures:user:%s", username)
+}
+
+// loginFailuresIPKey returns the sorted set of an address's recent failures
+func loginFailuresIPKey(ip string) string {
+	return fmt.Sprintf("login:failures:ip:%s", ip)
+}
+
+// loginLockKey returns the key that exists while a username is locked
+func loginLockKey(username string) string {
+	return fmt.Sprintf("login:lock:%s", username)
+}
+
+// loginLockoutCountKey counts a username's recent lockouts for the backoff
+func loginLockoutCountKey(username string) string {
+	return fmt.Sprintf("login:lockouts:%s", username)
+}
+
+// lockoutDuration returns the backoff for the nth lockout
+func lockoutDuration(lockouts int64) time.Duration {
+	duration := lockoutBaseDuration
+	for i := int64(1); i < lockouts && duration < lockoutMaxDuration; i++ {
+		duration *= 2
+	}
+	if duration > lockoutMaxDuration {
+		duration = lockoutMaxDuration
+	}
+	return duration
+}
+
+// Limiter tracks failed logins in Redis
+type Limiter struct {
+	redis *redis.Client
+}
+
+// New creates a limiter that stores its counters with the given client
+func New(client *redis.Client) *Limiter {
+	return &Limiter{redis: client}
+}
+
+// Blocked reports how long a login for the username from the address
+// has to wait, or zero if it may proceed
+func (l *Limiter) Blocked(ctx context.Context, username, ip string) (time.Duration, error) {
+	username = NormalizeName(username)
+	windowStart := time.Now().Add(-loginFailureWindow).UnixMilli()
+
+	var lockTTL *redis.DurationCmd
+	var oldest *redis.ZSliceCmd
+	var ipFailures *redis.IntCmd
+	_, err := l.redis.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		lockTTL = pipe.PTTL(ctx, loginLockKey(username))
+		pipe.ZRemRangeByScore(ctx, loginFailuresIPKey(ip), "-inf", fmt.Sprint(windowStart))
+		ipFailures = pipe.ZCard(ctx, loginFailuresIPKey(ip))
+		oldest = pipe.ZRangeWithScores(ctx, loginFailuresIPKey(ip), 0, 0)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	if ttl := lockTTL.Val(); ttl > 0 {
+		return ttl, nil
+	}
+
+	// The address may try again once its oldest failure leaves the window
+	if ipFailures.Val() >= maxIPFailures && len(oldest.Val()) > 0 {
+		expires := time.UnixMilli(int64(oldest.Val()[0].Score)).Add(loginFailureWindow)
+		if wait := time.Until(expires); wait > 0 {
+			return wait, nil
+		}
+	}
+	return 0, nil
+}
+
+// RecordFailure counts a failed login for the username and address and
+// locks the username once it has too many. It returns the lockout duration
+// and how many lockouts the username had recently, or zero if not locked.
+func (l *Limiter) RecordFailure(ctx context.Context, username, ip string) (time.Duration, int64, error) {
+	username = NormalizeName(username)
+	now := time.Now()
+	windowStart := now.Add(-loginFailureWindow).UnixMilli()
+	attempt := &redis.Z{Score: float64(now.UnixMilli()), Member: uuid.New().String()}
+
+	var userFailures *redis.IntCmd
+	_, err := l.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range []string{loginFailuresUserKey(username), loginFailuresIPKey(ip)} {
+			pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint(windowStart))
+			pipe.ZAdd(ctx, key, attempt)
+			pipe.PExpire(ctx, key, loginFailureWindow)
+		}
+		userFailures = pipe.ZCard(ctx, loginFailuresUserKey(username))
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if userFailures.Val() < MaxUsernameFailures {
+		return 0, 0, nil
+	}
+
+	lockouts, err := l.redis.Incr(ctx, loginLockoutCountKey(username)).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	duration := lockoutDuration(lockouts)
+
+	// Start the next lockout with a clean slate of attempts
+	_, err = l.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Expire(ctx, loginLockoutCountKey(username), lockoutMemory)
+		pipe.Set(ctx, loginLockKey(username), now.Add(duration).Unix(), duration)
+		pipe.Del(ctx, loginFailuresUserKey(username))
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return duration, lockouts, nil
+}
+
+// ClearFailures forgets a username's failures and backoff after a
+// successful login. The address keeps its count so logging into one account
+// doesn't reset guessing against others.
+func (l *Limiter) ClearFailures(ctx context.Context, username string) error {
+	username = NormalizeName(username)
+	return l.redis.Del(ctx, loginFailuresUserKey(username), loginLockoutCountKey(username)).Err()
+}
+
+// Lockouts lists the usernames that are currently locked
+func (l *Limiter) Lockouts(ctx context.Context) ([]models.LoginLockout, error) {
+	var lockouts []models.LoginLockout
+
+	iter := l.redis.Scan(ctx, 0, loginLockKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		username := strings.TrimPrefix(iter.Val(), loginLockKey(""))
+
+		until, err := l.redis.Get(ctx, iter.Val()).Result()
+		if err == redis.Nil {
+			// Expired since the scan
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		unlockAt, _ := strconv.ParseInt(until, 10, 64)
+
+		count, err := l.redis.Get(ctx, loginLockoutCountKey(username)).Int64()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+
+		lockouts = append(lockouts, models.LoginLockout{
+			Username:    username,
+			LockedUntil: time.Unix(unlockAt, 0),
+			Lockouts:    count,
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return lockouts, nil
+}
+
+// ClearLockout unlocks a username and resets its failures and backoff.
+// It reports whether the username was locked.
+func (l *Limiter) ClearLockout(ctx context.Context, username string) (bool, error) {
+	username = NormalizeName(username)
+	cleared, err := l.redis.Del(ctx, loginLockKey(username)).Result()
+	if err != nil {
+		return false, err
+	}
+	if err := l.redis.Del(ctx, loginFailuresUserKey(username), loginLockoutCountKey(username)).Err(); err != nil {
+		return false, err
+	}
+	return cleared > 0, nil
+}
+
+// rateLimitKey counts requests of one kind from one caller
+func rateLimitKey(key string) string {
+	return fmt.Sprintf("ratelimit:%s", key)
+}
+
+// Hit counts a request against key and reports how long the caller has to
+// wait once more than limit requests arrived in the current window, or zero
+// if it may proceed. Unlike failed logins, every request counts.
+func (l *Limiter) Hit(ctx context.Context, key string, limit int64, window time.Duration) (time.Duration, error) {
+	key = rateLimitKey(key)
+
+	var count *redis.IntCmd
+	var ttl *redis.DurationCmd
+	_, err := l.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(ctx, key)
+		ttl = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The first request of a window starts its clock
+	if ttl.Val() < 0 {
+		if err := l.redis.PExpire(ctx, key, window).Err(); err != nil {
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	if count.Val() > limit {
+		return ttl.Val(), nil
+	}
+	return 0, nil
+}
+
+// Close releases the limiter's Redis connections
+func (l *Limiter) Close() error {
+	return l.redis.Close()
+}
@@ -10,6 +10,9 @@ import (
 	"time"
 
 	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/mailer"
+	"git.ssy.dk/noob/bingbong-go/oidc"
+	"git.ssy.dk/noob/bingbong-go/passwords"
 	"git.ssy.dk/noob/bingbong-go/redis"
 	"git.ssy.dk/noob/bingbong-go/routes"
 	"github.com/joho/godotenv"
@@ -36,6 +39,19 @@ func main() {
 		log.Println("No .env file found, using environment variables.")
 	}
 
+	// Run migration subcommands without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Migrate failed: %v", err)
+		}
+		return
+	}
+
+	// Load the password policy before the admin account is set up
+	if err := passwords.LoadFromEnv(); err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
+
 	// Initialize DB
 	database, err := db.InitDB()
 	if err != nil {
@@ -43,14 +59,47 @@ func main() {
 	}
 
 	// Initialize Redis and WebSocket hub
-	hub, err := redis.InitRedis()
+	hub, err := redis.InitRedis(database.GetDB())
 	if err != nil {
 		log.Fatalf("Failed to initialize Redis: %v", err)
 	}
 
+	// Initialize login throttling
+	limiter, err := redis.InitLoginLimiter()
+	if err != nil {
+		log.Fatalf("Failed to initialize login limiter: %v", err)
+	}
+
 	// Initialize router with routes
-	router := routes.NewRouter(database.GetDB()) // Use GetDB() to get *gorm.DB
+	router := routes.NewRouter(database)
 	router.SetHub(hub)
+	router.SetLoginLimiter(limiter)
+
+	// Initialize outgoing mail
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+	router.SetMailer(mail)
+
+	// Initialize single sign-on if a provider is configured
+	oidcConfig, err := oidc.ConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid single sign-on configuration: %v", err)
+	}
+	if oidcConfig != nil {
+		discoveryCtx, cancelDiscovery := context.WithTimeout(context.Background(), 15*time.Second)
+		provider, err := oidc.NewProvider(discoveryCtx, oidcConfig)
+		cancelDiscovery()
+		if err != nil {
+			log.Fatalf("Failed to initialize single sign-on: %v", err)
+		}
+		router.SetOIDCProvider(provider)
+	}
+
+	if os.Getenv("REGISTRATION_ENABLED") == "true" {
+		router.EnableRegistration()
+	}
 	router.SetupRoutes()
 
 	// Setup HTTP server
@@ -91,6 +140,9 @@ func main() {
 		hub.Stop()
 		log.Println("Redis hub stopped")
 	}
+	if limiter != nil {
+		limiter.Close()
+	}
 
 	log.Println("Server exiting")
 }
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// requiredScope returns the scope needed for a request method
+func requiredScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return auth.ScopeRead
+	default:
+		return auth.ScopeWrite
+	}
+}
+
+// authenticateAPIKeyRequest handles AuthMiddleware for API key bearer tokens
+func authenticateAPIKeyRequest(c *gin.Context, db *gorm.DB, key string) {
+	claims, apiKey, err := auth.AuthenticateAPIKey(db, key)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+
+	if scope := requiredScope(c.Request.Method); !apiKey.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key is missing the " + scope + " scope"})
+		c.Abort()
+		return
+	}
+
+	c.Set("userID", claims.UserID)
+	c.Set("username", claims.Username)
+	c.Set("isAdmin", claims.IsAdmin)
+	c.Set("role", claims.EffectiveRole())
+	c.Set("claims", claims)
+	c.Set("apiKey", apiKey)
+
+	c.Next()
+}
+
+// SessionOnlyMiddleware rejects requests authenticated with an API key, for
+// routes such as key management that keys must not reach
+func SessionOnlyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, usingKey := c.Get("apiKey"); usingKey {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint can't be used with an API key"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
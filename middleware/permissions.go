@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// HasPermission reports whether the authenticated user's global role has a permission
+func HasPermission(c *gin.Context, perm models.Permission) bool {
+	return models.RoleCan(c.GetString("role"), perm)
+}
+
+// RequirePermission only lets users whose global role has the permission through.
+// It runs after AuthMiddleware.
+func RequirePermission(perm models.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GroupAccessFromContext returns the access RequireGroupPermission loaded
+func GroupAccessFromContext(c *gin.Context) models.GroupAccess {
+	if access, ok := c.Get("groupAccess"); ok {
+		return access.(models.GroupAccess)
+	}
+	return models.GroupAccess{}
+}
+
+// RequireGroupPermission only lets users through who have the permission in
+// the group named by the :id route parameter. The group must exist, and the
+// user's access is stored in the context for the handler.
+func RequireGroupPermission(db *gorm.DB, perm models.GroupPermission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("userID").(uint)
+
+		groupID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+			c.Abort()
+			return
+		}
+
+		if err := db.Select("id").First(&models.UserGroup{}, groupID).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			c.Abort()
+			return
+		}
+
+		access, err := auth.LoadGroupAccess(db, uint(groupID), userID, c.GetString("role"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check group permissions"})
+			c.Abort()
+			return
+		}
+		if !access.Can(perm) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission to do this in this group"})
+			c.Abort()
+			return
+		}
+
+		c.Set("groupAccess", access)
+		c.Next()
+	}
+}
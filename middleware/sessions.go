@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// refreshCookie holds the refresh token for browser sessions
+const refreshCookie = "refresh_token"
+
+// SetSessionCookies stores a token pair in the browser
+func SetSessionCookies(c *gin.Context, pair *auth.TokenPair) {
+	c.SetCookie("auth_token", pair.AccessToken, int(auth.RefreshTokenTTL.Seconds()), "/", "", false, true)
+	if pair.RefreshToken != "" {
+		c.SetCookie(refreshCookie, pair.RefreshToken, int(auth.RefreshTokenTTL.Seconds()), "/", "", false, true)
+	}
+}
+
+// ClearSessionCookies removes the session from the browser
+func ClearSessionCookies(c *gin.Context) {
+	c.SetCookie("auth_token", "", -1, "/", "", false, true)
+	c.SetCookie(refreshCookie, "", -1, "/", "", false, true)
+}
+
+// RefreshTokenFromRequest returns the refresh token from the cookie
+func RefreshTokenFromRequest(c *gin.Context) string {
+	token, err := c.Cookie(refreshCookie)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// refreshFromCookie transparently renews an expired browser session. The new
+// access token is also sent in X-Access-Token for pages that keep it in storage.
+func refreshFromCookie(c *gin.Context, db *gorm.DB) (*auth.Claims, bool) {
+	token := RefreshTokenFromRequest(c)
+	if token == "" {
+		return nil, false
+	}
+
+	pair, err := auth.RefreshSession(db, token)
+	if err != nil {
+		ClearSessionCookies(c)
+		return nil, false
+	}
+
+	SetSessionCookies(c, pair)
+	c.Header("X-Access-Token", pair.AccessToken)
+	return pair.Claims, true
+}
+
+// unauthenticated sends API clients a 401 and browsers to the login page
+func unauthenticated(c *gin.Context, message string) {
+	if c.GetHeader("HX-Request") == "" && c.GetHeader("Authorization") != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+		c.Abort()
+		return
+	}
+	redirectToLogin(c)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/migrations"
+)
+
+const migrateUsage = `usage: bingbong migrate <command>
+
+commands:
+  up              apply all pending migrations
+  down [N]        roll back the last N migrations (default 1)
+  to <version>    migrate up or down to the given version (0 rolls back everything)
+  status          list migrations and whether they are applied
+  redo            roll back and re-apply the newest migration`
+
+// runMigrateCommand drives the migration runner from the command line
+// without starting the HTTP server
+func runMigrateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", migrateUsage)
+	}
+
+	database, err := db.Connect()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if sqlDB, err := database.GetSQLDB(); err == nil {
+			sqlDB.Close()
+		}
+	}()
+
+	runner := migrations.NewRunner(database.GetDB())
+
+	switch args[0] {
+	case "up":
+		return runner.Run()
+
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations: %s", args[1])
+			}
+		}
+		return runner.Down(n)
+
+	case "to":
+		if len(args) < 2 {
+			return fmt.Errorf("missing target version\n\n%s", migrateUsage)
+		}
+		return runner.To(args[1])
+
+	case "status":
+		statuses, err := runner.Status()
+		if err != nil {
+			return err
+		}
+		printMigrationStatus(statuses)
+		return nil
+
+	case "redo":
+		return runner.Redo()
+
+	default:
+		return fmt.Errorf("unknown migrate command %q\n\n%s", args[0], migrateUsage)
+	}
+}
+
+// printMigrationStatus writes the migration status as a table to stdout
+func printMigrationStatus(statuses []migrations.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED AT\tDESCRIPTION")
+
+	for _, status := range statuses {
+		state := "pending"
+		appliedAt := "-"
+		if status.Applied {
+			state = "applied"
+			appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+			if status.ChecksumMismatch {
+				state = "modified"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status.Version, state, appliedAt, status.Description)
+	}
+
+	w.Flush()
+}
@@ -2,10 +2,11 @@
 package migrations
 
 import (
-	"git.ssy.dk/noob/bingbong-go/models"
 	"gorm.io/gorm"
 )
 
+// Migration is a single versioned schema change. Versions are applied in
+// lexical order, so they must keep the YYYY.MM.DD.NN format.
 type Migration struct {
 	Version     string
 	Description string
@@ -13,38 +14,20 @@ type Migration struct {
 	Down        func(*gorm.DB) error
 }
 
-type Runner struct {
-	db *gorm.DB
-}
-
-func NewRunner(db *gorm.DB) *Runner {
-	return &Runner{db: db}
-}
-
-func (r *Runner) Run() error {
-	// Implement migration logic here
-	return nil
-}
-
-func (r *Runner) Status() ([]string, error) {
-	// Implement status fetching logic here
-	return []string{}, nil
-}
-
 var Migrations = []Migration{
 	{
 		Version:     "2025.01.13.01",
 		Description: "Create base user and group tables",
 		Up: func(db *gorm.DB) error {
 			return db.AutoMigrate(
-				&models.User{},
-				&models.UserGroup{},
+				&userV20250113{},
+				&userGroupV20250113{},
 			)
 		},
 		Down: func(db *gorm.DB) error {
 			return db.Migrator().DropTable(
-				&models.UserGroup{},
-				&models.User{},
+				&userGroupV20250113{},
+				&userV20250113{},
 			)
 		},
 	},
@@ -53,16 +36,16 @@ var Migrations = []Migration{
 		Description: "Create relationship tables",
 		Up: func(db *gorm.DB) error {
 			return db.AutoMigrate(
-				&models.UserGroupMember{},
-				&models.UserGroupInvite{},
-				&models.AdminGroupMember{},
+				&userGroupMemberV20250113{},
+				&userGroupInviteV20250113{},
+				&adminGroupMemberV20250113{},
 			)
 		},
 		Down: func(db *gorm.DB) error {
 			return db.Migrator().DropTable(
-				&models.AdminGroupMember{},
-				&models.UserGroupInvite{},
-				&models.UserGroupMember{},
+				&adminGroupMemberV20250113{},
+				&userGroupInviteV20250113{},
+				&userGroupMemberV20250113{},
 			)
 		},
 	},
@@ -71,14 +54,14 @@ var Migrations = []Migration{
 		Description: "Create message and notification tables",
 		Up: func(db *gorm.DB) error {
 			return db.AutoMigrate(
-				&models.GroupMessage{},
-				&models.Notification{},
+				&groupMessageV20250113{},
+				&notificationV20250113{},
 			)
 		},
 		Down: func(db *gorm.DB) error {
 			return db.Migrator().DropTable(
-				&models.Notification{},
-				&models.GroupMessage{},
+				&notificationV20250113{},
+				&groupMessageV20250113{},
 			)
 		},
 	},
@@ -105,4 +88,293 @@ var Migrations = []Migration{
 			return nil
 		},
 	},
+	{
+		Version:     "2026.10.16.01",
+		Description: "Create API key table",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&apiKeyV2026101601{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropTable(&apiKeyV2026101601{})
+		},
+	},
+	{
+		Version:     "2026.10.16.02",
+		Description: "Create session, refresh token and token denylist tables",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(
+				&authSessionV2026101602{},
+				&refreshTokenV2026101602{},
+				&revokedTokenV2026101602{},
+			)
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropTable(
+				&revokedTokenV2026101602{},
+				&refreshTokenV2026101602{},
+				&authSessionV2026101602{},
+			)
+		},
+	},
+	{
+		Version:     "2026.10.16.03",
+		Description: "Add two-factor authentication columns and recovery codes",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(
+				&userV2026101603{},
+				&adminGroupMemberV2026101603{},
+				&recoveryCodeV2026101603{},
+			)
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Migrator().DropTable(&recoveryCodeV2026101603{}); err != nil {
+				return err
+			}
+			if err := db.Migrator().DropColumn(&adminGroupMemberV2026101603{}, "Require2FA"); err != nil {
+				return err
+			}
+			for _, column := range []string{"TOTPSecret", "TOTPEnabled", "TOTPLastCounter"} {
+				if err := db.Migrator().DropColumn(&userV2026101603{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     "2026.10.16.04",
+		Description: "Create security event table",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&securityEventV2026101604{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropTable(&securityEventV2026101604{})
+		},
+	},
+	{
+		Version:     "2026.10.16.05",
+		Description: "Add email verification timestamp to users",
+		Up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&userV2026101605{}); err != nil {
+				return err
+			}
+			// Existing accounts were all created by admins
+			return db.Exec(`UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL`).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropColumn(&userV2026101605{}, "EmailVerifiedAt")
+		},
+	},
+	{
+		Version:     "2026.10.16.06",
+		Description: "Create password reset token table",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&passwordResetTokenV2026101606{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropTable(&passwordResetTokenV2026101606{})
+		},
+	},
+	{
+		Version:     "2026.10.16.07",
+		Description: "Create user identity table for single sign-on",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&userIdentityV2026101607{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropTable(&userIdentityV2026101607{})
+		},
+	},
+	{
+		Version:     "2026.10.16.08",
+		Description: "Add global and group roles",
+		Up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&userV2026101608{}, &userGroupMemberV2026101608{}); err != nil {
+				return err
+			}
+			// Creators own their groups, and become members if they weren't
+			if err := db.Exec(`UPDATE user_group_members SET role = 'owner'
+				FROM user_groups
+				WHERE user_group_members.group_id = user_groups.id
+				AND user_group_members.user_id = user_groups.created_by_id`).Error; err != nil {
+				return err
+			}
+			return db.Exec(`INSERT INTO user_group_members (user_id, group_id, role, created_at, updated_at)
+				SELECT created_by_id, id, 'owner', created_at, created_at FROM user_groups
+				WHERE deleted_at IS NULL AND NOT EXISTS (
+					SELECT 1 FROM user_group_members
+					WHERE user_group_members.group_id = user_groups.id
+					AND user_group_members.user_id = user_groups.created_by_id
+				)`).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Migrator().DropColumn(&userGroupMemberV2026101608{}, "Role"); err != nil {
+				return err
+			}
+			return db.Migrator().DropColumn(&userV2026101608{}, "Role")
+		},
+	},
+	{
+		Version:     "2026.10.16.09",
+		Description: "Hand groups of deleted users to a remaining member",
+		Up: func(db *gorm.DB) error {
+			// Groups whose owner was deleted go to their longest-standing
+			// admin, or else their longest-standing member
+			if err := db.Exec(`UPDATE user_groups SET created_by_id = successor.user_id
+				FROM (
+					SELECT DISTINCT ON (m.group_id) m.group_id, m.user_id
+					FROM user_group_members m
+					JOIN users u ON u.id = m.user_id AND u.deleted_at IS NULL
+					JOIN user_groups g ON g.id = m.group_id
+					JOIN users owner ON owner.id = g.created_by_id
+					WHERE owner.deleted_at IS NOT NULL
+					ORDER BY m.group_id, CASE m.role WHEN 'admin' THEN 0 ELSE 1 END, m.created_at, m.id
+				) successor
+				WHERE user_groups.id = successor.group_id`).Error; err != nil {
+				return err
+			}
+			if err := db.Exec(`DELETE FROM user_group_members
+				WHERE user_id IN (SELECT id FROM users WHERE deleted_at IS NOT NULL)`).Error; err != nil {
+				return err
+			}
+			if err := db.Exec(`UPDATE user_group_members SET role = 'owner'
+				FROM user_groups
+				WHERE user_group_members.group_id = user_groups.id
+				AND user_group_members.user_id = user_groups.created_by_id`).Error; err != nil {
+				return err
+			}
+
+			// Deleting a user must no longer take their groups with them
+			if err := db.Exec(`ALTER TABLE user_groups DROP CONSTRAINT IF EXISTS fk_users_created_groups`).Error; err != nil {
+				return err
+			}
+			return db.Exec(`ALTER TABLE user_groups ADD CONSTRAINT fk_users_created_groups
+				FOREIGN KEY (created_by_id) REFERENCES users(id) ON DELETE RESTRICT`).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Exec(`ALTER TABLE user_groups DROP CONSTRAINT IF EXISTS fk_users_created_groups`).Error; err != nil {
+				return err
+			}
+			return db.Exec(`ALTER TABLE user_groups ADD CONSTRAINT fk_users_created_groups
+				FOREIGN KEY (created_by_id) REFERENCES users(id) ON DELETE CASCADE`).Error
+		},
+	},
+	{
+		Version:     "2026.10.16.10",
+		Description: "Create group invite link table",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&groupInviteLinkV2026101610{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Migrator().DropTable(&groupInviteLinkV2026101610{})
+		},
+	},
+	{
+		Version:     "2026.10.16.11",
+		Description: "Track group invite status, expiry and history",
+		Up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&userGroupInviteV2026101611{}); err != nil {
+				return err
+			}
+			if db.Migrator().HasColumn(&userGroupInviteV20250113{}, "accepted") {
+				if err := db.Exec(`UPDATE user_group_invites SET status = 'accepted', accepted_at = updated_at
+					WHERE accepted`).Error; err != nil {
+					return err
+				}
+			}
+			// Invites that were already waiting get the full time to be answered
+			if err := db.Exec(`UPDATE user_group_invites SET expires_at = NOW() + INTERVAL '14 days'
+				WHERE status = 'pending'`).Error; err != nil {
+				return err
+			}
+			// Only the newest of duplicate pending invites stays pending
+			if err := db.Exec(`UPDATE user_group_invites SET status = 'expired', expired_at = NOW()
+				WHERE status = 'pending' AND id NOT IN (
+					SELECT MAX(id) FROM user_group_invites WHERE status = 'pending' GROUP BY group_id, invitee_id
+				)`).Error; err != nil {
+				return err
+			}
+			if err := db.Exec(`ALTER TABLE user_group_invites DROP COLUMN IF EXISTS accepted`).Error; err != nil {
+				return err
+			}
+			return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_user_group_invites_pending
+				ON user_group_invites (group_id, invitee_id) WHERE status = 'pending'`).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Exec(`DROP INDEX IF EXISTS idx_user_group_invites_pending`).Error; err != nil {
+				return err
+			}
+			if err := db.Exec(`ALTER TABLE user_group_invites ADD COLUMN IF NOT EXISTS accepted boolean NOT NULL DEFAULT false`).Error; err != nil {
+				return err
+			}
+			// Answered invites used to be deleted
+			if err := db.Exec(`DELETE FROM user_group_invites WHERE status IN ('declined', 'revoked', 'expired')`).Error; err != nil {
+				return err
+			}
+			if err := db.Exec(`UPDATE user_group_invites SET accepted = true WHERE status = 'accepted'`).Error; err != nil {
+				return err
+			}
+			for _, column := range []string{"Status", "ExpiresAt", "AcceptedAt", "DeclinedAt", "RevokedAt", "ExpiredAt"} {
+				if err := db.Migrator().DropColumn(&userGroupInviteV2026101611{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     "2026.10.16.12",
+		Description: "Add group visibility and join requests",
+		Up: func(db *gorm.DB) error {
+			if err := db.AutoMigrate(&userGroupV2026101612{}, &groupJoinRequestV2026101612{}); err != nil {
+				return err
+			}
+			return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_group_join_requests_pending
+				ON group_join_requests (group_id, user_id) WHERE status = 'pending'`).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Migrator().DropTable(&groupJoinRequestV2026101612{}); err != nil {
+				return err
+			}
+			return db.Migrator().DropColumn(&userGroupV2026101612{}, "Visibility")
+		},
+	},
+	{
+		Version:     "2026.10.16.13",
+		Description: "Make group memberships unique per user and group",
+		Up: func(db *gorm.DB) error {
+			// Of duplicate memberships keep the one with the highest role
+			if err := db.Exec(`DELETE FROM user_group_members WHERE id NOT IN (
+				SELECT DISTINCT ON (user_id, group_id) id FROM user_group_members
+				ORDER BY user_id, group_id,
+					CASE role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, id
+			)`).Error; err != nil {
+				return err
+			}
+			return db.AutoMigrate(&userGroupMemberV2026101613{})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Exec(`DROP INDEX IF EXISTS idx_user_group_members_user_group`).Error
+		},
+	},
+	{
+		Version:     "2026.10.16.14",
+		Description: "Make group names unique",
+		Up: func(db *gorm.DB) error {
+			// The oldest group keeps a duplicate name; the others get their ID appended
+			if err := db.Exec(`UPDATE user_groups SET name = LEFT(name, 240) || ' (' || id || ')'
+				WHERE deleted_at IS NULL AND EXISTS (
+					SELECT 1 FROM user_groups AS older
+					WHERE older.name = user_groups.name AND older.deleted_at IS NULL AND older.id < user_groups.id
+				)`).Error; err != nil {
+				return err
+			}
+			// Deleted groups give up their name
+			return db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_user_groups_name
+				ON user_groups (name) WHERE deleted_at IS NULL`).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Exec(`DROP INDEX IF EXISTS idx_user_groups_name`).Error
+		},
+	},
 }
@@ -0,0 +1,348 @@
+// migrations/runner.go
+package migrations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// advisoryLockID is the Postgres advisory lock key held while migrating so
+// that several pods starting at the same time don't race each other.
+const advisoryLockID int64 = 0x62696e67626f6e67 // "bingbong"
+
+// SchemaMigration is the bookkeeping row stored for every applied migration
+type SchemaMigration struct {
+	Version     string    `gorm:"type:varchar(32);primaryKey"`
+	Description string    `gorm:"type:varchar(255);not null"`
+	Checksum    string    `gorm:"type:varchar(64);not null"`
+	AppliedAt   time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DurationMs  int64     `gorm:"not null;default:0"`
+}
+
+// TableName pins the bookkeeping table name
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// MigrationStatus describes the state of a single known migration
+type MigrationStatus struct {
+	Version     string
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+	// ChecksumMismatch is set when the applied row no longer matches the
+	// migration definition in code
+	ChecksumMismatch bool
+}
+
+type Runner struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+// NewRunner creates a runner for the registered Migrations
+func NewRunner(db *gorm.DB) *Runner {
+	return NewRunnerWithMigrations(db, Migrations)
+}
+
+// NewRunnerWithMigrations creates a runner for an explicit migration list
+func NewRunnerWithMigrations(db *gorm.DB, migrations []Migration) *Runner {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	return &Runner{db: db, migrations: sorted}
+}
+
+// Checksum returns the fingerprint recorded for a migration. It covers the
+// migration's source, so editing an applied migration changes it.
+func (m Migration) Checksum() string {
+	return checksum(m.Version, m.Description, migrationSource(m.Version))
+}
+
+// checksum hashes a migration's version, description and source
+func checksum(version, description, source string) string {
+	sum := sha256.Sum256([]byte(version + "\x00" + description + "\x00" + source))
+	return hex.EncodeToString(sum[:])
+}
+
+// Run applies all pending migrations in version order
+func (r *Runner) Run() error {
+	return r.withLock(func(conn *gorm.DB) error {
+		applied, err := r.appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		if err := r.verifyChecksums(applied); err != nil {
+			return err
+		}
+
+		for _, m := range r.migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := r.apply(conn, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Status returns the state of every known migration in version order
+func (r *Runner) Status() ([]MigrationStatus, error) {
+	if err := r.ensureTable(r.db); err != nil {
+		return nil, err
+	}
+
+	applied, err := r.appliedMigrations(r.db)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(r.migrations))
+	for _, m := range r.migrations {
+		status := MigrationStatus{
+			Version:     m.Version,
+			Description: m.Description,
+		}
+		if row, ok := applied[m.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = row.AppliedAt
+			status.ChecksumMismatch = row.Checksum != m.Checksum()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// withLock pins a single connection, takes the advisory lock on it and runs fn
+func (r *Runner) withLock(fn func(conn *gorm.DB) error) error {
+	return r.db.Connection(func(conn *gorm.DB) error {
+		if err := conn.Exec("SELECT pg_advisory_lock(?)", advisoryLockID).Error; err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %v", err)
+		}
+		defer func() {
+			if err := conn.Exec("SELECT pg_advisory_unlock(?)", advisoryLockID).Error; err != nil {
+				log.Printf("Warning: failed to release migration lock: %v", err)
+			}
+		}()
+
+		if err := r.ensureTable(conn); err != nil {
+			return err
+		}
+
+		return fn(conn)
+	})
+}
+
+// ensureTable creates the schema_migrations table if needed
+func (r *Runner) ensureTable(db *gorm.DB) error {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// appliedMigrations loads the bookkeeping rows keyed by version
+func (r *Runner) appliedMigrations(db *gorm.DB) (map[string]SchemaMigration, error) {
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %v", err)
+	}
+
+	applied := make(map[string]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+// verifyChecksums refuses to continue if an applied migration was edited
+func (r *Runner) verifyChecksums(applied map[string]SchemaMigration) error {
+	for _, m := range r.migrations {
+		row, ok := applied[m.Version]
+		if ok && row.Checksum != m.Checksum() {
+			return fmt.Errorf("checksum mismatch for applied migration %s (%s)", m.Version, m.Description)
+		}
+	}
+	return nil
+}
+
+// apply runs a single Up migration and records it in one transaction
+func (r *Runner) apply(conn *gorm.DB, m Migration) error {
+	start := time.Now()
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+
+		return tx.Create(&SchemaMigration{
+			Version:     m.Version,
+			Description: m.Description,
+			Checksum:    m.Checksum(),
+			AppliedAt:   time.Now(),
+			DurationMs:  time.Since(start).Milliseconds(),
+		}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("migration %s (%s) failed: %v", m.Version, m.Description, err)
+	}
+
+	log.Printf("Applied migration %s: %s (%s)", m.Version, m.Description, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Down rolls back the last n applied migrations, newest first
+func (r *Runner) Down(n int) error {
+	if n < 1 {
+		return fmt.Errorf("number of migrations to roll back must be at least 1")
+	}
+
+	return r.withLock(func(conn *gorm.DB) error {
+		applied, err := r.appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		if err := r.verifyChecksums(applied); err != nil {
+			return err
+		}
+
+		targets := r.appliedInReverse(applied)
+		if len(targets) < n {
+			n = len(targets)
+		}
+
+		for _, m := range targets[:n] {
+			if err := r.rollback(conn, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// To migrates up or down until version is the newest applied migration.
+// The version "0" rolls back every migration.
+func (r *Runner) To(version string) error {
+	if version != "0" && r.find(version) == nil {
+		return fmt.Errorf("unknown migration version %s", version)
+	}
+
+	return r.withLock(func(conn *gorm.DB) error {
+		applied, err := r.appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		if err := r.verifyChecksums(applied); err != nil {
+			return err
+		}
+
+		// Roll back everything newer than the target
+		for _, m := range r.appliedInReverse(applied) {
+			if m.Version <= version {
+				break
+			}
+			if err := r.rollback(conn, m); err != nil {
+				return err
+			}
+		}
+
+		// Apply everything pending up to and including the target
+		for _, m := range r.migrations {
+			if m.Version > version {
+				break
+			}
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if err := r.apply(conn, m); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Redo rolls back the newest applied migration and applies it again
+func (r *Runner) Redo() error {
+	return r.withLock(func(conn *gorm.DB) error {
+		applied, err := r.appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+
+		if err := r.verifyChecksums(applied); err != nil {
+			return err
+		}
+
+		targets := r.appliedInReverse(applied)
+		if len(targets) == 0 {
+			return fmt.Errorf("no applied migrations to redo")
+		}
+
+		if err := r.rollback(conn, targets[0]); err != nil {
+			return err
+		}
+		return r.apply(conn, targets[0])
+	})
+}
+
+// find returns the registered migration with the given version
+func (r *Runner) find(version string) *Migration {
+	for i := range r.migrations {
+		if r.migrations[i].Version == version {
+			return &r.migrations[i]
+		}
+	}
+	return nil
+}
+
+// appliedInReverse returns the applied migrations, newest first
+func (r *Runner) appliedInReverse(applied map[string]SchemaMigration) []Migration {
+	var result []Migration
+	for i := len(r.migrations) - 1; i >= 0; i-- {
+		if _, ok := applied[r.migrations[i].Version]; ok {
+			result = append(result, r.migrations[i])
+		}
+	}
+	return result
+}
+
+// rollback runs a single Down migration and removes its row in one transaction
+func (r *Runner) rollback(conn *gorm.DB, m Migration) error {
+	if m.Down == nil {
+		return fmt.Errorf("migration %s (%s) has no Down function", m.Version, m.Description)
+	}
+
+	start := time.Now()
+
+	err := conn.Transaction(func(tx *gorm.DB) error {
+		if err := m.Down(tx); err != nil {
+			return err
+		}
+		return tx.Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("rollback of %s (%s) failed: %v", m.Version, m.Description, err)
+	}
+
+	log.Printf("Rolled back migration %s: %s (%s)", m.Version, m.Description, time.Since(start).Round(time.Millisecond))
+	return nil
+}
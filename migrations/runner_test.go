@@ -0,0 +1,178 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+)
+
+func versions(migrations []Migration) []string {
+	result := make([]string, len(migrations))
+	for i, m := range migrations {
+		result[i] = m.Version
+	}
+	return result
+}
+
+func TestNewRunnerSortsByVersion(t *testing.T) {
+	unsorted := []Migration{
+		{Version: "2026.10.16.02"},
+		{Version: "2025.01.13.01"},
+		{Version: "2026.10.16.10"},
+		{Version: "2026.10.16.01"},
+	}
+
+	r := NewRunnerWithMigrations(nil, unsorted)
+
+	want := "2025.01.13.01 2026.10.16.01 2026.10.16.02 2026.10.16.10"
+	if got := strings.Join(versions(r.migrations), " "); got != want {
+		t.Errorf("runner order = %s, want %s", got, want)
+	}
+	if unsorted[0].Version != "2026.10.16.02" {
+		t.Errorf("NewRunnerWithMigrations reordered the caller's slice")
+	}
+}
+
+func TestAppliedInReverse(t *testing.T) {
+	r := NewRunnerWithMigrations(nil, []Migration{
+		{Version: "2025.01.13.01"},
+		{Version: "2025.01.13.02"},
+		{Version: "2025.01.13.03"},
+		{Version: "2025.01.13.04"},
+	})
+	applied := map[string]SchemaMigration{
+		"2025.01.13.01": {},
+		"2025.01.13.03": {},
+		"2025.01.13.04": {},
+	}
+
+	want := "2025.01.13.04 2025.01.13.03 2025.01.13.01"
+	if got := strings.Join(versions(r.appliedInReverse(applied)), " "); got != want {
+		t.Errorf("appliedInReverse = %s, want %s", got, want)
+	}
+}
+
+func TestRegisteredMigrationsAreOrderedAndHaveSource(t *testing.T) {
+	for i, m := range Migrations {
+		if i > 0 && m.Version <= Migrations[i-1].Version {
+			t.Errorf("migration %s is listed after %s", m.Version, Migrations[i-1].Version)
+		}
+		if migrationSource(m.Version) == "" {
+			t.Errorf("no source found for migration %s; its checksum wouldn't cover its body", m.Version)
+		}
+	}
+}
+
+func TestVerifyChecksums(t *testing.T) {
+	m := Migration{Version: "2025.01.13.01", Description: "Create base user and group tables"}
+	r := NewRunnerWithMigrations(nil, []Migration{m, {Version: "2025.01.13.02"}})
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  bool
+	}{
+		{"current checksum", m.Checksum(), false},
+		{"edited migration", checksum(m.Version, m.Description, "edited"), true},
+		{"description only", checksum(m.Version, m.Description, ""), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied := map[string]SchemaMigration{m.Version: {Version: m.Version, Checksum: tt.checksum}}
+
+			if err := r.verifyChecksums(applied); (err != nil) != tt.wantErr {
+				t.Errorf("verifyChecksums error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+const testSource = `package migrations
+
+type userV1 struct {
+	ID   uint
+	Name string
+}
+
+func (userV1) TableName() string { return "users" }
+
+var Migrations = []Migration{
+	{
+		Version:     "1",
+		Description: "Create users",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&userV1{})
+		},
+	},
+	{
+		Version:     "2",
+		Description: "Add index",
+		Up: func(db *gorm.DB) error {
+			return db.Exec("CREATE INDEX idx ON users(name)").Error
+		},
+	},
+}
+`
+
+func TestChecksumCoversSource(t *testing.T) {
+	base, err := parseMigrationSources(map[string][]byte{"migrations.go": []byte(testSource)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		old, new    string
+		wantChanged map[string]bool
+	}{
+		{
+			name:        "edited body",
+			old:         `users(name)`,
+			new:         `users(lower(name))`,
+			wantChanged: map[string]bool{"1": false, "2": true},
+		},
+		{
+			name:        "edited frozen struct",
+			old:         "Name string",
+			new:         "Name string `gorm:\"unique\"`",
+			wantChanged: map[string]bool{"1": true, "2": false},
+		},
+		{
+			name:        "edited table name",
+			old:         `return "users"`,
+			new:         `return "accounts"`,
+			wantChanged: map[string]bool{"1": true, "2": false},
+		},
+		{
+			name:        "comment and formatting only",
+			old:         "\t\tUp: func(db *gorm.DB) error {\n\t\t\treturn db.Exec",
+			new:         "\t\t// Speeds up lookups by name\n\t\tUp:   func(db *gorm.DB) error {\n\t\t\treturn  db.Exec",
+			wantChanged: map[string]bool{"1": false, "2": false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(testSource, tt.old) {
+				t.Fatalf("test source doesn't contain %q", tt.old)
+			}
+			edited, err := parseMigrationSources(map[string][]byte{
+				"migrations.go": []byte(strings.Replace(testSource, tt.old, tt.new, 1)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for version, want := range tt.wantChanged {
+				if base[version] == "" {
+					t.Fatalf("no source found for migration %s", version)
+				}
+				before := checksum(version, "", base[version])
+				after := checksum(version, "", edited[version])
+				if changed := before != after; changed != want {
+					t.Errorf("migration %s checksum changed = %v, want %v", version, changed, want)
+				}
+			}
+		})
+	}
+}
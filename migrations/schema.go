@@ -0,0 +1,407 @@
+// migrations/schema.go
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// The structs below are frozen copies of the models as each migration
+// created or changed them. Migrations use these instead of the models
+// package so that every version creates the same schema however the models
+// change later. Never edit a struct once its migration has been released;
+// add a new one for the next migration instead.
+//
+// Foreign keys are named after the field of the side that declares them,
+// e.g. fk_users_api_keys for a has-many field APIKeys on users, so the
+// structs keep the relationship fields the models had at the time.
+
+// userRef is a user referenced by a foreign key that users don't declare
+type userRef struct {
+	ID uint `gorm:"primaryKey"`
+}
+
+func (userRef) TableName() string { return "users" }
+
+// 2025.01.13.01 - 2025.01.13.03: the base tables
+
+type userV20250113 struct {
+	ID        uint           `gorm:"primaryKey"`
+	Username  string         `gorm:"type:varchar(255);unique;not null"`
+	Email     string         `gorm:"type:varchar(255);unique;not null"`
+	Password  string         `gorm:"type:text;not null"`
+	PublicKey string         `gorm:"type:text"`
+	Active    bool           `gorm:"default:true"`
+	CreatedAt time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	LastLogin time.Time      `gorm:""`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	AdminAccess          []adminGroupMemberV20250113 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	GroupMemberships     []userGroupMemberV20250113  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	GroupInvitesSent     []userGroupInviteV20250113  `gorm:"foreignKey:InviteInitiatorID;constraint:OnDelete:CASCADE;"`
+	GroupInvitesReceived []userGroupInviteV20250113  `gorm:"foreignKey:InviteeID;constraint:OnDelete:CASCADE;"`
+	CreatedGroups        []userGroupV20250113        `gorm:"foreignKey:CreatedByID;constraint:OnDelete:CASCADE;"`
+	SentMessages         []groupMessageV20250113     `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;"`
+	Notifications        []notificationV20250113     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userV20250113) TableName() string { return "users" }
+
+type userGroupV20250113 struct {
+	ID          uint           `gorm:"primaryKey"`
+	Name        string         `gorm:"type:varchar(255);not null"`
+	Description string         `gorm:"type:varchar(1024)"`
+	CreatedByID uint           `gorm:"not null"`
+	CreatedAt   time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+
+	Creator  userV20250113              `gorm:"foreignKey:CreatedByID"`
+	Members  []userGroupMemberV20250113 `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	Invites  []userGroupInviteV20250113 `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	Messages []groupMessageV20250113    `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userGroupV20250113) TableName() string { return "user_groups" }
+
+type userGroupInviteV20250113 struct {
+	ID                uint      `gorm:"primaryKey"`
+	GroupID           uint      `gorm:"not null"`
+	InviteInitiatorID uint      `gorm:"not null"`
+	InviteeID         uint      `gorm:"not null"`
+	Accepted          bool      `gorm:"default:false;not null"`
+	CreatedAt         time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt         time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	Group     userGroupV20250113 `gorm:"foreignKey:GroupID"`
+	Initiator userV20250113      `gorm:"foreignKey:InviteInitiatorID"`
+	Invitee   userV20250113      `gorm:"foreignKey:InviteeID"`
+}
+
+func (userGroupInviteV20250113) TableName() string { return "user_group_invites" }
+
+type userGroupMemberV20250113 struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null"`
+	GroupID   uint      `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User  userV20250113      `gorm:"foreignKey:UserID"`
+	Group userGroupV20250113 `gorm:"foreignKey:GroupID"`
+}
+
+func (userGroupMemberV20250113) TableName() string { return "user_group_members" }
+
+type adminGroupMemberV20250113 struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"unique;not null"`
+	Active    bool      `gorm:"default:true;not null"`
+	CreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User userV20250113 `gorm:"foreignKey:UserID"`
+}
+
+func (adminGroupMemberV20250113) TableName() string { return "admin_group_members" }
+
+type groupMessageV20250113 struct {
+	ID        uint           `gorm:"primaryKey"`
+	GroupID   uint           `gorm:"not null"`
+	SenderID  uint           `gorm:"not null"`
+	Content   string         `gorm:"type:text;not null"`
+	CreatedAt time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	Group  userGroupV20250113 `gorm:"foreignKey:GroupID"`
+	Sender userV20250113      `gorm:"foreignKey:SenderID"`
+}
+
+func (groupMessageV20250113) TableName() string { return "group_messages" }
+
+type notificationV20250113 struct {
+	ID        uint           `gorm:"primaryKey"`
+	UserID    uint           `gorm:"not null"`
+	Type      string         `gorm:"type:varchar(50);not null"`
+	Content   string         `gorm:"type:jsonb;not null"`
+	Read      bool           `gorm:"default:false;not null"`
+	CreatedAt time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+
+	User userV20250113 `gorm:"foreignKey:UserID"`
+}
+
+func (notificationV20250113) TableName() string { return "notifications" }
+
+// 2026.10.16.01: API keys
+
+type userV2026101601 struct {
+	ID      uint                `gorm:"primaryKey"`
+	APIKeys []apiKeyV2026101601 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userV2026101601) TableName() string { return "users" }
+
+type apiKeyV2026101601 struct {
+	ID         uint       `gorm:"primaryKey"`
+	UserID     uint       `gorm:"not null;index"`
+	Name       string     `gorm:"type:varchar(255);not null"`
+	Prefix     string     `gorm:"type:varchar(32);uniqueIndex;not null"`
+	SecretHash string     `gorm:"type:varchar(64);not null"`
+	Scopes     string     `gorm:"type:varchar(255);not null"`
+	LastUsedAt *time.Time `gorm:""`
+	ExpiresAt  *time.Time `gorm:""`
+	RevokedAt  *time.Time `gorm:""`
+	CreatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User userV2026101601 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (apiKeyV2026101601) TableName() string { return "api_keys" }
+
+// 2026.10.16.02: sessions, refresh tokens and the token denylist
+
+type authSessionV2026101602 struct {
+	ID         string     `gorm:"type:varchar(36);primaryKey"`
+	UserID     uint       `gorm:"not null;index"`
+	UserAgent  string     `gorm:"type:varchar(512)"`
+	IPAddress  string     `gorm:"type:varchar(64)"`
+	LastUsedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	ExpiresAt  time.Time  `gorm:"not null"`
+	RevokedAt  *time.Time `gorm:""`
+	CreatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User userRef `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (authSessionV2026101602) TableName() string { return "auth_sessions" }
+
+type refreshTokenV2026101602 struct {
+	ID        uint       `gorm:"primaryKey"`
+	SessionID string     `gorm:"type:varchar(36);not null;index"`
+	TokenHash string     `gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time `gorm:""`
+	CreatedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	Session authSessionV2026101602 `gorm:"foreignKey:SessionID;constraint:OnDelete:CASCADE;"`
+}
+
+func (refreshTokenV2026101602) TableName() string { return "refresh_tokens" }
+
+type revokedTokenV2026101602 struct {
+	JTI       string    `gorm:"type:varchar(36);primaryKey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+func (revokedTokenV2026101602) TableName() string { return "revoked_tokens" }
+
+// 2026.10.16.03: two-factor authentication
+
+type userV2026101603 struct {
+	ID              uint   `gorm:"primaryKey"`
+	TOTPSecret      string `gorm:"column:totp_secret;type:varchar(64)"`
+	TOTPEnabled     bool   `gorm:"column:totp_enabled;default:false;not null"`
+	TOTPLastCounter int64  `gorm:"column:totp_last_counter;default:0;not null"`
+
+	RecoveryCodes []recoveryCodeV2026101603 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userV2026101603) TableName() string { return "users" }
+
+type adminGroupMemberV2026101603 struct {
+	ID         uint `gorm:"primaryKey"`
+	Require2FA bool `gorm:"column:require_2fa;default:false;not null"`
+}
+
+func (adminGroupMemberV2026101603) TableName() string { return "admin_group_members" }
+
+type recoveryCodeV2026101603 struct {
+	ID        uint       `gorm:"primaryKey"`
+	UserID    uint       `gorm:"not null;index"`
+	CodeHash  string     `gorm:"type:varchar(64);not null"`
+	UsedAt    *time.Time `gorm:""`
+	CreatedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User userV2026101603 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (recoveryCodeV2026101603) TableName() string { return "recovery_codes" }
+
+// 2026.10.16.04: security events
+
+type securityEventV2026101604 struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    *uint     `gorm:"index"`
+	Username  string    `gorm:"type:varchar(255);not null"`
+	IPAddress string    `gorm:"type:varchar(64)"`
+	Type      string    `gorm:"type:varchar(50);not null;index"`
+	Detail    string    `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP;index"`
+}
+
+func (securityEventV2026101604) TableName() string { return "security_events" }
+
+// 2026.10.16.05: email verification
+
+type userV2026101605 struct {
+	ID              uint       `gorm:"primaryKey"`
+	EmailVerifiedAt *time.Time `gorm:""`
+}
+
+func (userV2026101605) TableName() string { return "users" }
+
+// 2026.10.16.06: password reset tokens
+
+type userV2026101606 struct {
+	ID                  uint                            `gorm:"primaryKey"`
+	PasswordResetTokens []passwordResetTokenV2026101606 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userV2026101606) TableName() string { return "users" }
+
+type passwordResetTokenV2026101606 struct {
+	ID        uint       `gorm:"primaryKey"`
+	UserID    uint       `gorm:"not null;index"`
+	TokenHash string     `gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time `gorm:""`
+	CreatedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User userV2026101606 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (passwordResetTokenV2026101606) TableName() string { return "password_reset_tokens" }
+
+// 2026.10.16.07: single sign-on identities
+
+type userV2026101607 struct {
+	ID         uint                      `gorm:"primaryKey"`
+	Identities []userIdentityV2026101607 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userV2026101607) TableName() string { return "users" }
+
+type userIdentityV2026101607 struct {
+	ID          uint      `gorm:"primaryKey"`
+	UserID      uint      `gorm:"not null;index"`
+	Issuer      string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Subject     string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Email       string    `gorm:"type:varchar(255)"`
+	LastLoginAt time.Time `gorm:""`
+	CreatedAt   time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	User userV2026101607 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userIdentityV2026101607) TableName() string { return "user_identities" }
+
+// 2026.10.16.08: global and group roles
+
+type userV2026101608 struct {
+	ID   uint   `gorm:"primaryKey"`
+	Role string `gorm:"type:varchar(20);default:'user';not null"`
+}
+
+func (userV2026101608) TableName() string { return "users" }
+
+type userGroupMemberV2026101608 struct {
+	ID   uint   `gorm:"primaryKey"`
+	Role string `gorm:"type:varchar(20);default:'member';not null"`
+}
+
+func (userGroupMemberV2026101608) TableName() string { return "user_group_members" }
+
+// 2026.10.16.10: group invite links
+
+type userGroupV2026101610 struct {
+	ID          uint                         `gorm:"primaryKey"`
+	InviteLinks []groupInviteLinkV2026101610 `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userGroupV2026101610) TableName() string { return "user_groups" }
+
+type groupInviteLinkV2026101610 struct {
+	ID          uint       `gorm:"primaryKey"`
+	GroupID     uint       `gorm:"not null;index"`
+	CreatedByID uint       `gorm:"not null"`
+	Prefix      string     `gorm:"type:varchar(16);not null"`
+	TokenHash   string     `gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt   *time.Time `gorm:""`
+	MaxUses     int        `gorm:"default:0;not null"`
+	Uses        int        `gorm:"default:0;not null"`
+	EmailDomain string     `gorm:"type:varchar(255)"`
+	RevokedAt   *time.Time `gorm:""`
+	CreatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	Group   userGroupV2026101610 `gorm:"foreignKey:GroupID"`
+	Creator userRef              `gorm:"foreignKey:CreatedByID"`
+}
+
+func (groupInviteLinkV2026101610) TableName() string { return "group_invite_links" }
+
+// 2026.10.16.11: invite status and history
+
+type userGroupInviteV2026101611 struct {
+	ID         uint       `gorm:"primaryKey"`
+	Status     string     `gorm:"type:varchar(20);default:'pending';not null;index"`
+	ExpiresAt  *time.Time `gorm:"index"`
+	AcceptedAt *time.Time `gorm:""`
+	DeclinedAt *time.Time `gorm:""`
+	RevokedAt  *time.Time `gorm:""`
+	ExpiredAt  *time.Time `gorm:""`
+}
+
+func (userGroupInviteV2026101611) TableName() string { return "user_group_invites" }
+
+// 2026.10.16.12: group visibility and join requests
+
+type userV2026101612 struct {
+	ID                uint                          `gorm:"primaryKey"`
+	GroupJoinRequests []groupJoinRequestV2026101612 `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userV2026101612) TableName() string { return "users" }
+
+type userGroupV2026101612 struct {
+	ID           uint                          `gorm:"primaryKey"`
+	Visibility   string                        `gorm:"type:varchar(20);default:'private';not null;index"`
+	JoinRequests []groupJoinRequestV2026101612 `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+}
+
+func (userGroupV2026101612) TableName() string { return "user_groups" }
+
+type groupJoinRequestV2026101612 struct {
+	ID          uint       `gorm:"primaryKey"`
+	GroupID     uint       `gorm:"not null;index"`
+	UserID      uint       `gorm:"not null;index"`
+	Status      string     `gorm:"type:varchar(20);default:'pending';not null;index"`
+	Message     string     `gorm:"type:varchar(500)"`
+	DecidedByID *uint      `gorm:""`
+	DecidedAt   *time.Time `gorm:""`
+	CreatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	Group     userGroupV2026101612 `gorm:"foreignKey:GroupID"`
+	User      userV2026101612      `gorm:"foreignKey:UserID"`
+	DecidedBy *userRef             `gorm:"foreignKey:DecidedByID;constraint:OnDelete:SET NULL;"`
+}
+
+func (groupJoinRequestV2026101612) TableName() string { return "group_join_requests" }
+
+// 2026.10.16.13: unique group memberships
+
+type userGroupMemberV2026101613 struct {
+	ID      uint `gorm:"primaryKey"`
+	UserID  uint `gorm:"not null;uniqueIndex:idx_user_group_members_user_group"`
+	GroupID uint `gorm:"not null;uniqueIndex:idx_user_group_members_user_group"`
+}
+
+func (userGroupMemberV2026101613) TableName() string { return "user_group_members" }
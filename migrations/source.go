@@ -0,0 +1,197 @@
+// migrations/source.go
+package migrations
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sourceFiles are the files that define the migrations and the frozen
+// structs they migrate. Checksums cover the source of each migration so
+// that editing an applied migration is caught.
+//
+//go:embed migrations.go schema.go
+var sourceFiles embed.FS
+
+var (
+	sourcesOnce sync.Once
+	sources     map[string]string
+)
+
+// migrationSource returns the normalized source of the registered migration
+// with the given version, or "" if it isn't defined in sourceFiles
+func migrationSource(version string) string {
+	sourcesOnce.Do(func() {
+		files := make(map[string][]byte)
+		for _, name := range []string{"migrations.go", "schema.go"} {
+			src, err := sourceFiles.ReadFile(name)
+			if err != nil {
+				log.Printf("Warning: failed to read migration source %s: %v", name, err)
+				continue
+			}
+			files[name] = src
+		}
+
+		var err error
+		if sources, err = parseMigrationSources(files); err != nil {
+			log.Printf("Warning: failed to parse migration source: %v", err)
+		}
+	})
+	return sources[version]
+}
+
+// parseMigrationSources finds the elements of the Migrations list and
+// returns the source of each, keyed by version. A migration's source is its
+// literal followed by every top-level type or function it refers to, directly
+// or through another, together with their methods. Source is printed without
+// comments and with whitespace collapsed, so that reformatting and comments
+// don't change checksums.
+func parseMigrationSources(files map[string][]byte) (map[string]string, error) {
+	fset := token.NewFileSet()
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	decls := make(map[string][]ast.Node)
+	var list *ast.CompositeLit
+	for _, name := range names {
+		file, err := parser.ParseFile(fset, name, files[name], 0)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, decl := range file.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				key := decl.Name.Name
+				if decl.Recv != nil && len(decl.Recv.List) == 1 {
+					key = receiverName(decl.Recv.List[0].Type)
+				}
+				decls[key] = append(decls[key], decl)
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						decls[spec.Name.Name] = append(decls[spec.Name.Name], spec)
+					case *ast.ValueSpec:
+						for i, ident := range spec.Names {
+							if ident.Name != "Migrations" || i >= len(spec.Values) {
+								continue
+							}
+							if lit, ok := spec.Values[i].(*ast.CompositeLit); ok {
+								list = lit
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	if list == nil {
+		return nil, fmt.Errorf("Migrations list not found")
+	}
+
+	result := make(map[string]string, len(list.Elts))
+	for _, elt := range list.Elts {
+		lit, ok := elt.(*ast.CompositeLit)
+		if !ok {
+			continue
+		}
+		version := literalVersion(lit)
+		if version == "" {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := printer.Fprint(&buf, fset, lit); err != nil {
+			return nil, err
+		}
+
+		// Add what the migration refers to, in a fixed order
+		seen := map[string]bool{}
+		pending := referencedNames(lit)
+		for len(pending) > 0 {
+			name := pending[0]
+			pending = pending[1:]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			for _, node := range decls[name] {
+				buf.WriteString("\n")
+				if err := printer.Fprint(&buf, fset, node); err != nil {
+					return nil, err
+				}
+				pending = append(pending, referencedNames(node)...)
+			}
+		}
+
+		result[version] = strings.Join(strings.Fields(buf.String()), " ")
+	}
+
+	return result, nil
+}
+
+// literalVersion returns the Version of a Migration literal
+func literalVersion(lit *ast.CompositeLit) string {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := kv.Key.(*ast.Ident)
+		if !ok || key.Name != "Version" {
+			continue
+		}
+		if value, ok := kv.Value.(*ast.BasicLit); ok && value.Kind == token.STRING {
+			version, err := strconv.Unquote(value.Value)
+			if err == nil {
+				return version
+			}
+		}
+	}
+	return ""
+}
+
+// referencedNames returns the identifiers used in a node, sorted
+func referencedNames(node ast.Node) []string {
+	found := map[string]bool{}
+	ast.Inspect(node, func(n ast.Node) bool {
+		if ident, ok := n.(*ast.Ident); ok {
+			found[ident.Name] = true
+		}
+		return true
+	})
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// receiverName returns the type name of a method receiver
+func receiverName(expr ast.Expr) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	if ident, ok := expr.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
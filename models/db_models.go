@@ -2,6 +2,7 @@ package models
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
@@ -19,40 +20,71 @@ type User struct {
 	LastLogin time.Time      `gorm:""`
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 
-	// Relationships with cascade delete
-	AdminAccess          []AdminGroupMember `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
-	GroupMemberships     []UserGroupMember  `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
-	GroupInvitesSent     []UserGroupInvite  `gorm:"foreignKey:InviteInitiatorID;constraint:OnDelete:CASCADE;"`
-	GroupInvitesReceived []UserGroupInvite  `gorm:"foreignKey:InviteeID;constraint:OnDelete:CASCADE;"`
-	CreatedGroups        []UserGroup        `gorm:"foreignKey:CreatedByID;constraint:OnDelete:CASCADE;"`
-	SentMessages         []GroupMessage     `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;"`
-	Notifications        []Notification     `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	// Role is RoleUser or RoleModerator; admin access is granted separately
+	// through AdminGroupMember
+	Role string `gorm:"type:varchar(20);default:'user';not null"`
+
+	// EmailVerifiedAt is nil until a self-registered user confirms their
+	// address; accounts created by admins count as verified
+	EmailVerifiedAt *time.Time `gorm:""`
+
+	// Two-factor authentication. TOTPSecret is set during enrollment and only
+	// used for login once TOTPEnabled; TOTPLastCounter stops code reuse.
+	TOTPSecret      string `gorm:"column:totp_secret;type:varchar(64)"`
+	TOTPEnabled     bool   `gorm:"column:totp_enabled;default:false;not null"`
+	TOTPLastCounter int64  `gorm:"column:totp_last_counter;default:0;not null"`
+
+	// Relationships with cascade delete, except owned groups, which are
+	// handed to another member before a user is deleted
+	AdminAccess          []AdminGroupMember   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	GroupMemberships     []UserGroupMember    `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	GroupInvitesSent     []UserGroupInvite    `gorm:"foreignKey:InviteInitiatorID;constraint:OnDelete:CASCADE;"`
+	GroupInvitesReceived []UserGroupInvite    `gorm:"foreignKey:InviteeID;constraint:OnDelete:CASCADE;"`
+	GroupJoinRequests    []GroupJoinRequest   `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	CreatedGroups        []UserGroup          `gorm:"foreignKey:CreatedByID;constraint:OnDelete:RESTRICT;"`
+	SentMessages         []GroupMessage       `gorm:"foreignKey:SenderID;constraint:OnDelete:CASCADE;"`
+	Notifications        []Notification       `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	APIKeys              []APIKey             `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	RecoveryCodes        []RecoveryCode       `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	PasswordResetTokens  []PasswordResetToken `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+	Identities           []UserIdentity       `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
 }
 
 type UserGroup struct {
 	ID          uint           `gorm:"primaryKey"`
-	Name        string         `gorm:"type:varchar(255);not null"`
+	Name        string         `gorm:"type:varchar(255);not null"` // unique among groups that aren't deleted
 	Description string         `gorm:"type:varchar(1024)"`
-	CreatedByID uint           `gorm:"not null"`
+	CreatedByID uint           `gorm:"not null"` // the current owner; follows ownership transfers
+	Visibility  string         `gorm:"type:varchar(20);default:'private';not null;index"`
 	CreatedAt   time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
 	UpdatedAt   time.Time      `gorm:"not null;default:CURRENT_TIMESTAMP"`
 	DeletedAt   gorm.DeletedAt `gorm:"index"`
 
 	// Relationships with cascade delete
-	Creator  User              `gorm:"foreignKey:CreatedByID"`
-	Members  []UserGroupMember `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
-	Invites  []UserGroupInvite `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
-	Messages []GroupMessage    `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	Creator      User               `gorm:"foreignKey:CreatedByID"`
+	Members      []UserGroupMember  `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	Invites      []UserGroupInvite  `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	InviteLinks  []GroupInviteLink  `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	JoinRequests []GroupJoinRequest `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
+	Messages     []GroupMessage     `gorm:"foreignKey:GroupID;constraint:OnDelete:CASCADE;"`
 }
 
+// UserGroupInvite invites a user to a group. Invites are kept after they are
+// answered so both parties can see their history; a group can only have one
+// pending invite per user.
 type UserGroupInvite struct {
-	ID                uint      `gorm:"primaryKey"`
-	GroupID           uint      `gorm:"not null"`
-	InviteInitiatorID uint      `gorm:"not null"`
-	InviteeID         uint      `gorm:"not null"`
-	Accepted          bool      `gorm:"default:false;not null"`
-	CreatedAt         time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
-	UpdatedAt         time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	ID                uint       `gorm:"primaryKey"`
+	GroupID           uint       `gorm:"not null"`
+	InviteInitiatorID uint       `gorm:"not null"`
+	InviteeID         uint       `gorm:"not null"`
+	Status            string     `gorm:"type:varchar(20);default:'pending';not null;index"`
+	ExpiresAt         *time.Time `gorm:"index"`
+	AcceptedAt        *time.Time `gorm:""`
+	DeclinedAt        *time.Time `gorm:""`
+	RevokedAt         *time.Time `gorm:""`
+	ExpiredAt         *time.Time `gorm:""`
+	CreatedAt         time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt         time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
 
 	// Relationships
 	Group     UserGroup `gorm:"foreignKey:GroupID"`
@@ -62,8 +94,9 @@ type UserGroupInvite struct {
 
 type UserGroupMember struct {
 	ID        uint      `gorm:"primaryKey"`
-	UserID    uint      `gorm:"not null"`
-	GroupID   uint      `gorm:"not null"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_user_group_members_user_group"`
+	GroupID   uint      `gorm:"not null;uniqueIndex:idx_user_group_members_user_group"`
+	Role      string    `gorm:"type:varchar(20);default:'member';not null"`
 	CreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
 	UpdatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
 
@@ -73,11 +106,12 @@ type UserGroupMember struct {
 }
 
 type AdminGroupMember struct {
-	ID        uint      `gorm:"primaryKey"`
-	UserID    uint      `gorm:"unique;not null"`
-	Active    bool      `gorm:"default:true;not null"`
-	CreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
-	UpdatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	ID         uint      `gorm:"primaryKey"`
+	UserID     uint      `gorm:"unique;not null"`
+	Active     bool      `gorm:"default:true;not null"`
+	Require2FA bool      `gorm:"column:require_2fa;default:false;not null"`
+	CreatedAt  time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
 
 	// Relationship
 	User User `gorm:"foreignKey:UserID"`
@@ -111,6 +145,212 @@ type Notification struct {
 	User User `gorm:"foreignKey:UserID"`
 }
 
+// APIKey is a personal access key for non-browser clients such as the sidecar.
+// Only a hash of the secret is stored; Prefix identifies the key for lookup and display.
+type APIKey struct {
+	ID         uint       `gorm:"primaryKey"`
+	UserID     uint       `gorm:"not null;index"`
+	Name       string     `gorm:"type:varchar(255);not null"`
+	Prefix     string     `gorm:"type:varchar(32);uniqueIndex;not null"`
+	SecretHash string     `gorm:"type:varchar(64);not null"`
+	Scopes     string     `gorm:"type:varchar(255);not null"`
+	LastUsedAt *time.Time `gorm:""`
+	ExpiresAt  *time.Time `gorm:""`
+	RevokedAt  *time.Time `gorm:""`
+	CreatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationship
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+// AuthSession is a login session. Refresh tokens rotate within a session and
+// access tokens carry its ID, so revoking the session logs the device out.
+type AuthSession struct {
+	ID         string     `gorm:"type:varchar(36);primaryKey"`
+	UserID     uint       `gorm:"not null;index"`
+	UserAgent  string     `gorm:"type:varchar(512)"`
+	IPAddress  string     `gorm:"type:varchar(64)"`
+	LastUsedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	ExpiresAt  time.Time  `gorm:"not null"`
+	RevokedAt  *time.Time `gorm:""`
+	CreatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt  time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationship
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+// RefreshToken is a single-use token that is exchanged for a new access and
+// refresh token pair. Only a hash of the token is stored.
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey"`
+	SessionID string     `gorm:"type:varchar(36);not null;index"`
+	TokenHash string     `gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time `gorm:""`
+	CreatedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationship
+	Session AuthSession `gorm:"foreignKey:SessionID;constraint:OnDelete:CASCADE;"`
+}
+
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost. Only a hash of the code is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey"`
+	UserID    uint       `gorm:"not null;index"`
+	CodeHash  string     `gorm:"type:varchar(64);not null"`
+	UsedAt    *time.Time `gorm:""`
+	CreatedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationship
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+// PasswordResetToken is a single-use token from a forgotten password email.
+// Only a hash of the token is stored.
+type PasswordResetToken struct {
+	ID        uint       `gorm:"primaryKey"`
+	UserID    uint       `gorm:"not null;index"`
+	TokenHash string     `gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time `gorm:""`
+	CreatedAt time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationship
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+// UserIdentity links an account to a user at an OpenID Connect provider,
+// identified by the provider's issuer and its subject for the user
+type UserIdentity struct {
+	ID          uint      `gorm:"primaryKey"`
+	UserID      uint      `gorm:"not null;index"`
+	Issuer      string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Subject     string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Email       string    `gorm:"type:varchar(255)"`
+	LastLoginAt time.Time `gorm:""`
+	CreatedAt   time.Time `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationship
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE;"`
+}
+
+// GroupInviteLink is a shareable link that lets anyone holding it join a
+// group. Only a hash of the token is stored; Prefix identifies the link for
+// display. MaxUses of 0 means unlimited, and EmailDomain, when set, limits
+// the link to users with a verified address at that domain.
+type GroupInviteLink struct {
+	ID          uint       `gorm:"primaryKey"`
+	GroupID     uint       `gorm:"not null;index"`
+	CreatedByID uint       `gorm:"not null"`
+	Prefix      string     `gorm:"type:varchar(16);not null"`
+	TokenHash   string     `gorm:"type:varchar(64);uniqueIndex;not null"`
+	ExpiresAt   *time.Time `gorm:""`
+	MaxUses     int        `gorm:"default:0;not null"`
+	Uses        int        `gorm:"default:0;not null"`
+	EmailDomain string     `gorm:"type:varchar(255)"`
+	RevokedAt   *time.Time `gorm:""`
+	CreatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationships
+	Group   UserGroup `gorm:"foreignKey:GroupID"`
+	Creator User      `gorm:"foreignKey:CreatedByID"`
+}
+
+// GroupJoinRequest asks to join a listed group. A group's owner or admins
+// approve or reject it; like invites, a user can only have one pending
+// request per group and answered requests are kept.
+type GroupJoinRequest struct {
+	ID          uint       `gorm:"primaryKey"`
+	GroupID     uint       `gorm:"not null;index"`
+	UserID      uint       `gorm:"not null;index"`
+	Status      string     `gorm:"type:varchar(20);default:'pending';not null;index"`
+	Message     string     `gorm:"type:varchar(500)"`
+	DecidedByID *uint      `gorm:""`
+	DecidedAt   *time.Time `gorm:""`
+	CreatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+	UpdatedAt   time.Time  `gorm:"not null;default:CURRENT_TIMESTAMP"`
+
+	// Relationships
+	Group     UserGroup `gorm:"foreignKey:GroupID"`
+	User      User      `gorm:"foreignKey:UserID"`
+	DecidedBy *User     `gorm:"foreignKey:DecidedByID;constraint:OnDelete:SET NULL;"`
+}
+
+// GroupListing is a group as shown in the group directory, with the
+// viewer's relation to it. It is assembled by queries, not stored.
+type GroupListing struct {
+	Group          UserGroup
+	MemberCount    int64
+	IsMember       bool
+	PendingRequest bool
+}
+
+// SecurityEvent is an audit record of a security relevant event such as an
+// account lockout. UserID is nil when the username didn't match an account.
+type SecurityEvent struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    *uint     `gorm:"index"`
+	Username  string    `gorm:"type:varchar(255);not null"`
+	IPAddress string    `gorm:"type:varchar(64)"`
+	Type      string    `gorm:"type:varchar(50);not null;index"`
+	Detail    string    `gorm:"type:text"`
+	CreatedAt time.Time `gorm:"not null;default:CURRENT_TIMESTAMP;index"`
+}
+
+// LoginLockout describes a username that is locked after too many failed
+// logins. Lockouts live in Redis, not in a table.
+type LoginLockout struct {
+	Username    string    `json:"username"`
+	LockedUntil time.Time `json:"locked_until"`
+	Lockouts    int64     `json:"lockouts"`
+}
+
+// RevokedToken denylists an access token by its jti until it would have expired
+type RevokedToken struct {
+	JTI       string    `gorm:"type:varchar(36);primaryKey"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+}
+
+// ScopeList returns the key's scopes
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// HasScope reports whether the key was granted a scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.ScopeList() {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Usable reports whether the key is neither revoked nor expired
+func (k *APIKey) Usable(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+func (k *APIKey) ToDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           k.ID,
+		"name":         k.Name,
+		"prefix":       k.Prefix,
+		"scopes":       k.ScopeList(),
+		"last_used_at": k.LastUsedAt,
+		"expires_at":   k.ExpiresAt,
+		"revoked_at":   k.RevokedAt,
+		"created_at":   k.CreatedAt,
+	}
+}
+
 // Methods remain unchanged
 func (m *GroupMessage) ToDict() map[string]interface{} {
 	return map[string]interface{}{
@@ -139,6 +379,18 @@ func (n *Notification) ToDict() map[string]interface{} {
 	}
 }
 
+func (e *SecurityEvent) ToDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":         e.ID,
+		"user_id":    e.UserID,
+		"username":   e.Username,
+		"ip_address": e.IPAddress,
+		"type":       e.Type,
+		"detail":     e.Detail,
+		"created_at": e.CreatedAt,
+	}
+}
+
 func (u *User) BeforeCreate(tx *gorm.DB) error {
 	u.CreatedAt = time.Now()
 	u.UpdatedAt = time.Now()
@@ -149,3 +401,36 @@ func (u *User) BeforeUpdate(tx *gorm.DB) error {
 	u.UpdatedAt = time.Now()
 	return nil
 }
+
+// Usable reports whether the link is neither revoked, expired nor used up
+func (l *GroupInviteLink) Usable(now time.Time) bool {
+	if l.RevokedAt != nil {
+		return false
+	}
+	if l.ExpiresAt != nil && !now.Before(*l.ExpiresAt) {
+		return false
+	}
+	return l.MaxUses == 0 || l.Uses < l.MaxUses
+}
+
+// AllowsEmail reports whether a user with this address may use the link
+func (l *GroupInviteLink) AllowsEmail(email string) bool {
+	if l.EmailDomain == "" {
+		return true
+	}
+	return strings.HasSuffix(strings.ToLower(email), "@"+strings.ToLower(l.EmailDomain))
+}
+
+func (l *GroupInviteLink) ToDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":           l.ID,
+		"group_id":     l.GroupID,
+		"prefix":       l.Prefix,
+		"expires_at":   l.ExpiresAt,
+		"max_uses":     l.MaxUses,
+		"uses":         l.Uses,
+		"email_domain": l.EmailDomain,
+		"revoked_at":   l.RevokedAt,
+		"created_at":   l.CreatedAt,
+	}
+}
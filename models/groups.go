@@ -0,0 +1,61 @@
+package models
+
+// Group visibility. Private groups are invitation-only and hidden from the
+// directory; listed groups appear in it and take join requests; open groups
+// appear in it and anyone can join.
+const (
+	GroupVisibilityPrivate = "private"
+	GroupVisibilityListed  = "listed"
+	GroupVisibilityOpen    = "open"
+)
+
+// Join request statuses. Requests start out pending and change status once.
+const (
+	JoinRequestStatusPending   = "pending"
+	JoinRequestStatusApproved  = "approved"
+	JoinRequestStatusRejected  = "rejected"
+	JoinRequestStatusCancelled = "cancelled"
+)
+
+// ValidGroupVisibility reports whether a group visibility exists
+func ValidGroupVisibility(visibility string) bool {
+	switch visibility {
+	case GroupVisibilityPrivate, GroupVisibilityListed, GroupVisibilityOpen:
+		return true
+	default:
+		return false
+	}
+}
+
+// Discoverable reports whether the group appears in the group directory
+func (g *UserGroup) Discoverable() bool {
+	return g.Visibility == GroupVisibilityListed || g.Visibility == GroupVisibilityOpen
+}
+
+// ToDict returns the join request's JSON form
+func (r *GroupJoinRequest) ToDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":            r.ID,
+		"group_id":      r.GroupID,
+		"user_id":       r.UserID,
+		"username":      r.User.Username,
+		"status":        r.Status,
+		"message":       r.Message,
+		"decided_by_id": r.DecidedByID,
+		"decided_at":    r.DecidedAt,
+		"created_at":    r.CreatedAt,
+	}
+}
+
+// ToDict returns the directory entry's JSON form
+func (l *GroupListing) ToDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":              l.Group.ID,
+		"name":            l.Group.Name,
+		"description":     l.Group.Description,
+		"visibility":      l.Group.Visibility,
+		"member_count":    l.MemberCount,
+		"is_member":       l.IsMember,
+		"pending_request": l.PendingRequest,
+	}
+}
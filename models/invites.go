@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// Invite statuses. Invites start out pending and change status once; the
+// other statuses are final.
+const (
+	InviteStatusPending  = "pending"
+	InviteStatusAccepted = "accepted"
+	InviteStatusDeclined = "declined"
+	InviteStatusRevoked  = "revoked"
+	InviteStatusExpired  = "expired"
+)
+
+// inviteStatusColumns names the timestamp column set when an invite reaches
+// each final status
+var inviteStatusColumns = map[string]string{
+	InviteStatusAccepted: "accepted_at",
+	InviteStatusDeclined: "declined_at",
+	InviteStatusRevoked:  "revoked_at",
+	InviteStatusExpired:  "expired_at",
+}
+
+// InviteStatusColumn returns the timestamp column for a final status, and
+// false for pending or unknown statuses
+func InviteStatusColumn(status string) (string, bool) {
+	column, ok := inviteStatusColumns[status]
+	return column, ok
+}
+
+// Pending reports whether the invite is still waiting for an answer
+func (i *UserGroupInvite) Pending() bool {
+	return i.Status == InviteStatusPending
+}
+
+// Expired reports whether a pending invite is past its expiry. The expiry
+// job marks such invites expired; until then they can't be answered either.
+func (i *UserGroupInvite) Expired(now time.Time) bool {
+	return i.Pending() && i.ExpiresAt != nil && !now.Before(*i.ExpiresAt)
+}
+
+// StatusChangedAt returns when the invite reached its current status
+func (i *UserGroupInvite) StatusChangedAt() time.Time {
+	var changed *time.Time
+	switch i.Status {
+	case InviteStatusAccepted:
+		changed = i.AcceptedAt
+	case InviteStatusDeclined:
+		changed = i.DeclinedAt
+	case InviteStatusRevoked:
+		changed = i.RevokedAt
+	case InviteStatusExpired:
+		changed = i.ExpiredAt
+	}
+	if changed == nil {
+		return i.CreatedAt
+	}
+	return *changed
+}
+
+// ToDict returns the invite's JSON form
+func (i *UserGroupInvite) ToDict() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                i.ID,
+		"group_id":          i.GroupID,
+		"group_name":        i.Group.Name,
+		"initiator_id":      i.InviteInitiatorID,
+		"initiator":         i.Initiator.Username,
+		"invitee_id":        i.InviteeID,
+		"invitee":           i.Invitee.Username,
+		"status":            i.Status,
+		"expires_at":        i.ExpiresAt,
+		"status_changed_at": i.StatusChangedAt(),
+		"created_at":        i.CreatedAt,
+	}
+}
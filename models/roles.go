@@ -0,0 +1,165 @@
+package models
+
+// Global roles. Admin is granted through AdminGroupMember, which also holds
+// the two-factor requirement; User.Role tells moderators from regular users.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleUser      = "user"
+)
+
+// Group roles held on UserGroupMember
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleAdmin  = "admin"
+	GroupRoleMember = "member"
+)
+
+// Permission is something a global role allows across the site
+type Permission string
+
+// Global permissions
+const (
+	PermManageUsers    Permission = "users:manage"
+	PermManageGroups   Permission = "groups:manage"
+	PermManageSecurity Permission = "security:manage"
+	PermViewAllGroups  Permission = "groups:view_all"
+	PermModerateGroups Permission = "groups:moderate"
+)
+
+// rolePermissions lists what each global role allows
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermManageUsers, PermManageGroups, PermManageSecurity,
+		PermViewAllGroups, PermModerateGroups,
+	},
+	RoleModerator: {PermViewAllGroups, PermModerateGroups},
+	RoleUser:      {},
+}
+
+// GroupPermission is something a group role allows within that group
+type GroupPermission string
+
+// Group permissions
+const (
+	GroupPermView          GroupPermission = "group:view"
+	GroupPermPost          GroupPermission = "group:post"
+	GroupPermInvite        GroupPermission = "group:invite"
+	GroupPermRemoveMembers GroupPermission = "group:remove_members"
+	GroupPermEdit          GroupPermission = "group:edit"
+	GroupPermManageRoles   GroupPermission = "group:manage_roles"
+	GroupPermTransfer      GroupPermission = "group:transfer"
+	GroupPermInviteLinks   GroupPermission = "group:invite_links"
+	GroupPermJoinRequests  GroupPermission = "group:join_requests"
+	GroupPermDelete        GroupPermission = "group:delete"
+)
+
+// groupRolePermissions lists what each group role allows. Owners delegate
+// moderation by making members group admins.
+var groupRolePermissions = map[string][]GroupPermission{
+	GroupRoleOwner: {
+		GroupPermView, GroupPermPost, GroupPermInvite, GroupPermRemoveMembers,
+		GroupPermEdit, GroupPermManageRoles, GroupPermTransfer, GroupPermInviteLinks,
+		GroupPermJoinRequests, GroupPermDelete,
+	},
+	GroupRoleAdmin: {
+		GroupPermView, GroupPermPost, GroupPermInvite, GroupPermRemoveMembers,
+		GroupPermEdit, GroupPermJoinRequests,
+	},
+	GroupRoleMember: {GroupPermView, GroupPermPost},
+}
+
+// moderatorGroupPermissions is what PermModerateGroups allows in any group
+var moderatorGroupPermissions = []GroupPermission{GroupPermView, GroupPermRemoveMembers, GroupPermEdit}
+
+// ValidRole reports whether a global role can be stored on a user
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleModerator
+}
+
+// ValidGroupRole reports whether a group role exists
+func ValidGroupRole(role string) bool {
+	_, ok := groupRolePermissions[role]
+	return ok
+}
+
+// GroupRolesWith lists the group roles that have a permission
+func GroupRolesWith(perm GroupPermission) []string {
+	var roles []string
+	for role, granted := range groupRolePermissions {
+		for _, p := range granted {
+			if p == perm {
+				roles = append(roles, role)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// RoleCan reports whether a global role has a permission
+func RoleCan(role string, perm Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupRoleRank orders group roles so higher roles can't be managed by lower ones
+func GroupRoleRank(role string) int {
+	switch role {
+	case GroupRoleOwner:
+		return 3
+	case GroupRoleAdmin:
+		return 2
+	case GroupRoleMember:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// GroupAccess is a user's standing in a group: their role in it, empty when
+// they aren't a member, and their global role
+type GroupAccess struct {
+	GroupRole string
+	Role      string
+}
+
+// IsMember reports whether the user belongs to the group
+func (a GroupAccess) IsMember() bool {
+	return a.GroupRole != ""
+}
+
+// Can reports whether the user may do something in the group, through their
+// group role or a global role that manages or moderates all groups
+func (a GroupAccess) Can(perm GroupPermission) bool {
+	for _, granted := range groupRolePermissions[a.GroupRole] {
+		if granted == perm {
+			return true
+		}
+	}
+	if RoleCan(a.Role, PermManageGroups) {
+		return true
+	}
+	if RoleCan(a.Role, PermModerateGroups) {
+		for _, granted := range moderatorGroupPermissions {
+			if granted == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanManageMember reports whether the user may act on a member holding
+// targetRole: site admins and moderators may, otherwise only group members
+// who outrank them
+func (a GroupAccess) CanManageMember(targetRole string) bool {
+	if RoleCan(a.Role, PermManageGroups) || RoleCan(a.Role, PermModerateGroups) {
+		return true
+	}
+	return GroupRoleRank(a.GroupRole) > GroupRoleRank(targetRole)
+}
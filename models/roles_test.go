@@ -0,0 +1,65 @@
+package models
+
+import "testing"
+
+func TestGroupAccessCan(t *testing.T) {
+	tests := []struct {
+		name   string
+		access GroupAccess
+		perm   GroupPermission
+		want   bool
+	}{
+		{"owner deletes", GroupAccess{GroupRole: GroupRoleOwner, Role: RoleUser}, GroupPermDelete, true},
+		{"owner transfers", GroupAccess{GroupRole: GroupRoleOwner, Role: RoleUser}, GroupPermTransfer, true},
+		{"group admin edits", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupPermEdit, true},
+		{"group admin answers join requests", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupPermJoinRequests, true},
+		{"group admin can't delete", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupPermDelete, false},
+		{"group admin can't manage roles", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupPermManageRoles, false},
+		{"member posts", GroupAccess{GroupRole: GroupRoleMember, Role: RoleUser}, GroupPermPost, true},
+		{"member can't invite", GroupAccess{GroupRole: GroupRoleMember, Role: RoleUser}, GroupPermInvite, false},
+		{"outsider can't view", GroupAccess{Role: RoleUser}, GroupPermView, false},
+		{"unknown group role", GroupAccess{GroupRole: "superuser", Role: RoleUser}, GroupPermView, false},
+		{"site admin deletes any group", GroupAccess{Role: RoleAdmin}, GroupPermDelete, true},
+		{"moderator views any group", GroupAccess{Role: RoleModerator}, GroupPermView, true},
+		{"moderator removes members", GroupAccess{Role: RoleModerator}, GroupPermRemoveMembers, true},
+		{"moderator can't post as an outsider", GroupAccess{Role: RoleModerator}, GroupPermPost, false},
+		{"moderator can't delete", GroupAccess{Role: RoleModerator}, GroupPermDelete, false},
+		{"moderator member posts", GroupAccess{GroupRole: GroupRoleMember, Role: RoleModerator}, GroupPermPost, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.access.Can(tt.perm); got != tt.want {
+				t.Errorf("%+v.Can(%q) = %v, want %v", tt.access, tt.perm, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupAccessCanManageMember(t *testing.T) {
+	tests := []struct {
+		name   string
+		access GroupAccess
+		target string
+		want   bool
+	}{
+		{"owner manages admin", GroupAccess{GroupRole: GroupRoleOwner, Role: RoleUser}, GroupRoleAdmin, true},
+		{"owner manages member", GroupAccess{GroupRole: GroupRoleOwner, Role: RoleUser}, GroupRoleMember, true},
+		{"owner can't manage owner", GroupAccess{GroupRole: GroupRoleOwner, Role: RoleUser}, GroupRoleOwner, false},
+		{"admin manages member", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupRoleMember, true},
+		{"admin can't manage admin", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupRoleAdmin, false},
+		{"admin can't manage owner", GroupAccess{GroupRole: GroupRoleAdmin, Role: RoleUser}, GroupRoleOwner, false},
+		{"member can't manage member", GroupAccess{GroupRole: GroupRoleMember, Role: RoleUser}, GroupRoleMember, false},
+		{"outsider can't manage member", GroupAccess{Role: RoleUser}, GroupRoleMember, false},
+		{"site admin manages owner", GroupAccess{Role: RoleAdmin}, GroupRoleOwner, true},
+		{"moderator manages admin", GroupAccess{Role: RoleModerator}, GroupRoleAdmin, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.access.CanManageMember(tt.target); got != tt.want {
+				t.Errorf("%+v.CanManageMember(%q) = %v, want %v", tt.access, tt.target, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+// Package oidc logs users in through an OpenID Connect provider with the
+// authorization code flow and PKCE
+package oidc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config describes the provider and how its claims map onto local accounts
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// DisplayName labels the login button
+	DisplayName string
+	// GroupsClaim names the ID token claim that lists the user's groups.
+	// Group mapping is off when it's empty.
+	GroupsClaim string
+	// AdminGroups grants admin access to members of any of these groups and
+	// takes it from everyone else
+	AdminGroups []string
+	// SyncGroups lists the local groups whose membership follows the IdP:
+	// users join the ones named like their IdP groups. Other groups are
+	// never joined this way, however their names match.
+	SyncGroups []string
+}
+
+// ConfigFromEnv reads the provider from OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL (defaulting to the callback under
+// APP_BASE_URL), OIDC_SCOPES, OIDC_DISPLAY_NAME, OIDC_GROUPS_CLAIM,
+// OIDC_ADMIN_GROUPS and OIDC_SYNC_GROUPS. The group settings are comma or
+// space separated lists of group names. It returns nil when OIDC_ISSUER
+// isn't set.
+func ConfigFromEnv() (*Config, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	cfg := &Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       []string{"openid", "email", "profile"},
+		DisplayName:  os.Getenv("OIDC_DISPLAY_NAME"),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroups:  splitList(os.Getenv("OIDC_ADMIN_GROUPS")),
+		SyncGroups:   splitList(os.Getenv("OIDC_SYNC_GROUPS")),
+	}
+
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+	if cfg.RedirectURL == "" {
+		base := strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/")
+		if base == "" {
+			return nil, fmt.Errorf("OIDC_REDIRECT_URL or APP_BASE_URL is required with OIDC_ISSUER")
+		}
+		cfg.RedirectURL = base + "/auth/oidc/callback"
+	}
+	if scopes := splitList(os.Getenv("OIDC_SCOPES")); len(scopes) > 0 {
+		cfg.Scopes = scopes
+	}
+	if !contains(cfg.Scopes, "openid") {
+		cfg.Scopes = append([]string{"openid"}, cfg.Scopes...)
+	}
+	if cfg.DisplayName == "" {
+		cfg.DisplayName = "Single Sign-On"
+	}
+	// Group sync used to be switched on for every group with OIDC_SYNC_GROUPS=true
+	if os.Getenv("OIDC_SYNC_GROUPS") == "true" {
+		return nil, fmt.Errorf("OIDC_SYNC_GROUPS must list the groups to sync")
+	}
+	if (len(cfg.AdminGroups) > 0 || len(cfg.SyncGroups) > 0) && cfg.GroupsClaim == "" {
+		return nil, fmt.Errorf("OIDC_GROUPS_CLAIM is required to map groups")
+	}
+
+	return cfg, nil
+}
+
+// IsAdmin reports whether any of the user's IdP groups grants admin access
+func (c *Config) IsAdmin(groups []string) bool {
+	for _, group := range groups {
+		if contains(c.AdminGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// SyncedGroups returns the user's IdP groups that are configured for sync
+func (c *Config) SyncedGroups(groups []string) []string {
+	var synced []string
+	for _, group := range groups {
+		if contains(c.SyncGroups, group) && !contains(synced, group) {
+			synced = append(synced, group)
+		}
+	}
+	return synced
+}
+
+// splitList splits a comma or space separated list
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// contains reports whether the list has the value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package oidc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigFromEnvGroups(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "https://idp.example.com/")
+	t.Setenv("OIDC_CLIENT_ID", testClientID)
+	t.Setenv("OIDC_REDIRECT_URL", testRedirectURL)
+	t.Setenv("OIDC_GROUPS_CLAIM", "groups")
+	t.Setenv("OIDC_ADMIN_GROUPS", "ops")
+	t.Setenv("OIDC_SYNC_GROUPS", "staff, devs")
+
+	cfg, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv() error = %v", err)
+	}
+	if !reflect.DeepEqual(cfg.AdminGroups, []string{"ops"}) {
+		t.Errorf("AdminGroups = %q, want [ops]", cfg.AdminGroups)
+	}
+	if !reflect.DeepEqual(cfg.SyncGroups, []string{"staff", "devs"}) {
+		t.Errorf("SyncGroups = %q, want [staff devs]", cfg.SyncGroups)
+	}
+
+	// The old switch would otherwise sync a group called "true"
+	t.Setenv("OIDC_SYNC_GROUPS", "true")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("ConfigFromEnv() accepted OIDC_SYNC_GROUPS=true")
+	}
+
+	t.Setenv("OIDC_SYNC_GROUPS", "staff")
+	t.Setenv("OIDC_GROUPS_CLAIM", "")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("ConfigFromEnv() accepted sync groups without a groups claim")
+	}
+}
+
+func TestConfigSyncedGroups(t *testing.T) {
+	cfg := &Config{SyncGroups: []string{"staff", "devs"}}
+
+	tests := []struct {
+		name   string
+		groups []string
+		want   []string
+	}{
+		{"configured groups", []string{"devs", "staff"}, []string{"devs", "staff"}},
+		{"other groups are ignored", []string{"staff", "admins", "my-private-group"}, []string{"staff"}},
+		{"duplicates", []string{"staff", "staff"}, []string{"staff"}},
+		{"names are case sensitive", []string{"Staff"}, nil},
+		{"no groups", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.SyncedGroups(tt.groups); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SyncedGroups(%q) = %q, want %q", tt.groups, got, tt.want)
+			}
+		})
+	}
+
+	if got := (&Config{}).SyncedGroups([]string{"staff"}); got != nil {
+		t.Errorf("SyncedGroups() without sync groups = %q, want none", got)
+	}
+}
+
+func TestConfigIsAdmin(t *testing.T) {
+	cfg := &Config{AdminGroups: []string{"ops", "root"}}
+
+	tests := []struct {
+		groups []string
+		want   bool
+	}{
+		{[]string{"staff", "root"}, true},
+		{[]string{"ops"}, true},
+		{[]string{"staff"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.IsAdmin(tt.groups); got != tt.want {
+			t.Errorf("IsAdmin(%q) = %v, want %v", tt.groups, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "bingbong"
+	testRedirectURL = "https://chat.example.com/auth/oidc/callback"
+	testKeyID       = "test-key"
+)
+
+// stubIdP is an OpenID Connect provider that logs everyone in as the same
+// subject. It checks PKCE like a real provider and signs ID tokens with an
+// RSA key from its key set.
+type stubIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// claims are added to every ID token
+	claims jwt.MapClaims
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	idp := &stubIdP{t: t, key: key, claims: jwt.MapClaims{}, codes: make(map[string]url.Values)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *stubIdP) config() *Config {
+	return &Config{
+		Issuer:       idp.server.URL,
+		ClientID:     testClientID,
+		ClientSecret: "secret",
+		RedirectURL:  testRedirectURL,
+		Scopes:       []string{"openid", "email"},
+		GroupsClaim:  "groups",
+	}
+}
+
+func (idp *stubIdP) provider() *Provider {
+	idp.t.Helper()
+
+	provider, err := NewProvider(context.Background(), idp.config())
+	if err != nil {
+		idp.t.Fatalf("NewProvider() error = %v", err)
+	}
+	return provider
+}
+
+func (idp *stubIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(discoveryDocument{
+		Issuer:                idp.server.URL,
+		AuthorizationEndpoint: idp.server.URL + "/authorize",
+		TokenEndpoint:         idp.server.URL + "/token",
+		JWKSURI:               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *stubIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+		Kty: "RSA",
+		Kid: testKeyID,
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+// authorize logs the user in at once and sends them back with a code
+func (idp *stubIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectURL ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString(idp.t)
+	idp.mu.Lock()
+	idp.codes[code] = query
+	idp.mu.Unlock()
+
+	http.Redirect(w, r, testRedirectURL+"?"+url.Values{"code": {code}, "state": {query.Get("state")}}.Encode(), http.StatusFound)
+}
+
+// token redeems a code once, for the verifier of its challenge
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clientID, secret, _ := r.BasicAuth()
+
+	idp.mu.Lock()
+	request, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || clientID != testClientID || secret != "secret" ||
+		r.PostForm.Get("redirect_uri") != testRedirectURL ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != request.Get("code_challenge") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(tokenResponse{IDToken: idp.idToken(request.Get("nonce"), nil)})
+}
+
+// idToken signs an ID token for the stub's subject with extra claims
+func (idp *stubIdP) idToken(nonce string, claims jwt.MapClaims) string {
+	idp.t.Helper()
+
+	now := time.Now()
+	tokenClaims := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   testClientID,
+		"sub":   "subject-1",
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	for name, value := range idp.claims {
+		tokenClaims[name] = value
+	}
+	for name, value := range claims {
+		tokenClaims[name] = value
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, tokenClaims)
+	token.Header["kid"] = testKeyID
+	raw, err := token.SignedString(idp.key)
+	if err != nil {
+		idp.t.Fatalf("failed to sign ID token: %v", err)
+	}
+	return raw
+}
+
+func randomString(t *testing.T) string {
+	t.Helper()
+
+	value, err := RandomString()
+	if err != nil {
+		t.Fatalf("RandomString() error = %v", err)
+	}
+	return value
+}
+
+// login follows the provider's login URL to the callback and returns the
+// callback's query
+func login(t *testing.T, loginURL string) url.Values {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(loginURL)
+	if err != nil {
+		t.Fatalf("login at provider failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login at provider returned %s", resp.Status)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid callback URL: %v", err)
+	}
+	return location.Query()
+}
+
+func TestLoginRoundTrip(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.claims["email"] = "alice@example.com"
+	provider := idp.provider()
+	state, nonce, verifier := randomString(t), randomString(t), randomString(t)
+
+	loginURL := provider.AuthCodeURL(state, nonce, verifier)
+	parsed, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("invalid login URL: %v", err)
+	}
+	if parsed.Query().Get("code_verifier") != "" || parsed.Query().Get("code_challenge") == verifier {
+		t.Fatal("login URL exposes the PKCE verifier")
+	}
+
+	callback := login(t, loginURL)
+	if callback.Get("state") != state {
+		t.Fatalf("callback state = %q, want %q", callback.Get("state"), state)
+	}
+
+	ctx := context.Background()
+	rawIDToken, err := provider.Exchange(ctx, callback.Get("code"), verifier)
+	if err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, nonce)
+	if err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+	if claims.Subject != "subject-1" || claims.Email != "alice@example.com" {
+		t.Errorf("claims = %+v, want subject-1 with alice@example.com", claims)
+	}
+
+	// Codes are single use
+	if _, err := provider.Exchange(ctx, callback.Get("code"), verifier); err == nil {
+		t.Error("Exchange() redeemed a code twice")
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := newStubIdP(t)
+	provider := idp.provider()
+
+	callback := login(t, provider.AuthCodeURL(randomString(t), randomString(t), randomString(t)))
+	if _, err := provider.Exchange(context.Background(), callback.Get("code"), randomString(t)); err == nil {
+		t.Error("Exchange() accepted a verifier that doesn't match the challenge")
+	}
+}
+
+func TestVerifyIDTokenRejectsWrongNonce(t *testing.T) {
+	idp := newStubIdP(t)
+	provider := idp.provider()
+
+	raw := idp.idToken(randomString(t), nil)
+	if _, err := provider.VerifyIDToken(context.Background(), raw, randomString(t)); err == nil {
+		t.Error("VerifyIDToken() accepted a token for another login")
+	}
+}
+
+func TestVerifyIDTokenClaims(t *testing.T) {
+	idp := newStubIdP(t)
+	provider := idp.provider()
+
+	tests := []struct {
+		name         string
+		claims       jwt.MapClaims
+		wantVerified bool
+		wantGroups   []string
+	}{
+		{"groups list", jwt.MapClaims{"groups": []string{"staff", "devs"}}, false, []string{"staff", "devs"}},
+		{"groups string", jwt.MapClaims{"groups": "staff, devs"}, false, []string{"staff", "devs"}},
+		{"groups list skips non-strings", jwt.MapClaims{"groups": []interface{}{"staff", 7}}, false, []string{"staff"}},
+		{"no groups", jwt.MapClaims{}, false, nil},
+		{"email verified", jwt.MapClaims{"email_verified": true}, true, nil},
+		{"email verified as string", jwt.MapClaims{"email_verified": "true"}, true, nil},
+		{"email not verified as string", jwt.MapClaims{"email_verified": "false"}, false, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nonce := randomString(t)
+			claims, err := provider.VerifyIDToken(context.Background(), idp.idToken(nonce, tt.claims), nonce)
+			if err != nil {
+				t.Fatalf("VerifyIDToken() error = %v", err)
+			}
+			if claims.EmailVerified != tt.wantVerified {
+				t.Errorf("EmailVerified = %v, want %v", claims.EmailVerified, tt.wantVerified)
+			}
+			if !reflect.DeepEqual(claims.Groups, tt.wantGroups) {
+				t.Errorf("Groups = %q, want %q", claims.Groups, tt.wantGroups)
+			}
+		})
+	}
+}
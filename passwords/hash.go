@@ -0,0 +1,138 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hash algorithms
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+// argon2id parameters for new hashes. Hashes made with other parameters
+// still verify and are replaced on the next login.
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// hashAlgorithm is the algorithm new hashes use, set by LoadFromEnv
+var hashAlgorithm = AlgorithmArgon2id
+
+// LoadFromEnv configures the hash algorithm from PASSWORD_HASH ("argon2id",
+// the default, or "bcrypt") and the policy from PolicyFromEnv
+func LoadFromEnv() error {
+	algorithm := strings.ToLower(os.Getenv("PASSWORD_HASH"))
+	switch algorithm {
+	case "":
+		algorithm = AlgorithmArgon2id
+	case AlgorithmArgon2id, AlgorithmBcrypt:
+	default:
+		return fmt.Errorf("unknown PASSWORD_HASH %q", algorithm)
+	}
+	hashAlgorithm = algorithm
+
+	p, err := PolicyFromEnv()
+	if err != nil {
+		return err
+	}
+	policy = p
+	return nil
+}
+
+// Hash hashes a password with the configured algorithm
+func Hash(password string) (string, error) {
+	if hashAlgorithm == AlgorithmBcrypt {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash password: %v", err)
+		}
+		return string(hashed), nil
+	}
+
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %v", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify reports whether the password matches the hash, and whether the
+// hash should be replaced because it uses an outdated algorithm or parameters
+func Verify(hash, password string) (ok bool, needsRehash bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2id(hash)
+		if err != nil {
+			return false, false
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(computed, key) != 1 {
+			return false, false
+		}
+		current := params.memory == argon2Memory && params.time == argon2Time &&
+			params.threads == argon2Threads && len(key) == argon2KeyLen
+		return true, hashAlgorithm != AlgorithmArgon2id || !current
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, hashAlgorithm != AlgorithmBcrypt || err != nil || cost < bcrypt.DefaultCost
+}
+
+// argon2Params are the cost parameters stored in an argon2id hash
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// decodeArgon2id parses a hash in the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func decodeArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, fmt.Errorf("malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id parameters: %v", err)
+	}
+	if params.time == 0 || params.threads == 0 {
+		return params, nil, nil, fmt.Errorf("malformed argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("malformed argon2id key")
+	}
+	return params, salt, key, nil
+}
@@ -0,0 +1,78 @@
+package passwords
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHashAndVerify(t *testing.T) {
+	defer func(algorithm string) { hashAlgorithm = algorithm }(hashAlgorithm)
+
+	lowCostBcrypt, err := bcrypt.GenerateFromPassword([]byte("passw0rd"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := []byte("somesaltsomesalt")
+	oldArgon2id := fmt.Sprintf("$argon2id$v=%d$m=4096,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("passw0rd"), salt, 1, 4096, 1, argon2KeyLen)))
+
+	tests := []struct {
+		name       string
+		hashWith   string
+		verifyWith string
+		hash       string
+		password   string
+		wantOK     bool
+		wantRehash bool
+	}{
+		{name: "argon2id", hashWith: AlgorithmArgon2id, verifyWith: AlgorithmArgon2id, password: "passw0rd", wantOK: true},
+		{name: "argon2id wrong password", hashWith: AlgorithmArgon2id, verifyWith: AlgorithmArgon2id, password: "passw0rD"},
+		{name: "bcrypt", hashWith: AlgorithmBcrypt, verifyWith: AlgorithmBcrypt, password: "passw0rd", wantOK: true},
+		{name: "bcrypt wrong password", hashWith: AlgorithmBcrypt, verifyWith: AlgorithmBcrypt, password: "passw0rD"},
+		{name: "bcrypt after switching to argon2id", hashWith: AlgorithmBcrypt, verifyWith: AlgorithmArgon2id, password: "passw0rd", wantOK: true, wantRehash: true},
+		{name: "argon2id after switching to bcrypt", hashWith: AlgorithmArgon2id, verifyWith: AlgorithmBcrypt, password: "passw0rd", wantOK: true, wantRehash: true},
+		{name: "low cost bcrypt", verifyWith: AlgorithmBcrypt, hash: string(lowCostBcrypt), password: "passw0rd", wantOK: true, wantRehash: true},
+		{name: "old argon2id parameters", verifyWith: AlgorithmArgon2id, hash: oldArgon2id, password: "passw0rd", wantOK: true, wantRehash: true},
+		{name: "malformed argon2id", verifyWith: AlgorithmArgon2id, hash: "$argon2id$v=19$m=65536$salt$key", password: "passw0rd"},
+		{name: "empty hash", verifyWith: AlgorithmArgon2id, hash: "", password: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash := tt.hash
+			if tt.hashWith != "" {
+				hashAlgorithm = tt.hashWith
+				var err error
+				if hash, err = Hash("passw0rd"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			hashAlgorithm = tt.verifyWith
+			ok, needsRehash := Verify(hash, tt.password)
+			if ok != tt.wantOK || needsRehash != tt.wantRehash {
+				t.Errorf("Verify = %v, %v, want %v, %v", ok, needsRehash, tt.wantOK, tt.wantRehash)
+			}
+		})
+	}
+}
+
+func TestHashSaltsEachPassword(t *testing.T) {
+	first, err := Hash("passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Hash("passw0rd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("hashing the same password twice gave the same hash")
+	}
+}
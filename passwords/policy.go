@@ -0,0 +1,211 @@
+// Package passwords validates new passwords against the password policy and
+// hashes and verifies them
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Character classes a policy can require
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassLetter = "letter"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// Policy describes what makes a new password acceptable
+type Policy struct {
+	MinLength       int
+	MaxLength       int
+	RequiredClasses []string
+	// breached holds upper case SHA-1 hex digests of known breached passwords
+	breached map[string]struct{}
+}
+
+// policy is the policy Validate enforces, replaced by LoadFromEnv
+var policy = DefaultPolicy()
+
+// DefaultPolicy requires 8 characters with letters and digits
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:       8,
+		MaxLength:       maxLengthFor(hashAlgorithm),
+		RequiredClasses: []string{ClassLetter, ClassDigit},
+	}
+}
+
+// maxLengthFor returns the longest password an algorithm hashes in full
+func maxLengthFor(algorithm string) int {
+	if algorithm == AlgorithmBcrypt {
+		// bcrypt ignores everything after 72 bytes
+		return 72
+	}
+	return 256
+}
+
+// PolicyFromEnv builds the policy from PASSWORD_MIN_LENGTH,
+// PASSWORD_REQUIRED_CLASSES (a comma separated list of lower, upper, letter,
+// digit and symbol) and PASSWORD_BREACHED_FILE
+func PolicyFromEnv() (*Policy, error) {
+	p := DefaultPolicy()
+
+	if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+		minLength, err := strconv.Atoi(value)
+		if err != nil || minLength < 1 {
+			return nil, fmt.Errorf("invalid PASSWORD_MIN_LENGTH %q", value)
+		}
+		if minLength > p.MaxLength {
+			return nil, fmt.Errorf("PASSWORD_MIN_LENGTH must be at most %d", p.MaxLength)
+		}
+		p.MinLength = minLength
+	}
+
+	if value, ok := os.LookupEnv("PASSWORD_REQUIRED_CLASSES"); ok {
+		p.RequiredClasses = nil
+		for _, class := range strings.Split(value, ",") {
+			class = strings.ToLower(strings.TrimSpace(class))
+			switch class {
+			case "":
+				continue
+			case ClassLower, ClassUpper, ClassLetter, ClassDigit, ClassSymbol:
+				p.RequiredClasses = append(p.RequiredClasses, class)
+			default:
+				return nil, fmt.Errorf("unknown password character class %q", class)
+			}
+		}
+	}
+
+	if path := os.Getenv("PASSWORD_BREACHED_FILE"); path != "" {
+		if err := p.LoadBreachedList(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// LoadBreachedList reads passwords that must not be used, one per line.
+// Lines may hold the password itself or its SHA-1 digest in hex, optionally
+// followed by ":count" as in the Have I Been Pwned downloads. Blank lines and
+// lines starting with # are skipped.
+func (p *Policy) LoadBreachedList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open breached password list: %v", err)
+	}
+	defer file.Close()
+
+	breached := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if digest, ok := parseSHA1Line(line); ok {
+			breached[digest] = struct{}{}
+		} else {
+			breached[sha1Hex(line)] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read breached password list: %v", err)
+	}
+
+	p.breached = breached
+	return nil
+}
+
+// parseSHA1Line recognizes a hex SHA-1 digest with an optional ":count"
+func parseSHA1Line(line string) (string, bool) {
+	digest := line
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		digest = line[:i]
+	}
+	if len(digest) != sha1.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return "", false
+	}
+	return strings.ToUpper(digest), true
+}
+
+// sha1Hex returns the upper case hex SHA-1 digest of a password
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// Validate checks a new password for the account with the username
+func (p *Policy) Validate(password, username string) error {
+	length := len([]rune(password))
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > p.MaxLength {
+		return fmt.Errorf("password must be at most %d bytes", p.MaxLength)
+	}
+	if username != "" && strings.EqualFold(strings.TrimSpace(password), strings.TrimSpace(username)) {
+		return fmt.Errorf("password must not match the username")
+	}
+
+	present := make(map[string]bool)
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			present[ClassLower] = true
+			present[ClassLetter] = true
+		case unicode.IsUpper(r):
+			present[ClassUpper] = true
+			present[ClassLetter] = true
+		case unicode.IsLetter(r):
+			present[ClassLetter] = true
+		case unicode.IsDigit(r):
+			present[ClassDigit] = true
+		case !unicode.IsSpace(r):
+			present[ClassSymbol] = true
+		}
+	}
+	for _, class := range p.RequiredClasses {
+		if !present[class] {
+			return fmt.Errorf("password must contain %s", classDescription(class))
+		}
+	}
+
+	if _, found := p.breached[sha1Hex(password)]; found {
+		return fmt.Errorf("password appears in a list of breached passwords, choose another one")
+	}
+	return nil
+}
+
+// classDescription names a character class in error messages
+func classDescription(class string) string {
+	switch class {
+	case ClassLower:
+		return "a lower case letter"
+	case ClassUpper:
+		return "an upper case letter"
+	case ClassLetter:
+		return "a letter"
+	case ClassDigit:
+		return "a digit"
+	default:
+		return "a symbol"
+	}
+}
+
+// Validate checks a new password against the configured policy
+func Validate(password, username string) error {
+	return policy.Validate(password, username)
+}
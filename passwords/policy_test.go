@@ -0,0 +1,75 @@
+package passwords
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	strict := &Policy{
+		MinLength:       10,
+		MaxLength:       64,
+		RequiredClasses: []string{ClassLower, ClassUpper, ClassDigit, ClassSymbol},
+	}
+
+	tests := []struct {
+		name     string
+		policy   *Policy
+		password string
+		username string
+		wantErr  bool
+	}{
+		{"letters and digits", DefaultPolicy(), "passw0rd", "alice", false},
+		{"too short", DefaultPolicy(), "pass123", "alice", true},
+		{"length counts characters, not bytes", DefaultPolicy(), "äöüäöü1", "alice", true},
+		{"non-ASCII letters count as letters", DefaultPolicy(), "pässwörd1", "alice", false},
+		{"no digit", DefaultPolicy(), "password", "alice", true},
+		{"no letter", DefaultPolicy(), "12345678", "alice", true},
+		{"too long", DefaultPolicy(), strings.Repeat("a", 256) + "1", "alice", true},
+		{"matches username", DefaultPolicy(), "Alice2024", "alice2024", true},
+		{"contains username", DefaultPolicy(), "alice2024!", "alice2024", false},
+		{"all classes", strict, "Passw0rd!x", "alice", false},
+		{"missing upper", strict, "passw0rd!x", "alice", true},
+		{"missing symbol", strict, "Passw0rdxx", "alice", true},
+		{"space isn't a symbol", strict, "Passw0rd x", "alice", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(tt.password, tt.username)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) error = %v, want error %v", tt.password, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicyBreachedList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	list := "# known breached passwords\n\npassw0rd\nE286977B13F1A89E20D0459207545D15FE1EBA08:42\r\n"
+	if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := DefaultPolicy()
+	if err := p.LoadBreachedList(path); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		password string
+		wantErr  bool
+	}{
+		{"passw0rd", true},
+		{"letmein123", true},
+		{"letmein124", false},
+	}
+
+	for _, tt := range tests {
+		if err := p.Validate(tt.password, ""); (err != nil) != tt.wantErr {
+			t.Errorf("Validate(%q) error = %v, want error %v", tt.password, err, tt.wantErr)
+		}
+	}
+}
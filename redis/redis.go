@@ -1,15 +1,21 @@
 package redis
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"git.ssy.dk/noob/bingbong-go/handlers"
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	goredis "github.com/go-redis/redis/v8"
+	"gorm.io/gorm"
 )
 
-func InitRedis() (*handlers.DistributedHub, error) {
+// redisURL builds the connection URL from the REDIS_* environment variables
+func redisURL() (string, error) {
 	redisHost := os.Getenv("REDIS_HOST")
 	redisPort := os.Getenv("REDIS_PORT")
 	redisUser := os.Getenv("REDIS_USER")
@@ -18,14 +24,33 @@ func InitRedis() (*handlers.DistributedHub, error) {
 	// Validate if we have all the required environment variables
 	if redisHost == "" || redisPort == "" || redisPassword == "" || redisUser == "" {
 		log.Println("missing required environment variables for Redis")
-		return nil, fmt.Errorf("missing required environment variables for Redis")
+		return "", fmt.Errorf("missing required environment variables for Redis")
+	}
+
+	return fmt.Sprintf("redis://%s:%s@%s:%s/0", redisUser, redisPassword, redisHost, redisPort), nil
+}
+
+func InitRedis(db *gorm.DB) (*handlers.DistributedHub, error) {
+	url, err := redisURL()
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional comma-separated list of browser origins allowed on /ws
+	var allowedOrigins []string
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			allowedOrigins = append(allowedOrigins, origin)
+		}
 	}
 
 	redisConfig := handlers.HubConfig{
-		RedisURL:        fmt.Sprintf("redis://%s:%s@%s:%s/0", redisUser, redisPassword, redisHost, redisPort),
+		RedisURL:        url,
 		MaxRetries:      3,
 		SessionDuration: 24 * time.Hour,
 		BufferSize:      256,
+		AllowedOrigins:  allowedOrigins,
+		DB:              db,
 	}
 
 	hub, err := handlers.NewDistributedHub(redisConfig)
@@ -34,6 +59,31 @@ func InitRedis() (*handlers.DistributedHub, error) {
 	}
 
 	go hub.Run()
-	log.Printf("Redis hub initialized and connected to %s:%s", redisHost, redisPort)
+	log.Printf("Redis hub initialized and connected to %s:%s", os.Getenv("REDIS_HOST"), os.Getenv("REDIS_PORT"))
 	return hub, nil
 }
+
+// InitLoginLimiter connects the login limiter to Redis. It uses its own
+// client so throttling doesn't depend on the websocket hub.
+func InitLoginLimiter() (*loginlimit.Limiter, error) {
+	url, err := redisURL()
+	if err != nil {
+		return nil, err
+	}
+
+	opt, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %v", err)
+	}
+	opt.MaxRetries = 3
+
+	client := goredis.NewClient(opt)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect login limiter to Redis: %v", err)
+	}
+
+	return loginlimit.New(client), nil
+}
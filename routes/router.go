@@ -1,32 +1,40 @@
 package routes
 
 import (
+	"log"
 	"net/http"
 
+	"git.ssy.dk/noob/bingbong-go/db"
 	"git.ssy.dk/noob/bingbong-go/handlers"
+	"git.ssy.dk/noob/bingbong-go/loginlimit"
+	"git.ssy.dk/noob/bingbong-go/mailer"
 	"git.ssy.dk/noob/bingbong-go/middleware"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/oidc"
+	"git.ssy.dk/noob/bingbong-go/services"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
 type Router struct {
-	db     *gorm.DB
-	engine *gin.Engine
-	wsHub  *handlers.DistributedHub
+	db           *gorm.DB
+	database     *db.Database
+	engine       *gin.Engine
+	wsHub        *handlers.DistributedHub
+	limiter      *loginlimit.Limiter
+	mailer       mailer.Mailer
+	registration bool
+	oidc         *oidc.Provider
 }
 
-func NewRouter(db *gorm.DB) *Router {
+func NewRouter(database *db.Database) *Router {
 	router := &Router{
-		db:     db,
-		engine: gin.Default(),
+		db:       database.GetDB(),
+		database: database,
+		engine:   gin.Default(),
+		mailer:   mailer.NewLogMailer(log.Writer()),
 	}
 
-	// Add DB middleware
-	router.engine.Use(func(c *gin.Context) {
-		c.Set("db", db)
-		c.Next()
-	})
-
 	// Add timing middleware
 	router.engine.Use(middleware.TimingMiddleware())
 
@@ -36,26 +44,62 @@ func NewRouter(db *gorm.DB) *Router {
 // SetHub sets the WebSocket hub for the router
 func (r *Router) SetHub(hub *handlers.DistributedHub) {
 	r.wsHub = hub
-	// Add WebSocket hub middleware
-	r.engine.Use(func(c *gin.Context) {
-		c.Set("hub", r.wsHub)
-		c.Next()
-	})
+}
+
+// SetLoginLimiter sets the limiter that throttles password and code
+// guessing. Without one, logins are not limited.
+func (r *Router) SetLoginLimiter(limiter *loginlimit.Limiter) {
+	r.limiter = limiter
+}
+
+// SetMailer sets the mailer handlers use for outgoing email. Without one,
+// emails are only logged.
+func (r *Router) SetMailer(m mailer.Mailer) {
+	r.mailer = m
+}
+
+// SetOIDCProvider enables single sign-on through an OpenID Connect provider
+func (r *Router) SetOIDCProvider(provider *oidc.Provider) {
+	r.oidc = provider
+}
+
+// EnableRegistration lets visitors sign up for their own accounts
+func (r *Router) EnableRegistration() {
+	r.registration = true
 }
 
 func (r *Router) SetupRoutes() {
+	svc := services.New(r.database, handlers.NewNotificationService(r.wsHub))
+	if r.wsHub != nil {
+		r.wsHub.SetGroupService(svc.Groups)
+	}
+
 	// Authentication routes
-	r.engine.GET("/login", handlers.LoginPageHandler)
-	r.engine.GET("/logout", handlers.LogoutHandler)
+	r.engine.GET("/login", handlers.LoginPageHandler(r.oidc))
+	r.engine.GET("/logout", handlers.LogoutHandler(r.db))
+	r.engine.GET("/verify-email", handlers.VerifyEmailHandler(r.db))
+	r.engine.GET("/forgot-password", handlers.ForgotPasswordPageHandler)
+	r.engine.GET("/reset-password", handlers.ResetPasswordPageHandler(r.db))
+	if r.registration {
+		r.engine.GET("/register", handlers.RegisterPageHandler)
+	}
+
+	// Invite links; anonymous visitors are sent through the login page first
+	r.engine.GET("/join/:token", middleware.AuthMiddleware(r.db), handlers.JoinGroupPageHandler(svc.Users, svc.Groups, svc.Invites))
+	r.engine.POST("/join/:token", middleware.AuthMiddleware(r.db), handlers.JoinGroupHandler(svc.Users, svc.Groups, svc.Invites))
+
+	// Directory of listed and open groups
+	r.engine.GET("/directory", middleware.AuthMiddleware(r.db), handlers.GroupDirectoryHandler(svc.Groups))
+
+	// Single sign-on routes
+	if r.oidc != nil {
+		r.engine.GET("/auth/oidc/login", handlers.OIDCLoginHandler(r.oidc))
+		r.engine.GET("/auth/oidc/callback", handlers.OIDCCallbackHandler(r.db, r.limiter, r.oidc))
+		r.engine.GET("/auth/oidc/link", middleware.AuthMiddleware(r.db), middleware.SessionOnlyMiddleware(), handlers.OIDCLinkHandler(r.oidc))
+	}
 
 	// WebSocket routes
-	r.engine.GET("/ws", func(c *gin.Context) {
-		if r.wsHub != nil {
-			handlers.HandleWebSocket(c)
-		} else {
-			c.String(http.StatusServiceUnavailable, "WebSocket service not available")
-		}
-	})
+	r.engine.GET("/ws", handlers.HandleWebSocket(r.wsHub))
 	r.engine.GET("/demo", handlers.WebSocketDemoHandler)
 
 	// Serve static files
@@ -66,10 +110,11 @@ func (r *Router) SetupRoutes() {
 
 	// Health check endpoints
 	r.engine.GET("/ping", handlers.PingHandler)
+	healthz := handlers.HealthzHandler(r.wsHub)
 	r.engine.GET("/healthz", func(c *gin.Context) {
 		// Enhanced health check that includes Redis status
 		if r.wsHub != nil && r.wsHub.IsHealthy() {
-			handlers.HealthzHandler(c)
+			healthz(c)
 		} else {
 			c.JSON(http.StatusServiceUnavailable, gin.H{
 				"status":  "unhealthy",
@@ -80,11 +125,11 @@ func (r *Router) SetupRoutes() {
 
 	// User Dashboard routes (protected)
 	dashboard := r.engine.Group("/dashboard")
-	dashboard.Use(middleware.AuthMiddleware())
+	dashboard.Use(middleware.AuthMiddleware(r.db))
 	{
-		dashboard.GET("/", handlers.UserDashboardHandler)
-		dashboard.GET("/groups", handlers.UserGroupsHandler)
-		dashboard.GET("/invites", handlers.UserInvitesHandler)
+		dashboard.GET("/", handlers.UserDashboardHandler(svc.Users))
+		dashboard.GET("/groups", handlers.UserGroupsHandler(svc.Users))
+		dashboard.GET("/invites", handlers.UserInvitesHandler(svc.Users))
 	}
 
 	// API routes
@@ -94,85 +139,161 @@ func (r *Router) SetupRoutes() {
 		// Auth API endpoints
 		auth := v1.Group("/auth")
 		{
-			auth.POST("/login", handlers.LoginHandler)
+			auth.POST("/login", handlers.LoginHandler(r.db, svc.Security, r.limiter, r.oidc))
+			auth.POST("/login/2fa", handlers.LoginTwoFactorHandler(r.db, svc.Security, r.limiter, r.oidc))
+			auth.POST("/refresh", handlers.RefreshTokenHandler(r.db))
+			auth.POST("/logout", middleware.AuthMiddleware(r.db), handlers.LogoutSessionHandler(r.db))
+			auth.POST("/logout-all", middleware.AuthMiddleware(r.db), handlers.LogoutAllSessionsHandler(r.db))
+			auth.POST("/ws-ticket", middleware.AuthMiddleware(r.db), handlers.WebSocketTicketHandler(r.wsHub))
+			auth.POST("/forgot-password", handlers.ForgotPasswordHandler(r.db, r.limiter, r.mailer))
+			auth.POST("/reset-password", handlers.ResetPasswordHandler(r.db))
+
+			// Self-service registration, off unless enabled
+			if r.registration {
+				auth.POST("/register", handlers.RegisterHandler(r.db, r.mailer))
+				auth.POST("/register/resend", handlers.ResendVerificationHandler(r.db, r.mailer))
+			}
 		}
 
 		// User API endpoints (protected)
 		user := v1.Group("/user")
-		user.Use(middleware.AuthMiddleware())
+		user.Use(middleware.AuthMiddleware(r.db))
 		{
 			// Account settings
-			user.GET("/account", handlers.GetUserAccountHandler) // New endpoint for account tab
-			user.PUT("/password", handlers.UpdateUserPasswordHandler)
-			user.PUT("/publickey", handlers.UpdateUserPublicKeyHandler)
+			user.GET("/account", handlers.GetUserAccountHandler(svc.Users)) // New endpoint for account tab
+			user.PUT("/password", handlers.UpdateUserPasswordHandler(svc.Users))
+			user.PUT("/publickey", handlers.UpdateUserPublicKeyHandler(svc.Users))
+
+			// API keys, managed from a browser session only
+			apiKeys := user.Group("/apikeys")
+			apiKeys.Use(middleware.SessionOnlyMiddleware())
+			{
+				apiKeys.GET("", handlers.GetAPIKeysHandler(svc.APIKeys))
+				apiKeys.POST("", handlers.CreateAPIKeyHandler(svc.APIKeys))
+				apiKeys.DELETE("/:id", handlers.RevokeAPIKeyHandler(svc.APIKeys))
+			}
+
+			// Two-factor authentication, managed from a browser session only
+			twoFactor := user.Group("/2fa")
+			twoFactor.Use(middleware.SessionOnlyMiddleware())
+			{
+				twoFactor.GET("", handlers.GetTwoFactorHandler(svc.TwoFactor))
+				twoFactor.POST("/setup", handlers.BeginTwoFactorSetupHandler(svc.TwoFactor))
+				twoFactor.POST("/enable", handlers.EnableTwoFactorHandler(svc.TwoFactor))
+				twoFactor.POST("/disable", handlers.DisableTwoFactorHandler(svc.TwoFactor, svc.Security, r.limiter))
+				twoFactor.POST("/recovery-codes", handlers.RegenerateRecoveryCodesHandler(svc.TwoFactor, svc.Security, r.limiter))
+			}
+
+			// Single sign-on accounts linked from the account settings
+			user.GET("/sso", middleware.SessionOnlyMiddleware(), handlers.GetSingleSignOnHandler(r.db, r.oidc))
 
-			// Groups management
-			user.GET("/groups", handlers.GetUserGroupsDataHandler) // API endpoint to fetch groups data
+			// Groups management; what members may do depends on their role in the group
+			user.GET("/groups", handlers.GetUserGroupsDataHandler(svc.Users, svc.Groups)) // API endpoint to fetch groups data
 			user.GET("/groups/new", handlers.GetCreateGroupFormHandler)
-			user.GET("/groups/:id", handlers.GetGroupDetailHandler)
-			user.DELETE("/groups/:id", handlers.DeleteGroupHandler)
-			user.GET("/groups/:id/edit", handlers.GetEditGroupFormHandler)
-			user.GET("/groups/:id/invite", handlers.GetInviteUserFormHandler)
-			user.POST("/groups", handlers.CreateGroupHandler)
-			user.PUT("/groups/:id", handlers.UpdateGroupHandler)
-			user.POST("/groups/:id/invite", handlers.InviteUserToGroupHandler)
-			user.DELETE("/groups/:id/members/:member_id", handlers.RemoveGroupMemberHandler)
+			user.GET("/groups/:id", middleware.RequireGroupPermission(r.db, models.GroupPermView), handlers.GetGroupDetailHandler(svc.Groups, r.wsHub))
+			user.DELETE("/groups/:id", middleware.RequireGroupPermission(r.db, models.GroupPermDelete), handlers.DeleteGroupHandler(svc.Users, svc.Groups))
+			user.GET("/groups/:id/edit", middleware.RequireGroupPermission(r.db, models.GroupPermEdit), handlers.GetEditGroupFormHandler(svc.Groups))
+			user.GET("/groups/:id/invite", middleware.RequireGroupPermission(r.db, models.GroupPermInvite), handlers.GetInviteUserFormHandler(svc.Invites))
+			user.POST("/groups", handlers.CreateGroupHandler(svc.Users, svc.Groups))
+			user.PUT("/groups/:id", middleware.RequireGroupPermission(r.db, models.GroupPermEdit), handlers.UpdateGroupHandler(svc.Users, svc.Groups))
+			user.POST("/groups/:id/invite", middleware.RequireGroupPermission(r.db, models.GroupPermInvite), handlers.InviteUserToGroupHandler(svc.Users, svc.Invites))
+			user.DELETE("/groups/:id/members/:member_id", middleware.RequireGroupPermission(r.db, models.GroupPermRemoveMembers), handlers.RemoveGroupMemberHandler(svc.Groups, r.wsHub))
+			user.PUT("/groups/:id/members/:member_id/role", middleware.RequireGroupPermission(r.db, models.GroupPermManageRoles), handlers.UpdateGroupMemberRoleHandler(svc.Groups, r.wsHub))
+			user.PUT("/groups/:id/owner", middleware.RequireGroupPermission(r.db, models.GroupPermTransfer), handlers.TransferGroupOwnershipHandler(svc.Groups, r.wsHub))
+			user.POST("/groups/:id/leave", handlers.LeaveGroupHandler(svc.Users, svc.Groups))
+			user.GET("/groups/:id/invite-links", middleware.RequireGroupPermission(r.db, models.GroupPermInviteLinks), handlers.GetGroupInviteLinksHandler(svc.Invites))
+			user.POST("/groups/:id/invite-links", middleware.RequireGroupPermission(r.db, models.GroupPermInviteLinks), handlers.CreateGroupInviteLinkHandler(svc.Invites))
+			user.DELETE("/groups/:id/invite-links/:link_id", middleware.RequireGroupPermission(r.db, models.GroupPermInviteLinks), handlers.RevokeGroupInviteLinkHandler(svc.Invites))
+			user.GET("/groups/:id/join-requests", middleware.RequireGroupPermission(r.db, models.GroupPermJoinRequests), handlers.GetGroupJoinRequestsHandler(svc.Groups))
+			user.PUT("/groups/:id/join-requests/:request_id/approve", middleware.RequireGroupPermission(r.db, models.GroupPermJoinRequests), handlers.ApproveJoinRequestHandler(svc.Groups, r.wsHub))
+			user.PUT("/groups/:id/join-requests/:request_id/reject", middleware.RequireGroupPermission(r.db, models.GroupPermJoinRequests), handlers.RejectJoinRequestHandler(svc.Groups, r.wsHub))
+
+			// Group directory; private groups never show up here
+			user.GET("/directory", handlers.SearchGroupDirectoryHandler(svc.Groups))
+			user.POST("/directory/:id/join", handlers.JoinDirectoryGroupHandler(svc.Users, svc.Groups))
+			user.DELETE("/directory/:id/join", handlers.CancelJoinRequestHandler(svc.Users, svc.Groups))
+
+			// Group chat
+			user.GET("/groups/:id/presence", middleware.RequireGroupPermission(r.db, models.GroupPermView), handlers.GetGroupPresenceHandler(svc.Groups, r.wsHub))
+			user.GET("/groups/:id/messages", middleware.RequireGroupPermission(r.db, models.GroupPermView), handlers.GetGroupMessagesHandler(svc.Groups))
+			user.POST("/groups/:id/messages", middleware.RequireGroupPermission(r.db, models.GroupPermPost), handlers.PostGroupMessageHandler(svc.Groups))
+
+			// Notifications
+			user.GET("/notifications", handlers.GetNotificationsHandler(svc.Users))
+			user.GET("/notifications/unread-count", handlers.GetUnreadNotificationCountHandler(svc.Users))
+			user.PUT("/notifications/read-all", handlers.MarkAllNotificationsReadHandler(svc.Users))
+			user.PUT("/notifications/:id/read", handlers.MarkNotificationReadHandler(svc.Users))
+			user.DELETE("/notifications/:id", handlers.DeleteNotificationHandler(svc.Users))
 
 			// Invitations management
-			user.GET("/invites/list", handlers.GetUserInvitesDataHandler) // API endpoint to fetch invites data
-			user.PUT("/invites/:id/accept", handlers.AcceptInviteHandler)
-			user.DELETE("/invites/:id", handlers.DeclineInviteHandler)
+			user.GET("/invites/list", handlers.GetUserInvitesDataHandler(svc.Users, svc.Invites)) // API endpoint to fetch invites data
+			user.PUT("/invites/:id/accept", handlers.AcceptInviteHandler(svc.Users, svc.Invites))
+			user.DELETE("/invites/:id", handlers.DeclineInviteHandler(svc.Users, svc.Invites))
 		}
 
-		// Public API endpoints
+		// JSON API endpoints for scripts and other clients
 		users := v1.Group("/users")
+		users.Use(middleware.AuthMiddleware(r.db))
 		{
-			users.POST("/", handlers.CreateUser)
-			users.GET("/", handlers.GetUsers)
-			users.GET("/:id", handlers.GetUser)
-			users.PUT("/:id", handlers.UpdateUser)
-			users.DELETE("/:id", handlers.DeleteUser)
+			users.POST("/", handlers.CreateUser(svc.Users))
+			users.GET("/", handlers.GetUsers(svc.Users))
+			users.GET("/:id", handlers.GetUser(svc.Users))
+			users.PUT("/:id", handlers.UpdateUser(svc.Users))
+			users.DELETE("/:id", handlers.DeleteUser(svc.Users))
 		}
 
 		groups := v1.Group("/groups")
+		groups.Use(middleware.AuthMiddleware(r.db))
 		{
-			groups.POST("/", handlers.CreateGroup)
-			groups.GET("/", handlers.GetGroups)
-			groups.GET("/:id", handlers.GetGroup)
-			groups.PUT("/:id", handlers.UpdateGroup)
-			groups.DELETE("/:id", handlers.DeleteGroup)
+			groups.POST("/", handlers.CreateGroup(svc.Groups))
+			groups.GET("/", handlers.GetGroups(svc.Groups))
+			groups.GET("/:id", middleware.RequireGroupPermission(r.db, models.GroupPermView), handlers.GetGroup(svc.Groups))
+			groups.PUT("/:id", middleware.RequireGroupPermission(r.db, models.GroupPermEdit), handlers.UpdateGroup(svc.Groups))
+			groups.DELETE("/:id", middleware.RequireGroupPermission(r.db, models.GroupPermDelete), handlers.DeleteGroup(svc.Groups))
+			groups.PUT("/:id/owner", middleware.RequireGroupPermission(r.db, models.GroupPermTransfer), handlers.TransferGroupOwnership(svc.Groups))
+			groups.POST("/:id/invites", middleware.RequireGroupPermission(r.db, models.GroupPermInvite), handlers.InviteUserToGroupHandler(svc.Users, svc.Invites))
 		}
 
 		// Protected admin API endpoints
 		admin := v1.Group("/admin")
-		admin.Use(middleware.AuthMiddleware(), middleware.AdminAuthMiddleware())
+		admin.Use(middleware.AuthMiddleware(r.db), middleware.AdminAuthMiddleware())
 		{
 			// Admin user management
 			adminUsers := admin.Group("/users")
+			adminUsers.Use(middleware.RequirePermission(models.PermManageUsers))
 			{
-				adminUsers.GET("/", handlers.AdminGetUsersHandler)
+				adminUsers.GET("/", handlers.AdminGetUsersHandler(svc.Users))
 				adminUsers.GET("/new", handlers.AdminGetUserFormHandler)
-				adminUsers.GET("/:id/edit", handlers.AdminGetUserEditFormHandler)
-				adminUsers.POST("/", handlers.AdminCreateUserHandler)
-				adminUsers.PUT("/:id", handlers.AdminUpdateUserHandler)
-				adminUsers.DELETE("/:id", handlers.AdminDeleteUserHandler)
+				adminUsers.GET("/:id/edit", handlers.AdminGetUserEditFormHandler(svc.Users))
+				adminUsers.POST("/", handlers.AdminCreateUserHandler(svc.Users))
+				adminUsers.PUT("/:id", handlers.AdminUpdateUserHandler(svc.Users))
+				adminUsers.DELETE("/:id", handlers.AdminDeleteUserHandler(svc.Users))
+			}
+
+			// Login lockouts and security events
+			adminLockouts := admin.Group("/lockouts")
+			adminLockouts.Use(middleware.RequirePermission(models.PermManageSecurity))
+			{
+				adminLockouts.GET("/", handlers.AdminGetLockoutsHandler(svc.Security, r.limiter))
+				adminLockouts.DELETE("/:username", handlers.AdminClearLockoutHandler(svc.Security, r.limiter))
 			}
 
 			// Admin group management
 			adminGroups := admin.Group("/groups")
+			adminGroups.Use(middleware.RequirePermission(models.PermManageGroups))
 			{
-				adminGroups.GET("/", handlers.AdminGetGroupsHandler)
-				adminGroups.GET("/new", handlers.AdminGetGroupFormHandler)
-				adminGroups.GET("/:id/edit", handlers.AdminGetGroupEditFormHandler)
-				adminGroups.POST("/", handlers.AdminCreateGroupHandler)
-				adminGroups.PUT("/:id", handlers.AdminUpdateGroupHandler)
-				adminGroups.DELETE("/:id", handlers.AdminDeleteGroupHandler)
+				adminGroups.GET("/", handlers.AdminGetGroupsHandler(svc.Groups))
+				adminGroups.GET("/new", handlers.AdminGetGroupFormHandler(svc.Users))
+				adminGroups.GET("/:id/edit", handlers.AdminGetGroupEditFormHandler(svc.Users, svc.Groups))
+				adminGroups.POST("/", handlers.AdminCreateGroupHandler(svc.Groups))
+				adminGroups.PUT("/:id", handlers.AdminUpdateGroupHandler(svc.Groups))
+				adminGroups.DELETE("/:id", handlers.AdminDeleteGroupHandler(svc.Groups))
 			}
 		}
 
 		// WebSocket related APIs
 		websocket := v1.Group("/websocket")
-		admin.Use(middleware.AuthMiddleware())
+		admin.Use(middleware.AuthMiddleware(r.db))
 		{
 			websocket.GET("/stats", func(c *gin.Context) {
 				if r.wsHub != nil {
@@ -190,9 +311,9 @@ func (r *Router) SetupRoutes() {
 
 	// Admin routes - protected and rendered pages
 	adminRoutes := r.engine.Group("/admin")
-	adminRoutes.Use(middleware.AuthMiddleware(), middleware.AdminAuthMiddleware())
+	adminRoutes.Use(middleware.AuthMiddleware(r.db), middleware.AdminAuthMiddleware())
 	{
-		adminRoutes.GET("/", handlers.AdminDashboardHandler) // Renders the admin dashboard
+		adminRoutes.GET("/", handlers.AdminDashboardHandler(svc.Users, svc.Groups)) // Renders the admin dashboard
 		// Add more admin UI routes here as needed
 	}
 }
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// maxAPIKeysPerUser bounds how many active keys a user can hold
+const maxAPIKeysPerUser = 20
+
+// Errors returned by APIKeyService
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrTooManyAPIKeys = errors.New("too many active API keys")
+	ErrAdminScope     = errors.New("only admins can create keys with the admin scope")
+)
+
+// apiKeyService is the APIKeyService backed by the database
+type apiKeyService struct {
+	db *db.Database
+}
+
+// NewAPIKeyService returns an APIKeyService backed by the database
+func NewAPIKeyService(database *db.Database) APIKeyService {
+	return &apiKeyService{db: database}
+}
+
+// NewAPIKey describes an API key a user creates. A zero ExpiresIn means the
+// key doesn't expire; IsAdmin allows the admin scope.
+type NewAPIKey struct {
+	UserID    uint
+	Name      string
+	Scopes    []string
+	ExpiresIn time.Duration
+	IsAdmin   bool
+}
+
+// APIKeys returns the user's keys, newest first
+func (s *apiKeyService) APIKeys(userID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := s.db.GormDB.Where("user_id = ?", userID).Order("created_at DESC").Find(&keys).Error
+	return keys, err
+}
+
+// CreateAPIKey stores a new key and returns its plaintext, which is only
+// available here
+func (s *apiKeyService) CreateAPIKey(input NewAPIKey) (string, *models.APIKey, error) {
+	scopes, err := auth.ValidateScopes(input.Scopes)
+	if err != nil {
+		return "", nil, &InputError{err.Error()}
+	}
+
+	// Admin scope is only meaningful for admins
+	for _, scope := range scopes {
+		if scope == auth.ScopeAdmin && !input.IsAdmin {
+			return "", nil, ErrAdminScope
+		}
+	}
+
+	var expiresAt *time.Time
+	if input.ExpiresIn > 0 {
+		expiry := time.Now().Add(input.ExpiresIn)
+		expiresAt = &expiry
+	}
+
+	var plaintext string
+	var apiKey *models.APIKey
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var activeKeys int64
+		if err := tx.Model(&models.APIKey{}).
+			Where("user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", input.UserID, time.Now()).
+			Count(&activeKeys).Error; err != nil {
+			return err
+		}
+		if activeKeys >= maxAPIKeysPerUser {
+			return ErrTooManyAPIKeys
+		}
+
+		var err error
+		plaintext, apiKey, err = auth.GenerateAPIKey(tx, input.UserID, input.Name, scopes, expiresAt)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return plaintext, apiKey, nil
+}
+
+// RevokeAPIKey stops one of the user's keys from working
+func (s *apiKeyService) RevokeAPIKey(userID, keyID uint) error {
+	result := s.db.GormDB.Model(&models.APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", keyID, userID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"strings"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// directoryLimit bounds how many groups a directory search returns
+const directoryLimit = 50
+
+// ErrJoinRequestNotFound is returned for join requests of another group or
+// that don't exist
+var ErrJoinRequestNotFound = errors.New("join request not found")
+
+// groupListings adds the user's relation to each group for the directory
+func groupListings(tx *gorm.DB, userID uint, groups []models.UserGroup) ([]models.GroupListing, error) {
+	listings := make([]models.GroupListing, len(groups))
+	if len(groups) == 0 {
+		return listings, nil
+	}
+
+	ids := make([]uint, len(groups))
+	for i, group := range groups {
+		ids[i] = group.ID
+	}
+
+	var counts []struct {
+		GroupID uint
+		Count   int64
+	}
+	if err := tx.Model(&models.UserGroupMember{}).Select("group_id, COUNT(*) AS count").
+		Where("group_id IN ?", ids).Group("group_id").Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	memberCounts := make(map[uint]int64, len(counts))
+	for _, count := range counts {
+		memberCounts[count.GroupID] = count.Count
+	}
+
+	var memberOf []uint
+	if err := tx.Model(&models.UserGroupMember{}).
+		Where("user_id = ? AND group_id IN ?", userID, ids).
+		Pluck("group_id", &memberOf).Error; err != nil {
+		return nil, err
+	}
+
+	var requested []uint
+	if err := tx.Model(&models.GroupJoinRequest{}).
+		Where("user_id = ? AND status = ? AND group_id IN ?", userID, models.JoinRequestStatusPending, ids).
+		Pluck("group_id", &requested).Error; err != nil {
+		return nil, err
+	}
+
+	for i, group := range groups {
+		listings[i] = models.GroupListing{Group: group, MemberCount: memberCounts[group.ID]}
+		for _, id := range memberOf {
+			if id == group.ID {
+				listings[i].IsMember = true
+			}
+		}
+		for _, id := range requested {
+			if id == group.ID {
+				listings[i].PendingRequest = true
+			}
+		}
+	}
+	return listings, nil
+}
+
+// SearchDirectory finds the listed and open groups matching a search of
+// their names and descriptions, with the user's relation to each
+func (s *groupService) SearchDirectory(userID uint, query string) ([]models.GroupListing, error) {
+	tx := s.db.GormDB.Where("visibility IN ?", []string{models.GroupVisibilityListed, models.GroupVisibilityOpen})
+	if query = strings.TrimSpace(query); query != "" {
+		tx = tx.Where("name ILIKE ? OR description ILIKE ?", "%"+query+"%", "%"+query+"%")
+	}
+
+	var groups []models.UserGroup
+	if err := tx.Order("name").Limit(directoryLimit).Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	return groupListings(s.db.GormDB, userID, groups)
+}
+
+// DirectoryListing returns a group's directory entry as the user sees it
+func (s *groupService) DirectoryListing(userID uint, group *models.UserGroup) (*models.GroupListing, error) {
+	listings, err := groupListings(s.db.GormDB, userID, []models.UserGroup{*group})
+	if err != nil {
+		return nil, err
+	}
+	return &listings[0], nil
+}
+
+// PendingJoinRequests returns a group's pending join requests with their
+// requesters, oldest first
+func (s *groupService) PendingJoinRequests(groupID uint) ([]models.GroupJoinRequest, error) {
+	var requests []models.GroupJoinRequest
+	err := s.db.GormDB.Preload("User").
+		Where("group_id = ? AND status = ?", groupID, models.JoinRequestStatusPending).
+		Order("created_at, id").Find(&requests).Error
+	return requests, err
+}
+
+// GetJoinRequest returns one of a group's join requests with its group and
+// requester
+func (s *groupService) GetJoinRequest(groupID, requestID uint) (*models.GroupJoinRequest, error) {
+	var request models.GroupJoinRequest
+	err := s.db.GormDB.Preload("Group").Preload("User").
+		Where("id = ? AND group_id = ?", requestID, groupID).
+		First(&request).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrJoinRequestNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &request, nil
+}
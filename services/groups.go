@@ -0,0 +1,633 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Errors returned by GroupService
+var (
+	ErrGroupNotFound       = errors.New("group not found")
+	ErrGroupNameTaken      = errors.New("group name already exists")
+	ErrAlreadyMember       = errors.New("already a member of this group")
+	ErrNotMember           = errors.New("not a member of this group")
+	ErrOwnerCannotLeave    = errors.New("the owner can't leave the group")
+	ErrJoinRequestPending  = errors.New("already asked to join this group")
+	ErrNoJoinRequest       = errors.New("no pending request to join this group")
+	ErrJoinRequestAnswered = errors.New("this join request was already answered")
+	ErrOwnerMembership     = errors.New("the owner's membership can't be changed here")
+	ErrCannotManageMember  = errors.New("not allowed to manage this member")
+)
+
+// groupNameIndex is the unique index on the names of groups that aren't deleted
+const groupNameIndex = "idx_user_groups_name"
+
+// isGroupNameTaken reports whether an insert or update failed because
+// another group already has the name. The count before saving gives a
+// friendly error in the common case; the index catches concurrent requests.
+func isGroupNameTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == groupNameIndex
+}
+
+// groupService is the GroupService backed by the database
+type groupService struct {
+	db            *db.Database
+	notifications NotificationService
+}
+
+// NewGroupService returns a GroupService backed by the database
+func NewGroupService(database *db.Database, notifications NotificationService) GroupService {
+	return &groupService{db: database, notifications: notifications}
+}
+
+// NewGroup describes a group to create. The owner becomes its first member;
+// MemberIDs that don't belong to a user are skipped.
+type NewGroup struct {
+	Name        string
+	Description string
+	Visibility  string
+	OwnerID     uint
+	MemberIDs   []uint
+}
+
+// GroupQuery filters the groups ListGroups returns
+type GroupQuery struct {
+	// MemberID only lists groups the user created or belongs to when set
+	MemberID    uint
+	CreatedByID uint
+	// Search matches part of the group name
+	Search string
+	Page   Page
+}
+
+// GroupChanges lists the details of a group to change; nil fields stay as
+// they are
+type GroupChanges struct {
+	Name        *string
+	Description *string
+	Visibility  *string
+}
+
+// AddMember gives a user a role in a group unless they already belong to
+// it, and reports whether a membership was added. The unique (user_id,
+// group_id) index settles concurrent additions.
+func AddMember(tx *gorm.DB, groupID, userID uint, role string) (bool, error) {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.UserGroupMember{
+		UserID:  userID,
+		GroupID: groupID,
+		Role:    role,
+	})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// existingUserIDs keeps the IDs that belong to a user, dropping duplicates
+// and the excluded ID
+func existingUserIDs(tx *gorm.DB, ids []uint, exclude uint) ([]uint, error) {
+	var found []uint
+	if len(ids) == 0 {
+		return found, nil
+	}
+	err := tx.Model(&models.User{}).Where("id IN ? AND id <> ?", ids, exclude).Pluck("id", &found).Error
+	return found, err
+}
+
+// GetGroup returns a group with its creator and members
+func (s *groupService) GetGroup(groupID uint) (*models.UserGroup, error) {
+	var group models.UserGroup
+	err := s.db.GormDB.Preload("Creator").Preload("Members.User").First(&group, groupID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrGroupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// MemberIDs returns the IDs of the group's creator and members
+func (s *groupService) MemberIDs(groupID uint) ([]uint, error) {
+	var userIDs []uint
+	err := s.db.GormDB.Model(&models.User{}).
+		Where("id IN (SELECT created_by_id FROM user_groups WHERE id = ?) OR id IN (SELECT user_id FROM user_group_members WHERE group_id = ?)", groupID, groupID).
+		Pluck("id", &userIDs).Error
+	return userIDs, err
+}
+
+// IsMember reports whether the user belongs to the group
+func (s *groupService) IsMember(groupID, userID uint) (bool, error) {
+	var count int64
+	err := s.db.GormDB.Model(&models.UserGroupMember{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// ListGroups returns a page of the groups matching the query, with their
+// creator and memberships, and how many match in total
+func (s *groupService) ListGroups(query GroupQuery) ([]models.UserGroup, int64, error) {
+	filtered := s.db.GormDB.Model(&models.UserGroup{})
+	if query.MemberID != 0 {
+		filtered = filtered.Where("user_groups.created_by_id = ? OR user_groups.id IN (SELECT group_id FROM user_group_members WHERE user_id = ?)", query.MemberID, query.MemberID)
+	}
+	if query.CreatedByID != 0 {
+		filtered = filtered.Where("user_groups.created_by_id = ?", query.CreatedByID)
+	}
+	if query.Search != "" {
+		filtered = filtered.Where("user_groups.name ILIKE ?", "%"+query.Search+"%")
+	}
+
+	var total int64
+	if err := filtered.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count groups: %v", err)
+	}
+
+	var groups []models.UserGroup
+	if err := query.Page.apply(filtered).Preload("Creator").Preload("Members").Find(&groups).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch groups: %v", err)
+	}
+	return groups, total, nil
+}
+
+// CreateGroup creates a group with its owner and members. Nothing is kept
+// if any part fails.
+func (s *groupService) CreateGroup(input NewGroup) (*models.UserGroup, error) {
+	if input.Visibility == "" {
+		input.Visibility = models.GroupVisibilityPrivate
+	}
+
+	group := models.UserGroup{
+		Name:        input.Name,
+		Description: input.Description,
+		CreatedByID: input.OwnerID,
+		Visibility:  input.Visibility,
+	}
+
+	memberIDs := []uint{input.OwnerID}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.UserGroup{}).Where("name = ?", input.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrGroupNameTaken
+		}
+
+		if err := tx.Create(&group).Error; err != nil {
+			if isGroupNameTaken(err) {
+				return ErrGroupNameTaken
+			}
+			return fmt.Errorf("failed to create group: %v", err)
+		}
+		if _, err := AddMember(tx, group.ID, input.OwnerID, models.GroupRoleOwner); err != nil {
+			return fmt.Errorf("failed to add owner: %v", err)
+		}
+
+		existing, err := existingUserIDs(tx, input.MemberIDs, input.OwnerID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch members: %v", err)
+		}
+		for _, memberID := range existing {
+			if _, err := AddMember(tx, group.ID, memberID, models.GroupRoleMember); err != nil {
+				return fmt.Errorf("failed to add member %d: %v", memberID, err)
+			}
+		}
+		memberIDs = append(memberIDs, existing...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Start delivering the group's messages to the creator and members
+	for _, memberID := range memberIDs {
+		s.notifications.Subscribe(memberID, group.ID)
+	}
+	return &group, nil
+}
+
+// SaveGroup saves the group's details and makes its members exactly the
+// given users. The owner always stays, and members who stay keep their role.
+func (s *groupService) SaveGroup(group *models.UserGroup, memberIDs []uint) error {
+	var previousIDs, currentIDs []uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if previousIDs, err = groupUserIDs(tx, group.ID); err != nil {
+			return fmt.Errorf("failed to fetch members: %v", err)
+		}
+
+		// Memberships are synced below, not from whatever was preloaded
+		if err := tx.Omit(clause.Associations).Save(group).Error; err != nil {
+			if isGroupNameTaken(err) {
+				return ErrGroupNameTaken
+			}
+			return fmt.Errorf("failed to update group: %v", err)
+		}
+
+		remove := tx.Where("group_id = ? AND role <> ?", group.ID, models.GroupRoleOwner)
+		if len(memberIDs) > 0 {
+			remove = remove.Where("user_id NOT IN ?", memberIDs)
+		}
+		if err := remove.Delete(&models.UserGroupMember{}).Error; err != nil {
+			return fmt.Errorf("failed to remove members: %v", err)
+		}
+
+		existing, err := existingUserIDs(tx, memberIDs, 0)
+		if err != nil {
+			return fmt.Errorf("failed to fetch members: %v", err)
+		}
+		for _, memberID := range existing {
+			if _, err := AddMember(tx, group.ID, memberID, models.GroupRoleMember); err != nil {
+				return fmt.Errorf("failed to add member %d: %v", memberID, err)
+			}
+		}
+
+		currentIDs, err = groupUserIDs(tx, group.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	syncSubscriptions(s.notifications, group.ID, previousIDs, currentIDs)
+	return nil
+}
+
+// UpdateGroup changes a group's details and returns it with its creator
+// and members
+func (s *groupService) UpdateGroup(groupID uint, changes GroupChanges) (*models.UserGroup, error) {
+	if changes.Visibility != nil && !models.ValidGroupVisibility(*changes.Visibility) {
+		return nil, &InputError{"Invalid visibility"}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var group models.UserGroup
+		if err := tx.First(&group, groupID).Error; err != nil {
+			return ErrGroupNotFound
+		}
+
+		if changes.Name != nil && *changes.Name != group.Name {
+			var count int64
+			if err := tx.Model(&models.UserGroup{}).Where("name = ? AND id <> ?", *changes.Name, group.ID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return ErrGroupNameTaken
+			}
+			group.Name = *changes.Name
+		}
+		if changes.Description != nil {
+			group.Description = *changes.Description
+		}
+		if changes.Visibility != nil {
+			group.Visibility = *changes.Visibility
+		}
+
+		if err := tx.Save(&group).Error; err != nil {
+			if isGroupNameTaken(err) {
+				return ErrGroupNameTaken
+			}
+			return fmt.Errorf("failed to update group: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetGroup(groupID)
+}
+
+// DeleteGroup deletes a group and stops delivering its messages to the
+// former members
+func (s *groupService) DeleteGroup(groupID uint) error {
+	var memberIDs []uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var group models.UserGroup
+		if err := tx.First(&group, groupID).Error; err != nil {
+			return ErrGroupNotFound
+		}
+
+		var err error
+		if memberIDs, err = groupUserIDs(tx, group.ID); err != nil {
+			return fmt.Errorf("failed to fetch members: %v", err)
+		}
+		if err := tx.Delete(&group).Error; err != nil {
+			return fmt.Errorf("failed to delete group: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, memberID := range memberIDs {
+		s.notifications.Unsubscribe(memberID, groupID)
+	}
+	return nil
+}
+
+// findMembership returns a user's membership of a group, or ErrNotMember
+func findMembership(tx *gorm.DB, groupID, userID uint) (*models.UserGroupMember, error) {
+	var membership models.UserGroupMember
+	err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &membership, nil
+}
+
+// RemoveMember removes a member on behalf of someone with the given access
+// to the group. The owner can't be removed, and only members the remover
+// outranks can be.
+func (s *groupService) RemoveMember(groupID, memberID uint, remover models.GroupAccess) error {
+	membership, err := findMembership(s.db.GormDB, groupID, memberID)
+	if err != nil {
+		return err
+	}
+	if membership.Role == models.GroupRoleOwner {
+		return ErrOwnerMembership
+	}
+	if !remover.CanManageMember(membership.Role) {
+		return ErrCannotManageMember
+	}
+
+	if err := s.db.GormDB.Delete(membership).Error; err != nil {
+		return err
+	}
+
+	// Stop delivering the group's messages to the removed member
+	s.notifications.Unsubscribe(memberID, groupID)
+	return nil
+}
+
+// SetMemberRole makes a member a group admin or a regular member. Ownership
+// changes hands through TransferOwnership instead.
+func (s *groupService) SetMemberRole(groupID, memberID uint, role string) error {
+	if role != models.GroupRoleAdmin && role != models.GroupRoleMember {
+		return &InputError{"Role must be admin or member"}
+	}
+
+	membership, err := findMembership(s.db.GormDB, groupID, memberID)
+	if err != nil {
+		return err
+	}
+	if membership.Role == models.GroupRoleOwner {
+		return ErrOwnerMembership
+	}
+	if membership.Role == role {
+		return nil
+	}
+	return s.db.GormDB.Model(membership).Update("role", role).Error
+}
+
+// JoinWithInviteLink counts a use of the link and adds the user to its
+// group together, so a link that runs out midway doesn't let anyone in
+func (s *groupService) JoinWithInviteLink(link *models.GroupInviteLink, userID uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := joinableBy(tx, link.GroupID, userID); err != nil {
+			return err
+		}
+		if err := auth.UseGroupInviteLink(tx, link); err != nil {
+			return err
+		}
+		return addNewMember(tx, link.GroupID, userID)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notifications.Subscribe(userID, link.GroupID)
+	return nil
+}
+
+// JoinOpenGroup adds the user to a group anyone may join and tells the
+// group's managers
+func (s *groupService) JoinOpenGroup(group *models.UserGroup, user *models.User) error {
+	if group.Visibility != models.GroupVisibilityOpen {
+		return ErrGroupNotFound
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return addNewMember(tx, group.ID, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notifications.Subscribe(user.ID, group.ID)
+	notifyGroupManagers(s.db.GormDB, s.notifications, group.ID, Notification{
+		Type:    NotificationTypeSystem,
+		Title:   "New group member",
+		Message: user.Username + " joined group: " + group.Name,
+		Data: map[string]any{
+			"groupId":   group.ID,
+			"groupName": group.Name,
+		},
+	})
+	return nil
+}
+
+// RequestToJoin asks the managers of a listed group to let the user in
+func (s *groupService) RequestToJoin(group *models.UserGroup, user *models.User, message string) (*models.GroupJoinRequest, error) {
+	if !group.Discoverable() {
+		return nil, ErrGroupNotFound
+	}
+
+	request := models.GroupJoinRequest{
+		GroupID: group.ID,
+		UserID:  user.ID,
+		Status:  models.JoinRequestStatusPending,
+		Message: message,
+	}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := joinableBy(tx, group.ID, user.ID); err != nil {
+			return err
+		}
+		// The unique pending index settles concurrent requests
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&request)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrJoinRequestPending
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	notifyGroupManagers(s.db.GormDB, s.notifications, group.ID, Notification{
+		Type:    NotificationTypeJoinRequest,
+		Title:   "New join request",
+		Message: user.Username + " asked to join group: " + group.Name,
+		Data: map[string]any{
+			"requestId": request.ID,
+			"groupId":   group.ID,
+			"groupName": group.Name,
+			"status":    request.Status,
+		},
+	})
+	return &request, nil
+}
+
+// CancelJoinRequest withdraws the user's pending request to join a group
+func (s *groupService) CancelJoinRequest(group *models.UserGroup, user *models.User) error {
+	result := s.db.GormDB.Model(&models.GroupJoinRequest{}).
+		Where("group_id = ? AND user_id = ? AND status = ?", group.ID, user.ID, models.JoinRequestStatusPending).
+		Updates(map[string]interface{}{
+			"status":        models.JoinRequestStatusCancelled,
+			"decided_by_id": user.ID,
+			"decided_at":    time.Now(),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoJoinRequest
+	}
+
+	notifyGroupManagers(s.db.GormDB, s.notifications, group.ID, Notification{
+		Type:    NotificationTypeJoinRequest,
+		Title:   "Join request withdrawn",
+		Message: user.Username + " withdrew their request to join group: " + group.Name,
+		Data: map[string]any{
+			"groupId":   group.ID,
+			"groupName": group.Name,
+			"status":    models.JoinRequestStatusCancelled,
+		},
+	})
+	return nil
+}
+
+// AnswerJoinRequest approves or rejects a pending join request; approved
+// requesters become members. Of several managers answering at once only
+// the first gets through. The request needs its Group loaded.
+func (s *groupService) AnswerJoinRequest(request *models.GroupJoinRequest, deciderID uint, status string) error {
+	now := time.Now()
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.GroupJoinRequest{}).
+			Where("id = ? AND status = ?", request.ID, models.JoinRequestStatusPending).
+			Updates(map[string]interface{}{"status": status, "decided_by_id": deciderID, "decided_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrJoinRequestAnswered
+		}
+		if status != models.JoinRequestStatusApproved {
+			return nil
+		}
+		_, err := AddMember(tx, request.GroupID, request.UserID, models.GroupRoleMember)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	request.Status = status
+	request.DecidedByID = &deciderID
+	request.DecidedAt = &now
+
+	title := "Join request rejected"
+	message := "Your request to join group: " + request.Group.Name + " was rejected"
+	if status == models.JoinRequestStatusApproved {
+		// Start delivering the group's messages to the new member
+		s.notifications.Subscribe(request.UserID, request.GroupID)
+		title = "Join request approved"
+		message = "Your request to join group: " + request.Group.Name + " was approved"
+	}
+	s.notifications.Notify(request.UserID, Notification{
+		Type:    NotificationTypeJoinRequest,
+		Title:   title,
+		Message: message,
+		Data: map[string]any{
+			"requestId": request.ID,
+			"groupId":   request.GroupID,
+			"groupName": request.Group.Name,
+			"status":    request.Status,
+		},
+	})
+	return nil
+}
+
+// LeaveGroup removes a member from a group. Owners have to hand the group
+// to someone else first.
+func (s *groupService) LeaveGroup(groupID, userID uint) error {
+	membership, err := findMembership(s.db.GormDB, groupID, userID)
+	if err != nil {
+		return err
+	}
+	if membership.Role == models.GroupRoleOwner {
+		return ErrOwnerCannotLeave
+	}
+
+	if err := s.db.GormDB.Delete(membership).Error; err != nil {
+		return err
+	}
+
+	// Stop delivering the group's messages to the former member
+	s.notifications.Unsubscribe(userID, groupID)
+	return nil
+}
+
+// TransferOwnership makes a member the group's owner; the previous owner
+// stays on as a group admin
+func (s *groupService) TransferOwnership(group *models.UserGroup, newOwnerID uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return transferGroupOwnership(tx, group.ID, newOwnerID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if newOwnerID != group.CreatedByID {
+		s.notifications.Notify(newOwnerID, Notification{
+			Type:    NotificationTypeSystem,
+			Title:   "You now own a group",
+			Message: "You are now the owner of group: " + group.Name,
+			Data: map[string]any{
+				"groupId":   group.ID,
+				"groupName": group.Name,
+			},
+		})
+	}
+	return nil
+}
+
+// joinableBy returns ErrAlreadyMember when the user already belongs to the group
+func joinableBy(tx *gorm.DB, groupID, userID uint) error {
+	var count int64
+	if err := tx.Model(&models.UserGroupMember{}).Where("group_id = ? AND user_id = ?", groupID, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrAlreadyMember
+	}
+	return nil
+}
+
+// addNewMember adds a regular member, failing with ErrAlreadyMember when a
+// concurrent join got there first
+func addNewMember(tx *gorm.DB, groupID, userID uint) error {
+	added, err := AddMember(tx, groupID, userID, models.GroupRoleMember)
+	if err != nil {
+		return err
+	}
+	if !added {
+		return ErrAlreadyMember
+	}
+	return nil
+}
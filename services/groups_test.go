@@ -0,0 +1,36 @@
+package services
+
+import (
+	"testing"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+)
+
+func TestAddMemberIgnoresExistingMembers(t *testing.T) {
+	database := openTestDB(t)
+	owner := createTestUser(t, database, "owner")
+	member := createTestUser(t, database, "member")
+	group := createTestGroup(t, database, "team", owner)
+
+	added, err := AddMember(database.GormDB, group.ID, member.ID, models.GroupRoleAdmin)
+	if err != nil || !added {
+		t.Fatalf("AddMember() = %v, %v; want true, nil", added, err)
+	}
+
+	// A second add, as from a concurrent invite acceptance, changes nothing
+	added, err = AddMember(database.GormDB, group.ID, member.ID, models.GroupRoleMember)
+	if err != nil || added {
+		t.Fatalf("AddMember() again = %v, %v; want false, nil", added, err)
+	}
+
+	var memberships []models.UserGroupMember
+	if err := database.GormDB.Where("group_id = ? AND user_id = ?", group.ID, member.ID).Find(&memberships).Error; err != nil {
+		t.Fatalf("failed to fetch memberships: %v", err)
+	}
+	if len(memberships) != 1 {
+		t.Fatalf("got %d memberships, want 1", len(memberships))
+	}
+	if memberships[0].Role != models.GroupRoleAdmin {
+		t.Errorf("role = %q, want the original %q", memberships[0].Role, models.GroupRoleAdmin)
+	}
+}
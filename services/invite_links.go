@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// maxInviteLinksPerGroup bounds how many usable links a group can have
+const maxInviteLinksPerGroup = 20
+
+// Errors returned for invite links
+var (
+	ErrInviteLinkNotFound = errors.New("invite link not found")
+	ErrTooManyInviteLinks = errors.New("too many active invite links")
+)
+
+// NewInviteLink describes a shareable invite link to create. A zero
+// ExpiresIn or MaxUses means no limit; EmailDomain restricts the link to
+// users with a verified address at that domain.
+type NewInviteLink struct {
+	GroupID     uint
+	CreatedByID uint
+	ExpiresIn   time.Duration
+	MaxUses     int
+	EmailDomain string
+}
+
+// FindInviteLink returns the usable or spent link with the token and its
+// group, or ErrInviteLinkNotFound
+func (s *inviteService) FindInviteLink(token string) (*models.GroupInviteLink, error) {
+	link, err := auth.FindGroupInviteLink(s.db.GormDB, token)
+	if errors.Is(err, auth.ErrInvalidInviteLink) {
+		return nil, ErrInviteLinkNotFound
+	}
+	return link, err
+}
+
+// InviteLinks returns a group's invite links with their creators, newest first
+func (s *inviteService) InviteLinks(groupID uint) ([]models.GroupInviteLink, error) {
+	var links []models.GroupInviteLink
+	err := s.db.GormDB.Preload("Creator").Where("group_id = ?", groupID).Order("created_at DESC").Find(&links).Error
+	return links, err
+}
+
+// CreateInviteLink stores a new invite link and returns its plaintext
+// token, which is only available here
+func (s *inviteService) CreateInviteLink(input NewInviteLink) (string, *models.GroupInviteLink, error) {
+	emailDomain := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(input.EmailDomain), "@"))
+	if emailDomain != "" && (!strings.Contains(emailDomain, ".") || strings.ContainsAny(emailDomain, "@ /")) {
+		return "", nil, &InputError{"Invalid email domain"}
+	}
+
+	var token string
+	var link *models.GroupInviteLink
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var activeLinks int64
+		if err := tx.Model(&models.GroupInviteLink{}).
+			Where("group_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", input.GroupID, time.Now()).
+			Where("max_uses = 0 OR uses < max_uses").
+			Count(&activeLinks).Error; err != nil {
+			return err
+		}
+		if activeLinks >= maxInviteLinksPerGroup {
+			return ErrTooManyInviteLinks
+		}
+
+		var expiresAt *time.Time
+		if input.ExpiresIn > 0 {
+			expiry := time.Now().Add(input.ExpiresIn)
+			expiresAt = &expiry
+		}
+
+		var err error
+		token, link, err = auth.CreateGroupInviteLink(tx, input.GroupID, input.CreatedByID, expiresAt, input.MaxUses, emailDomain)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, link, nil
+}
+
+// RevokeInviteLink stops one of a group's invite links from working
+func (s *inviteService) RevokeInviteLink(groupID, linkID uint) error {
+	result := s.db.GormDB.Model(&models.GroupInviteLink{}).
+		Where("id = ? AND group_id = ? AND revoked_at IS NULL", linkID, groupID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteLinkNotFound
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// InviteTTL is how long an invitation can be answered
+	InviteTTL = 14 * 24 * time.Hour
+	// inviteHistoryLimit bounds how many sent and received invites UserInvites returns
+	inviteHistoryLimit = 50
+)
+
+// Errors returned by InviteService
+var (
+	ErrInviteNotFound   = errors.New("invitation not found")
+	ErrInviteNotPending = errors.New("this invitation is no longer pending")
+	ErrInviteExpired    = errors.New("this invitation has expired")
+	ErrNotInvitee       = errors.New("only the invitee can accept this invitation")
+	ErrNotInviteParty   = errors.New("only the invitee or the inviter can decline this invitation")
+	ErrAlreadyInvited   = errors.New("the user has already been invited to this group")
+)
+
+// inviteService is the InviteService backed by the database
+type inviteService struct {
+	db            *db.Database
+	notifications NotificationService
+}
+
+// NewInviteService returns an InviteService backed by the database
+func NewInviteService(database *db.Database, notifications NotificationService) InviteService {
+	return &inviteService{db: database, notifications: notifications}
+}
+
+// TransitionInvite moves a pending invite to a final status and records
+// when. Of several concurrent transitions only the first succeeds.
+func TransitionInvite(tx *gorm.DB, invite *models.UserGroupInvite, status string) error {
+	column, ok := models.InviteStatusColumn(status)
+	if !ok {
+		return fmt.Errorf("invalid invite status %q", status)
+	}
+
+	now := time.Now()
+	result := tx.Model(&models.UserGroupInvite{}).
+		Where("id = ? AND status = ?", invite.ID, models.InviteStatusPending).
+		Updates(map[string]interface{}{"status": status, column: now})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteNotPending
+	}
+
+	invite.Status = status
+	switch status {
+	case models.InviteStatusAccepted:
+		invite.AcceptedAt = &now
+	case models.InviteStatusDeclined:
+		invite.DeclinedAt = &now
+	case models.InviteStatusRevoked:
+		invite.RevokedAt = &now
+	case models.InviteStatusExpired:
+		invite.ExpiredAt = &now
+	}
+	return nil
+}
+
+// loadInvite returns an invite with its Group, even a deleted one, its
+// Initiator and its Invitee
+func (s *inviteService) loadInvite(inviteID uint) (*models.UserGroupInvite, error) {
+	var invite models.UserGroupInvite
+	err := s.db.GormDB.Preload("Group", func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }).
+		Preload("Initiator").Preload("Invitee").First(&invite, inviteID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInviteNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// InviteCandidates returns the users the inviter can invite to a group:
+// everyone who isn't a member and has no pending invitation to it
+func (s *inviteService) InviteCandidates(groupID, inviterID uint) ([]models.User, error) {
+	var users []models.User
+	err := s.db.GormDB.Where("id NOT IN (SELECT user_id FROM user_group_members WHERE group_id = ?)", groupID).
+		Where("id NOT IN (SELECT invitee_id FROM user_group_invites WHERE group_id = ? AND status = ?)", groupID, models.InviteStatusPending).
+		Where("id != ?", inviterID).
+		Find(&users).Error
+	return users, err
+}
+
+// UserInvites returns the invites a user sent and received, pending ones
+// first and then the latest answered ones, with their groups, even deleted
+// ones, and the other party
+func (s *inviteService) UserInvites(userID uint) (sent, received []models.UserGroupInvite, err error) {
+	pendingFirst := "CASE user_group_invites.status WHEN '" + models.InviteStatusPending + "' THEN 0 ELSE 1 END"
+	deletedToo := func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }
+
+	if err := s.db.GormDB.Preload("Group", deletedToo).Preload("Invitee").
+		Where("invite_initiator_id = ?", userID).
+		Order(pendingFirst).Order("created_at DESC, id DESC").
+		Limit(inviteHistoryLimit).
+		Find(&sent).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch sent invites: %v", err)
+	}
+
+	if err := s.db.GormDB.Preload("Group", deletedToo).Preload("Initiator").
+		Where("invitee_id = ?", userID).
+		Order(pendingFirst).Order("created_at DESC, id DESC").
+		Limit(inviteHistoryLimit).
+		Find(&received).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch received invites: %v", err)
+	}
+	return sent, received, nil
+}
+
+// Invite invites a user who doesn't belong to the group yet and tells them
+func (s *inviteService) Invite(groupID, initiatorID, inviteeID uint) (*models.UserGroupInvite, error) {
+	expiresAt := time.Now().Add(InviteTTL)
+	invite := models.UserGroupInvite{
+		GroupID:           groupID,
+		InviteInitiatorID: initiatorID,
+		InviteeID:         inviteeID,
+		Status:            models.InviteStatusPending,
+		ExpiresAt:         &expiresAt,
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var group models.UserGroup
+		if err := tx.First(&group, groupID).Error; err != nil {
+			return ErrGroupNotFound
+		}
+		if err := joinableBy(tx, groupID, inviteeID); err != nil {
+			return err
+		}
+		// The unique pending index settles concurrent invites
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&invite)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyInvited
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The invite stands either way; only the notification needs the names
+	loaded, err := s.loadInvite(invite.ID)
+	if err != nil {
+		return &invite, nil
+	}
+
+	s.notifications.Notify(inviteeID, Notification{
+		Type:    NotificationTypeInvite,
+		Title:   "New Group Invitation",
+		Message: loaded.Initiator.Username + " has invited you to join group: " + loaded.Group.Name,
+		Data: map[string]any{
+			"inviteId":  loaded.ID,
+			"groupName": loaded.Group.Name,
+			"inviter":   loaded.Initiator.Username,
+		},
+	})
+	return loaded, nil
+}
+
+// Accept accepts a pending invitation for the invitee and makes them a
+// member. The returned invite has its Group, Initiator and Invitee loaded,
+// also when an expired invite is retired with ErrInviteExpired.
+func (s *inviteService) Accept(inviteID, userID uint) (*models.UserGroupInvite, error) {
+	invite, err := s.loadInvite(inviteID)
+	if err != nil {
+		return nil, err
+	}
+
+	if invite.InviteeID != userID {
+		return nil, ErrNotInvitee
+	}
+	if !invite.Pending() {
+		return invite, ErrInviteNotPending
+	}
+
+	// Don't wait for the expiry job to retire invites that ran out or whose
+	// group is gone
+	if invite.Expired(time.Now()) || invite.Group.DeletedAt.Valid {
+		if err := TransitionInvite(s.db.GormDB, invite, models.InviteStatusExpired); err != nil {
+			return invite, err
+		}
+		notifyInviteChange(s.notifications, invite)
+		return invite, ErrInviteExpired
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := TransitionInvite(tx, invite, models.InviteStatusAccepted); err != nil {
+			return err
+		}
+		_, err := AddMember(tx, invite.GroupID, userID, models.GroupRoleMember)
+		return err
+	})
+	if err != nil {
+		return invite, err
+	}
+
+	// Start delivering the group's messages to the new member
+	s.notifications.Subscribe(userID, invite.GroupID)
+	notifyInviteChange(s.notifications, invite)
+	return invite, nil
+}
+
+// Decline answers a pending invitation without joining: the invitee
+// declines it, the user who sent it revokes it
+func (s *inviteService) Decline(inviteID, userID uint) (*models.UserGroupInvite, error) {
+	invite, err := s.loadInvite(inviteID)
+	if err != nil {
+		return nil, err
+	}
+
+	var status string
+	switch userID {
+	case invite.InviteeID:
+		status = models.InviteStatusDeclined
+	case invite.InviteInitiatorID:
+		status = models.InviteStatusRevoked
+	default:
+		return nil, ErrNotInviteParty
+	}
+
+	if err := TransitionInvite(s.db.GormDB, invite, status); err != nil {
+		return invite, err
+	}
+
+	notifyInviteChange(s.notifications, invite)
+	return invite, nil
+}
+
+// ExpireStale marks pending invites past their expiry, or of deleted
+// groups, as expired and notifies both parties. Every pod runs it; each
+// invite is only returned to the pod whose update changed it.
+func (s *inviteService) ExpireStale() (int, error) {
+	now := time.Now()
+
+	var expired []models.UserGroupInvite
+	err := s.db.GormDB.Model(&expired).Clauses(clause.Returning{}).
+		Where("status = ?", models.InviteStatusPending).
+		Where("expires_at <= ? OR group_id IN (SELECT id FROM user_groups WHERE deleted_at IS NOT NULL)", now).
+		Updates(map[string]interface{}{"status": models.InviteStatusExpired, "expired_at": now}).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire invites: %v", err)
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]uint, len(expired))
+	for i, invite := range expired {
+		ids[i] = invite.ID
+	}
+
+	// Deleted groups still need their name in the notification
+	if err := s.db.GormDB.Preload("Group", func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }).
+		Preload("Initiator").Preload("Invitee").Find(&expired, ids).Error; err != nil {
+		return len(expired), fmt.Errorf("failed to load expired invites: %v", err)
+	}
+
+	for i := range expired {
+		notifyInviteChange(s.notifications, &expired[i])
+	}
+	return len(expired), nil
+}
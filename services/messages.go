@@ -0,0 +1,54 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+)
+
+// maxMessageLength bounds the length of a chat message in bytes
+const maxMessageLength = 4000
+
+// Messages returns up to limit of a group's messages with their senders,
+// newest first. A non-zero before only returns messages older than that ID.
+func (s *groupService) Messages(groupID, before uint, limit int) ([]models.GroupMessage, error) {
+	query := s.db.GormDB.Preload("Sender").Where("group_id = ?", groupID)
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var messages []models.GroupMessage
+	err := query.Order("id DESC").Limit(limit).Find(&messages).Error
+	return messages, err
+}
+
+// PostMessage stores a message from a group member and delivers it to the
+// group's online members. The HTTP and WebSocket routes both post through it.
+func (s *groupService) PostMessage(groupID, senderID uint, content string) (*models.GroupMessage, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, &InputError{"Message cannot be empty"}
+	}
+	if len(content) > maxMessageLength {
+		return nil, &InputError{"Message is too long"}
+	}
+
+	var sender models.User
+	if err := s.db.GormDB.First(&sender, senderID).Error; err != nil {
+		return nil, ErrUserNotFound
+	}
+
+	message := models.GroupMessage{
+		GroupID:  groupID,
+		SenderID: senderID,
+		Content:  content,
+	}
+	if err := s.db.GormDB.Create(&message).Error; err != nil {
+		return nil, fmt.Errorf("failed to store message: %v", err)
+	}
+	message.Sender = sender
+
+	s.notifications.SendGroupMessage(&message)
+	return &message, nil
+}
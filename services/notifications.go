@@ -0,0 +1,184 @@
+package services
+
+import (
+	"errors"
+	"log"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// Notification types the clients know how to show
+const (
+	NotificationTypeInvite       = "invite"
+	NotificationTypeInviteUpdate = "invite_update"
+	NotificationTypeJoinRequest  = "join_request"
+	NotificationTypeSystem       = "system"
+)
+
+// ErrNotificationNotFound is returned for notifications that don't exist
+// or belong to someone else
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// Notification is a message for a user, stored and sent to their sessions
+type Notification struct {
+	Type    string
+	Title   string
+	Message string
+	Data    map[string]any
+}
+
+// notifyGroupManagers notifies the members who may answer the group's join requests
+func notifyGroupManagers(tx *gorm.DB, notifications NotificationService, groupID uint, notification Notification) {
+	var managerIDs []uint
+	if err := tx.Model(&models.UserGroupMember{}).
+		Where("group_id = ? AND role IN ?", groupID, models.GroupRolesWith(models.GroupPermJoinRequests)).
+		Pluck("user_id", &managerIDs).Error; err != nil {
+		log.Printf("Failed to find managers of group %d: %v", groupID, err)
+		return
+	}
+
+	for _, managerID := range managerIDs {
+		notifications.Notify(managerID, notification)
+	}
+}
+
+// notifyInviteChange tells the inviter and the invitee that an invite
+// changed status. The invite needs its Group, Initiator and Invitee loaded.
+func notifyInviteChange(notifications NotificationService, invite *models.UserGroupInvite) {
+	groupName := invite.Group.Name
+	inviter := invite.Initiator.Username
+	invitee := invite.Invitee.Username
+
+	var title, toInitiator, toInvitee string
+	switch invite.Status {
+	case models.InviteStatusAccepted:
+		title = "Invitation accepted"
+		toInitiator = invitee + " accepted your invitation to join group: " + groupName
+		toInvitee = "You joined group: " + groupName
+	case models.InviteStatusDeclined:
+		title = "Invitation declined"
+		toInitiator = invitee + " declined your invitation to join group: " + groupName
+		toInvitee = "You declined the invitation to join group: " + groupName
+	case models.InviteStatusRevoked:
+		title = "Invitation revoked"
+		toInitiator = "You revoked the invitation for " + invitee + " to join group: " + groupName
+		toInvitee = inviter + " revoked your invitation to join group: " + groupName
+	case models.InviteStatusExpired:
+		title = "Invitation expired"
+		toInitiator = "Your invitation for " + invitee + " to join group: " + groupName + " expired"
+		toInvitee = "Your invitation to join group: " + groupName + " expired"
+	default:
+		return
+	}
+
+	data := map[string]any{
+		"inviteId":  invite.ID,
+		"groupId":   invite.GroupID,
+		"groupName": groupName,
+		"status":    invite.Status,
+	}
+	notifications.Notify(invite.InviteInitiatorID, Notification{
+		Type:    NotificationTypeInviteUpdate,
+		Title:   title,
+		Message: toInitiator,
+		Data:    data,
+	})
+	notifications.Notify(invite.InviteeID, Notification{
+		Type:    NotificationTypeInviteUpdate,
+		Title:   title,
+		Message: toInvitee,
+		Data:    data,
+	})
+}
+
+// syncSubscriptions adds and removes group delivery for a changed member list
+func syncSubscriptions(notifications NotificationService, groupID uint, previousIDs, currentIDs []uint) {
+	current := make(map[uint]bool, len(currentIDs))
+	for _, userID := range currentIDs {
+		current[userID] = true
+	}
+
+	previous := make(map[uint]bool, len(previousIDs))
+	for _, userID := range previousIDs {
+		previous[userID] = true
+		if !current[userID] {
+			notifications.Unsubscribe(userID, groupID)
+		}
+	}
+
+	for _, userID := range currentIDs {
+		if !previous[userID] {
+			notifications.Subscribe(userID, groupID)
+		}
+	}
+}
+
+// groupUserIDs returns the IDs of the group's creator and members
+func groupUserIDs(tx *gorm.DB, groupID uint) ([]uint, error) {
+	var userIDs []uint
+	err := tx.Model(&models.User{}).
+		Where("id IN (SELECT created_by_id FROM user_groups WHERE id = ?) OR id IN (SELECT user_id FROM user_group_members WHERE group_id = ?)", groupID, groupID).
+		Pluck("id", &userIDs).Error
+	return userIDs, err
+}
+
+// ListNotifications returns up to limit of the user's notifications, newest
+// first. A non-zero before only returns notifications older than that ID.
+func (s *userService) ListNotifications(userID uint, unreadOnly bool, before uint, limit int) ([]models.Notification, error) {
+	query := s.db.GormDB.Where("user_id = ?", userID)
+	if unreadOnly {
+		query = query.Where("read = ?", false)
+	}
+	if before > 0 {
+		query = query.Where("id < ?", before)
+	}
+
+	var notifications []models.Notification
+	err := query.Order("id DESC").Limit(limit).Find(&notifications).Error
+	return notifications, err
+}
+
+// CountUnreadNotifications returns how many notifications the user hasn't read
+func (s *userService) CountUnreadNotifications(userID uint) (int64, error) {
+	var count int64
+	err := s.db.GormDB.Model(&models.Notification{}).
+		Where("user_id = ? AND read = ?", userID, false).
+		Count(&count).Error
+	return count, err
+}
+
+// MarkNotificationRead marks one of the user's notifications as read
+func (s *userService) MarkNotificationRead(userID, notificationID uint) error {
+	result := s.db.GormDB.Model(&models.Notification{}).
+		Where("id = ? AND user_id = ?", notificationID, userID).
+		Update("read", true)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead marks the user's unread notifications as read and
+// returns how many there were
+func (s *userService) MarkAllNotificationsRead(userID uint) (int64, error) {
+	result := s.db.GormDB.Model(&models.Notification{}).
+		Where("user_id = ? AND read = ?", userID, false).
+		Update("read", true)
+	return result.RowsAffected, result.Error
+}
+
+// DeleteNotification deletes one of the user's notifications
+func (s *userService) DeleteNotification(userID, notificationID uint) error {
+	result := s.db.GormDB.Where("id = ? AND user_id = ?", notificationID, userID).Delete(&models.Notification{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotificationNotFound
+	}
+	return nil
+}
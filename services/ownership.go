@@ -0,0 +1,89 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrNewOwnerNotMember is returned when ownership would go to someone outside the group
+var ErrNewOwnerNotMember = errors.New("the new owner must be a member of the group")
+
+// groupHandover records a group that changed owner when its owner was deleted
+type groupHandover struct {
+	GroupID    uint
+	GroupName  string
+	NewOwnerID uint
+}
+
+// transferGroupOwnership makes a member the group's owner. The previous
+// owner stays on as a group admin.
+func transferGroupOwnership(tx *gorm.DB, groupID, newOwnerID uint) error {
+	var membership models.UserGroupMember
+	err := tx.Where("group_id = ? AND user_id = ?", groupID, newOwnerID).First(&membership).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNewOwnerNotMember
+	}
+	if err != nil {
+		return err
+	}
+	if membership.Role == models.GroupRoleOwner {
+		return nil
+	}
+
+	if err := tx.Model(&models.UserGroupMember{}).
+		Where("group_id = ? AND role = ?", groupID, models.GroupRoleOwner).
+		Update("role", models.GroupRoleAdmin).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&membership).Update("role", models.GroupRoleOwner).Error; err != nil {
+		return err
+	}
+	return tx.Model(&models.UserGroup{}).Where("id = ?", groupID).Update("created_by_id", newOwnerID).Error
+}
+
+// reassignOwnedGroups prepares a user for deletion: each group they own goes
+// to its longest-standing admin, or else its longest-standing member, and
+// groups nobody else belongs to are deleted. The user's memberships are removed.
+func reassignOwnedGroups(tx *gorm.DB, userID uint) ([]groupHandover, error) {
+	var groups []models.UserGroup
+	if err := tx.Where("created_by_id = ?", userID).Find(&groups).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch owned groups: %v", err)
+	}
+
+	var handovers []groupHandover
+	for _, group := range groups {
+		var successor models.UserGroupMember
+		err := tx.Joins("JOIN users ON users.id = user_group_members.user_id AND users.deleted_at IS NULL").
+			Where("user_group_members.group_id = ? AND user_group_members.user_id <> ?", group.ID, userID).
+			Order(clause.OrderBy{Expression: clause.Expr{
+				SQL:  "CASE user_group_members.role WHEN ? THEN 0 ELSE 1 END",
+				Vars: []interface{}{models.GroupRoleAdmin},
+			}}).
+			Order("user_group_members.created_at, user_group_members.id").
+			First(&successor).Error
+
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if err := tx.Delete(&group).Error; err != nil {
+				return nil, fmt.Errorf("failed to delete group %d: %v", group.ID, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to find a new owner for group %d: %v", group.ID, err)
+		}
+
+		if err := transferGroupOwnership(tx, group.ID, successor.UserID); err != nil {
+			return nil, fmt.Errorf("failed to transfer group %d: %v", group.ID, err)
+		}
+		handovers = append(handovers, groupHandover{GroupID: group.ID, GroupName: group.Name, NewOwnerID: successor.UserID})
+	}
+
+	if err := tx.Where("user_id = ?", userID).Delete(&models.UserGroupMember{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to remove group memberships: %v", err)
+	}
+	return handovers, nil
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+func TestReassignOwnedGroups(t *testing.T) {
+	database := openTestDB(t)
+	owner := createTestUser(t, database, "owner")
+	veteran := createTestUser(t, database, "veteran")
+	admin := createTestUser(t, database, "admin")
+
+	// The admin joined after the plain member but still takes precedence
+	withAdmin := createTestGroup(t, database, "with-admin", owner)
+	addTestMember(t, database, withAdmin, veteran, models.GroupRoleMember, time.Now().Add(-30*time.Minute))
+	addTestMember(t, database, withAdmin, admin, models.GroupRoleAdmin, time.Now().Add(-10*time.Minute))
+
+	membersOnly := createTestGroup(t, database, "members-only", owner)
+	addTestMember(t, database, membersOnly, admin, models.GroupRoleMember, time.Now().Add(-10*time.Minute))
+	addTestMember(t, database, membersOnly, veteran, models.GroupRoleMember, time.Now().Add(-30*time.Minute))
+
+	alone := createTestGroup(t, database, "alone", owner)
+
+	var handovers []groupHandover
+	err := database.Transaction(func(tx *gorm.DB) error {
+		var err error
+		handovers, err = reassignOwnedGroups(tx, owner.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("reassignOwnedGroups() error = %v", err)
+	}
+
+	want := map[uint]uint{withAdmin.ID: admin.ID, membersOnly.ID: veteran.ID}
+	if len(handovers) != len(want) {
+		t.Fatalf("got %d handovers, want %d", len(handovers), len(want))
+	}
+	for _, handover := range handovers {
+		if handover.NewOwnerID != want[handover.GroupID] {
+			t.Errorf("group %d went to user %d, want %d", handover.GroupID, handover.NewOwnerID, want[handover.GroupID])
+		}
+
+		var group models.UserGroup
+		if err := database.GormDB.First(&group, handover.GroupID).Error; err != nil {
+			t.Fatalf("failed to fetch group %d: %v", handover.GroupID, err)
+		}
+		if group.CreatedByID != handover.NewOwnerID {
+			t.Errorf("group %d created_by_id = %d, want %d", group.ID, group.CreatedByID, handover.NewOwnerID)
+		}
+
+		var membership models.UserGroupMember
+		if err := database.GormDB.Where("group_id = ? AND user_id = ?", group.ID, handover.NewOwnerID).First(&membership).Error; err != nil {
+			t.Fatalf("failed to fetch new owner's membership: %v", err)
+		}
+		if membership.Role != models.GroupRoleOwner {
+			t.Errorf("new owner's role = %q, want %q", membership.Role, models.GroupRoleOwner)
+		}
+	}
+
+	if err := database.GormDB.First(&models.UserGroup{}, alone.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("group without other members still exists: %v", err)
+	}
+
+	var remaining int64
+	database.GormDB.Model(&models.UserGroupMember{}).Where("user_id = ?", owner.ID).Count(&remaining)
+	if remaining != 0 {
+		t.Errorf("owner still has %d memberships", remaining)
+	}
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"log"
+	"strings"
+
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// Security event types
+const (
+	SecurityEventLoginLockout   = "login_lockout"
+	SecurityEventLockoutCleared = "lockout_cleared"
+	SecurityEventPasswordReset  = "password_reset"
+	SecurityEventSSOLinked      = "sso_linked"
+	SecurityEventSSOProvisioned = "sso_provisioned"
+)
+
+// securityService is the SecurityService backed by the database
+type securityService struct {
+	db *db.Database
+}
+
+// NewSecurityService returns a SecurityService backed by the database
+func NewSecurityService(database *db.Database) SecurityService {
+	return &securityService{db: database}
+}
+
+// RecordSecurityEvent stores an audit record, linking it to the account with
+// that username if there is one. Failures are only logged, so auditing never
+// fails the request it describes.
+func RecordSecurityEvent(tx *gorm.DB, username, ip, eventType, detail string) {
+	event := models.SecurityEvent{
+		Username:  username,
+		IPAddress: ip,
+		Type:      eventType,
+		Detail:    detail,
+	}
+
+	var user models.User
+	if tx.Where("LOWER(username) = ?", strings.ToLower(strings.TrimSpace(username))).First(&user).Error == nil {
+		event.UserID = &user.ID
+	}
+
+	if err := tx.Create(&event).Error; err != nil {
+		log.Printf("Failed to record security event %s for %s: %v", eventType, username, err)
+	}
+}
+
+// RecordEvent stores an audit record of a security-relevant change
+func (s *securityService) RecordEvent(username, ip, eventType, detail string) {
+	RecordSecurityEvent(s.db.GormDB, username, ip, eventType, detail)
+}
+
+// RecentEvents returns the latest security events, newest first
+func (s *securityService) RecentEvents(limit int) ([]models.SecurityEvent, error) {
+	var events []models.SecurityEvent
+	err := s.db.GormDB.Order("created_at DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
@@ -0,0 +1,161 @@
+// Package services holds the use cases behind the HTML and JSON routes.
+// Each use case that changes several rows runs in a single transaction, and
+// services get their dependencies when they are created rather than from
+// the request context.
+package services
+
+import (
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"gorm.io/gorm"
+)
+
+// UserService looks up, creates, changes and deletes user accounts and
+// keeps their notifications
+type UserService interface {
+	GetUser(userID uint) (*models.User, error)
+	ListUsers(query UserQuery) ([]models.User, int64, error)
+	CreateUser(input NewUser) (*models.User, error)
+	UpdateUser(userID uint, changes UserChanges) (*models.User, error)
+	DeleteUser(userID uint) error
+
+	ListNotifications(userID uint, unreadOnly bool, before uint, limit int) ([]models.Notification, error)
+	CountUnreadNotifications(userID uint) (int64, error)
+	MarkNotificationRead(userID, notificationID uint) error
+	MarkAllNotificationsRead(userID uint) (int64, error)
+	DeleteNotification(userID, notificationID uint) error
+}
+
+// GroupService looks up groups, changes them and who belongs to them, and
+// keeps their chat
+type GroupService interface {
+	GetGroup(groupID uint) (*models.UserGroup, error)
+	MemberIDs(groupID uint) ([]uint, error)
+	IsMember(groupID, userID uint) (bool, error)
+	ListGroups(query GroupQuery) ([]models.UserGroup, int64, error)
+	CreateGroup(input NewGroup) (*models.UserGroup, error)
+	UpdateGroup(groupID uint, changes GroupChanges) (*models.UserGroup, error)
+	SaveGroup(group *models.UserGroup, memberIDs []uint) error
+	DeleteGroup(groupID uint) error
+	RemoveMember(groupID, memberID uint, remover models.GroupAccess) error
+	SetMemberRole(groupID, memberID uint, role string) error
+	JoinWithInviteLink(link *models.GroupInviteLink, userID uint) error
+	SearchDirectory(userID uint, query string) ([]models.GroupListing, error)
+	DirectoryListing(userID uint, group *models.UserGroup) (*models.GroupListing, error)
+	JoinOpenGroup(group *models.UserGroup, user *models.User) error
+	RequestToJoin(group *models.UserGroup, user *models.User, message string) (*models.GroupJoinRequest, error)
+	CancelJoinRequest(group *models.UserGroup, user *models.User) error
+	PendingJoinRequests(groupID uint) ([]models.GroupJoinRequest, error)
+	GetJoinRequest(groupID, requestID uint) (*models.GroupJoinRequest, error)
+	AnswerJoinRequest(request *models.GroupJoinRequest, deciderID uint, status string) error
+	LeaveGroup(groupID, userID uint) error
+	TransferOwnership(group *models.UserGroup, newOwnerID uint) error
+
+	Messages(groupID, before uint, limit int) ([]models.GroupMessage, error)
+	PostMessage(groupID, senderID uint, content string) (*models.GroupMessage, error)
+}
+
+// InviteService sends group invitations and answers them
+type InviteService interface {
+	Invite(groupID, initiatorID, inviteeID uint) (*models.UserGroupInvite, error)
+	Accept(inviteID, userID uint) (*models.UserGroupInvite, error)
+	Decline(inviteID, userID uint) (*models.UserGroupInvite, error)
+	InviteCandidates(groupID, inviterID uint) ([]models.User, error)
+	ExpireStale() (int, error)
+	UserInvites(userID uint) (sent, received []models.UserGroupInvite, err error)
+
+	FindInviteLink(token string) (*models.GroupInviteLink, error)
+	InviteLinks(groupID uint) ([]models.GroupInviteLink, error)
+	CreateInviteLink(input NewInviteLink) (string, *models.GroupInviteLink, error)
+	RevokeInviteLink(groupID, linkID uint) error
+}
+
+// APIKeyService issues and revokes the API keys users authenticate
+// scripts with
+type APIKeyService interface {
+	APIKeys(userID uint) ([]models.APIKey, error)
+	CreateAPIKey(input NewAPIKey) (string, *models.APIKey, error)
+	RevokeAPIKey(userID, keyID uint) error
+}
+
+// TwoFactorService enrolls users in two-factor authentication and manages
+// their recovery codes
+type TwoFactorService interface {
+	TwoFactorStatus(userID uint) (*TwoFactorStatus, error)
+	BeginTwoFactorSetup(userID uint) (secret, uri string, err error)
+	EnableTwoFactor(userID uint, code, userAgent, ipAddress string) ([]string, *auth.TokenPair, error)
+	DisableTwoFactor(userID uint, password, code string) error
+	RegenerateRecoveryCodes(userID uint, code string) ([]string, error)
+}
+
+// SecurityService keeps the audit log of logins, lockouts and account links
+type SecurityService interface {
+	RecordEvent(username, ip, eventType, detail string)
+	RecentEvents(limit int) ([]models.SecurityEvent, error)
+}
+
+// NotificationService delivers notifications and group messages to users.
+// The WebSocket hub provides it; without a hub nothing is delivered.
+type NotificationService interface {
+	// Notify stores a notification for a user and sends it to their sessions
+	Notify(userID uint, notification Notification)
+	// Subscribe starts delivering a group's messages to a user's sessions
+	Subscribe(userID, groupID uint)
+	// Unsubscribe stops delivering a group's messages to a user's sessions
+	Unsubscribe(userID, groupID uint)
+	// SendGroupMessage delivers a chat message to the group's online members
+	SendGroupMessage(message *models.GroupMessage)
+}
+
+// Services are the use cases the routes call
+type Services struct {
+	Users         UserService
+	Groups        GroupService
+	Invites       InviteService
+	APIKeys       APIKeyService
+	TwoFactor     TwoFactorService
+	Security      SecurityService
+	Notifications NotificationService
+}
+
+// New creates the services on top of the database and the notification service
+func New(database *db.Database, notifications NotificationService) *Services {
+	return &Services{
+		Users:         NewUserService(database, notifications),
+		Groups:        NewGroupService(database, notifications),
+		Invites:       NewInviteService(database, notifications),
+		APIKeys:       NewAPIKeyService(database),
+		TwoFactor:     NewTwoFactorService(database),
+		Security:      NewSecurityService(database),
+		Notifications: notifications,
+	}
+}
+
+// InputError is a request a service refuses, with a message for the user
+type InputError struct {
+	message string
+}
+
+func (e *InputError) Error() string {
+	return e.message
+}
+
+// Page selects part of a sorted list. Order is an ORDER BY clause the
+// caller has checked; a zero Limit returns every row.
+type Page struct {
+	Order  string
+	Offset int
+	Limit  int
+}
+
+// apply adds the ordering and page window to a query
+func (p Page) apply(query *gorm.DB) *gorm.DB {
+	if p.Order != "" {
+		query = query.Order(p.Order)
+	}
+	if p.Limit > 0 {
+		query = query.Offset(p.Offset).Limit(p.Limit)
+	}
+	return query
+}
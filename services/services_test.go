@@ -0,0 +1,141 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/migrations"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB migrates a fresh schema in the PostgreSQL database at
+// TEST_DATABASE_URL and drops it when the test ends. Without one the test
+// is skipped.
+func openTestDB(t *testing.T) *db.Database {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	config := &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)}
+
+	admin, err := gorm.Open(postgres.Open(dsn), config)
+	if err != nil {
+		t.Fatalf("failed to connect to test database: %v", err)
+	}
+	schema := fmt.Sprintf("services_test_%d", time.Now().UnixNano())
+	if err := admin.Exec("CREATE SCHEMA " + schema).Error; err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+
+	// Every pooled connection has to see only the test schema
+	separator := " "
+	if strings.Contains(dsn, "://") {
+		separator = "?"
+		if strings.Contains(dsn, "?") {
+			separator = "&"
+		}
+	}
+	gormDB, err := gorm.Open(postgres.Open(dsn+separator+"search_path="+schema), config)
+	if err != nil {
+		t.Fatalf("failed to connect to test schema: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := gormDB.DB(); err == nil {
+			sqlDB.Close()
+		}
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	if err := migrations.NewRunner(gormDB).Run(); err != nil {
+		t.Fatalf("failed to migrate test schema: %v", err)
+	}
+	return &db.Database{GormDB: gormDB}
+}
+
+// createTestUser stores an active user
+func createTestUser(t *testing.T, database *db.Database, username string) *models.User {
+	t.Helper()
+
+	user := models.User{
+		Username: username,
+		Email:    username + "@example.com",
+		Password: "not-a-hash",
+		Active:   true,
+		Role:     models.RoleUser,
+	}
+	if err := database.GormDB.Create(&user).Error; err != nil {
+		t.Fatalf("failed to create user %s: %v", username, err)
+	}
+	return &user
+}
+
+// createTestGroup stores a group owned by the user, with their membership
+func createTestGroup(t *testing.T, database *db.Database, name string, owner *models.User) *models.UserGroup {
+	t.Helper()
+
+	group := models.UserGroup{Name: name, CreatedByID: owner.ID, Visibility: models.GroupVisibilityPrivate}
+	if err := database.GormDB.Create(&group).Error; err != nil {
+		t.Fatalf("failed to create group %s: %v", name, err)
+	}
+	addTestMember(t, database, &group, owner, models.GroupRoleOwner, time.Now().Add(-time.Hour))
+	return &group
+}
+
+// addTestMember adds a membership that started at the given time
+func addTestMember(t *testing.T, database *db.Database, group *models.UserGroup, user *models.User, role string, since time.Time) {
+	t.Helper()
+
+	member := models.UserGroupMember{GroupID: group.ID, UserID: user.ID, Role: role, CreatedAt: since, UpdatedAt: since}
+	if err := database.GormDB.Create(&member).Error; err != nil {
+		t.Fatalf("failed to add %s to %s: %v", user.Username, group.Name, err)
+	}
+}
+
+// startTestSession stores a live session for the user and returns its ID
+func startTestSession(t *testing.T, database *db.Database, user *models.User) string {
+	t.Helper()
+
+	session := models.AuthSession{ID: uuid.New().String(), UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := database.GormDB.Create(&session).Error; err != nil {
+		t.Fatalf("failed to start session: %v", err)
+	}
+	return session.ID
+}
+
+// sessionRevoked reports whether a session has ended
+func sessionRevoked(t *testing.T, database *db.Database, sessionID string) bool {
+	t.Helper()
+
+	var session models.AuthSession
+	if err := database.GormDB.First(&session, "id = ?", sessionID).Error; err != nil {
+		t.Fatalf("failed to fetch session: %v", err)
+	}
+	return session.RevokedAt != nil
+}
+
+// recordingNotifications is a NotificationService that remembers whom it notified
+type recordingNotifications struct {
+	notified []uint
+}
+
+func (n *recordingNotifications) Notify(userID uint, notification Notification) {
+	n.notified = append(n.notified, userID)
+}
+
+func (n *recordingNotifications) Subscribe(userID, groupID uint)                {}
+func (n *recordingNotifications) Unsubscribe(userID, groupID uint)              {}
+func (n *recordingNotifications) SendGroupMessage(message *models.GroupMessage) {}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"gorm.io/gorm"
+)
+
+// Errors returned by TwoFactorService
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotStarted = errors.New("two-factor setup was not started")
+	ErrTwoFactorRequired   = errors.New("two-factor authentication is required for this account")
+	ErrInvalidCode         = errors.New("invalid authentication code")
+	ErrWrongPassword       = errors.New("password is incorrect")
+)
+
+// twoFactorService is the TwoFactorService backed by the database
+type twoFactorService struct {
+	db *db.Database
+}
+
+// NewTwoFactorService returns a TwoFactorService backed by the database
+func NewTwoFactorService(database *db.Database) TwoFactorService {
+	return &twoFactorService{db: database}
+}
+
+// TwoFactorStatus is a user's two-factor settings
+type TwoFactorStatus struct {
+	User models.User
+	// Required is set for admins who have to use two-factor authentication
+	Required               bool
+	RecoveryCodesRemaining int64
+}
+
+// loadUser fetches the user whose two-factor settings change
+func (s *twoFactorService) loadUser(userID uint) (*models.User, error) {
+	var user models.User
+	err := s.db.GormDB.First(&user, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	return &user, err
+}
+
+// TwoFactorStatus returns whether the user has two-factor authentication
+// enabled, whether they must, and how many recovery codes are left
+func (s *twoFactorService) TwoFactorStatus(userID uint) (*TwoFactorStatus, error) {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining, err := auth.RemainingRecoveryCodes(s.db.GormDB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TwoFactorStatus{
+		User:                   *user,
+		Required:               auth.TwoFactorRequired(s.db.GormDB, userID),
+		RecoveryCodesRemaining: remaining,
+	}, nil
+}
+
+// BeginTwoFactorSetup stores a new TOTP secret for the user to add to their
+// authenticator app and returns it with its provisioning URI. It isn't used
+// for login until EnableTwoFactor confirms it.
+func (s *twoFactorService) BeginTwoFactorSetup(userID uint) (string, string, error) {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.db.GormDB.Model(user).Update("totp_secret", secret).Error; err != nil {
+		return "", "", err
+	}
+
+	return secret, auth.TOTPProvisioningURI(secret, user.Username), nil
+}
+
+// EnableTwoFactor confirms enrollment with a code from the app and returns
+// new recovery codes. Sessions that logged in with only a password end and
+// a fresh one starts for the caller, which picks up admin access if it was
+// waiting on two-factor.
+func (s *twoFactorService) EnableTwoFactor(userID uint, code, userAgent, ipAddress string) ([]string, *auth.TokenPair, error) {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, nil, ErrTwoFactorNotStarted
+	}
+
+	step, valid := auth.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if !valid {
+		return nil, nil, ErrInvalidCode
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled":      true,
+			"totp_last_counter": step,
+		}).Error; err != nil {
+			return err
+		}
+		return auth.RevokeUserSessions(tx, user.ID)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	recoveryCodes, err := auth.GenerateRecoveryCodes(s.db.GormDB, user.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pair, err := auth.StartSession(s.db.GormDB, user, userAgent, ipAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+	return recoveryCodes, pair, nil
+}
+
+// DisableTwoFactor turns two-factor authentication off after checking the
+// password and a current code. Admins required to use it can't.
+func (s *twoFactorService) DisableTwoFactor(userID uint, password, code string) error {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return ErrTwoFactorNotEnabled
+	}
+	if auth.TwoFactorRequired(s.db.GormDB, user.ID) {
+		return ErrTwoFactorRequired
+	}
+
+	if ok, _ := passwords.Verify(user.Password, password); !ok {
+		return ErrWrongPassword
+	}
+
+	valid, err := auth.VerifyTwoFactor(s.db.GormDB, user, code)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrInvalidCode
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_secret":       "",
+			"totp_enabled":      false,
+			"totp_last_counter": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes after checking
+// a current code
+func (s *twoFactorService) RegenerateRecoveryCodes(userID uint, code string) ([]string, error) {
+	user, err := s.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, ErrTwoFactorNotEnabled
+	}
+
+	valid, err := auth.VerifyTwoFactor(s.db.GormDB, user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidCode
+	}
+
+	return auth.GenerateRecoveryCodes(s.db.GormDB, user.ID)
+}
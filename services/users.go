@@ -0,0 +1,334 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"git.ssy.dk/noob/bingbong-go/auth"
+	"git.ssy.dk/noob/bingbong-go/db"
+	"git.ssy.dk/noob/bingbong-go/models"
+	"git.ssy.dk/noob/bingbong-go/passwords"
+	"gorm.io/gorm"
+)
+
+// Errors returned by UserService
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("username or email already exists")
+	ErrInvalidRole  = errors.New("invalid role")
+)
+
+// userService is the UserService backed by the database
+type userService struct {
+	db            *db.Database
+	notifications NotificationService
+}
+
+// NewUserService returns a UserService backed by the database
+func NewUserService(database *db.Database, notifications NotificationService) UserService {
+	return &userService{db: database, notifications: notifications}
+}
+
+// NewUser describes an account an admin creates
+type NewUser struct {
+	Username   string
+	Email      string
+	Password   string
+	PublicKey  string
+	Role       string
+	IsAdmin    bool
+	Require2FA bool
+}
+
+// UserChanges lists the fields of an account to change; nil fields stay
+// as they are
+type UserChanges struct {
+	Username *string
+	// Email is only changed by admins; like the addresses of accounts they
+	// create, it counts as verified
+	Email      *string
+	Password   *string
+	PublicKey  *string
+	Active     *bool
+	Role       *string
+	IsAdmin    *bool
+	Require2FA *bool
+	// KeepSessionID is the session of a user changing their own password,
+	// which stays logged in while their other sessions end
+	KeepSessionID string
+}
+
+// UserQuery filters the users ListUsers returns
+type UserQuery struct {
+	// Search matches part of the username, and of the email when SearchEmail is set
+	Search      string
+	SearchEmail bool
+	// Active only lists users with the given active flag when set
+	Active *bool
+	Page   Page
+}
+
+// hashPassword checks a new password against the policy and hashes it
+func hashPassword(password, username string) (string, error) {
+	if err := passwords.Validate(password, username); err != nil {
+		return "", &InputError{err.Error()}
+	}
+	hashed, err := passwords.Hash(password)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %v", err)
+	}
+	return hashed, nil
+}
+
+// setAdminAccess grants or revokes a user's admin access. A nil require2FA
+// keeps the two-factor requirement of existing admin access.
+func setAdminAccess(tx *gorm.DB, userID uint, isAdmin bool, require2FA *bool) error {
+	var adminAccess models.AdminGroupMember
+	err := tx.Where("user_id = ?", userID).First(&adminAccess).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !isAdmin {
+			return nil
+		}
+		adminAccess = models.AdminGroupMember{UserID: userID, Active: true}
+		if require2FA != nil {
+			adminAccess.Require2FA = *require2FA
+		}
+		return tx.Create(&adminAccess).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	changed := adminAccess.Active != isAdmin
+	adminAccess.Active = isAdmin
+	if isAdmin && require2FA != nil && adminAccess.Require2FA != *require2FA {
+		adminAccess.Require2FA = *require2FA
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return tx.Save(&adminAccess).Error
+}
+
+// isAdmin reports whether the user has active admin access
+func isAdmin(tx *gorm.DB, userID uint) bool {
+	return tx.Where("user_id = ? AND active = ?", userID, true).First(&models.AdminGroupMember{}).Error == nil
+}
+
+// GetUser returns a user with their admin access
+func (s *userService) GetUser(userID uint) (*models.User, error) {
+	var user models.User
+	err := s.db.GormDB.Preload("AdminAccess").First(&user, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListUsers returns a page of the users matching the query, with their
+// admin access, and how many match in total
+func (s *userService) ListUsers(query UserQuery) ([]models.User, int64, error) {
+	filtered := s.db.GormDB.Model(&models.User{})
+	if query.Search != "" {
+		pattern := "%" + query.Search + "%"
+		if query.SearchEmail {
+			filtered = filtered.Where("username ILIKE ? OR email ILIKE ?", pattern, pattern)
+		} else {
+			filtered = filtered.Where("username ILIKE ?", pattern)
+		}
+	}
+	if query.Active != nil {
+		filtered = filtered.Where("active = ?", *query.Active)
+	}
+
+	var total int64
+	if err := filtered.Count(&total).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %v", err)
+	}
+
+	var users []models.User
+	if err := query.Page.apply(filtered).Preload("AdminAccess").Find(&users).Error; err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch users: %v", err)
+	}
+	return users, total, nil
+}
+
+// CreateUser creates an active account; the admin vouches for the address
+func (s *userService) CreateUser(input NewUser) (*models.User, error) {
+	if input.Role == "" {
+		input.Role = models.RoleUser
+	}
+	if !models.ValidRole(input.Role) {
+		return nil, ErrInvalidRole
+	}
+
+	hashedPassword, err := hashPassword(input.Password, input.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user := models.User{
+		Username:        input.Username,
+		Email:           input.Email,
+		Password:        hashedPassword,
+		PublicKey:       input.PublicKey,
+		Role:            input.Role,
+		Active:          true,
+		EmailVerifiedAt: &now,
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.User{}).Where("username = ? OR email = ?", input.Username, input.Email).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrUserExists
+		}
+
+		if err := tx.Create(&user).Error; err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+		if err := setAdminAccess(tx, user.ID, input.IsAdmin, &input.Require2FA); err != nil {
+			return fmt.Errorf("failed to set admin status: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.db.GormDB.Preload("AdminAccess").First(&user, user.ID)
+	return &user, nil
+}
+
+// UpdateUser changes an account. Tokens carry the role and admin flag and
+// outlive deactivation, so the user's sessions end when any of them, or the
+// two-factor requirement, changes. A new password ends them too, except for
+// changes.KeepSessionID.
+func (s *userService) UpdateUser(userID uint, changes UserChanges) (*models.User, error) {
+	if changes.Role != nil && !models.ValidRole(*changes.Role) {
+		return nil, ErrInvalidRole
+	}
+
+	var user models.User
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&user, userID).Error; err != nil {
+			return ErrUserNotFound
+		}
+
+		// Remember the access-relevant state to detect changes below
+		wasActive := user.Active
+		previousRole := user.Role
+		wasAdmin := isAdmin(tx, user.ID)
+		wasRequired := auth.TwoFactorRequired(tx, user.ID)
+
+		if changes.Username != nil {
+			user.Username = *changes.Username
+		}
+		if changes.Email != nil && *changes.Email != user.Email {
+			now := time.Now()
+			user.Email = *changes.Email
+			user.EmailVerifiedAt = &now
+		}
+
+		// The new username or email can't be taken by someone else
+		var count int64
+		if err := tx.Model(&models.User{}).
+			Where("(username = ? OR email = ?) AND id <> ?", user.Username, user.Email, user.ID).
+			Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrUserExists
+		}
+
+		if changes.PublicKey != nil {
+			user.PublicKey = *changes.PublicKey
+		}
+		if changes.Active != nil {
+			user.Active = *changes.Active
+		}
+		if changes.Role != nil {
+			user.Role = *changes.Role
+		}
+		if changes.Password != nil {
+			hashedPassword, err := hashPassword(*changes.Password, user.Username)
+			if err != nil {
+				return err
+			}
+			user.Password = hashedPassword
+		}
+
+		if err := tx.Save(&user).Error; err != nil {
+			return fmt.Errorf("failed to update user: %v", err)
+		}
+
+		if changes.IsAdmin != nil {
+			if err := setAdminAccess(tx, user.ID, *changes.IsAdmin, changes.Require2FA); err != nil {
+				return fmt.Errorf("failed to update admin status: %v", err)
+			}
+		}
+
+		if wasActive != user.Active || previousRole != user.Role ||
+			wasAdmin != isAdmin(tx, user.ID) || wasRequired != auth.TwoFactorRequired(tx, user.ID) {
+			if err := auth.RevokeUserSessions(tx, user.ID); err != nil {
+				return fmt.Errorf("failed to revoke user sessions: %v", err)
+			}
+		} else if changes.Password != nil {
+			if err := auth.RevokeOtherSessions(tx, user.ID, changes.KeepSessionID); err != nil {
+				return fmt.Errorf("failed to revoke user sessions: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.db.GormDB.Preload("AdminAccess").First(&user, user.ID)
+	return &user, nil
+}
+
+// DeleteUser deletes a user after handing their groups to other members,
+// logs them out everywhere and tells the new owners
+func (s *userService) DeleteUser(userID uint) error {
+	var user models.User
+	if err := s.db.GormDB.First(&user, userID).Error; err != nil {
+		return ErrUserNotFound
+	}
+
+	var handovers []groupHandover
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if handovers, err = reassignOwnedGroups(tx, user.ID); err != nil {
+			return err
+		}
+		if err := tx.Delete(&user).Error; err != nil {
+			return err
+		}
+		return auth.RevokeUserSessions(tx, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, handover := range handovers {
+		s.notifications.Notify(handover.NewOwnerID, Notification{
+			Type:    NotificationTypeSystem,
+			Title:   "You now own a group",
+			Message: user.Username + " was removed, so you are now the owner of group: " + handover.GroupName,
+			Data: map[string]any{
+				"groupId":   handover.GroupID,
+				"groupName": handover.GroupName,
+			},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+
+	"git.ssy.dk/noob/bingbong-go/models"
+)
+
+func TestUpdateUserRevokesSessions(t *testing.T) {
+	database := openTestDB(t)
+	users := NewUserService(database, &recordingNotifications{})
+
+	inactive := false
+	moderator := models.RoleModerator
+	admin := true
+	publicKey := "ssh-ed25519 AAAA"
+	password := "a new Passw0rd!"
+
+	tests := []struct {
+		name    string
+		changes UserChanges
+		revoked bool
+	}{
+		{"deactivated", UserChanges{Active: &inactive}, true},
+		{"role changed", UserChanges{Role: &moderator}, true},
+		{"made admin", UserChanges{IsAdmin: &admin}, true},
+		{"password changed", UserChanges{Password: &password}, true},
+		{"public key changed", UserChanges{PublicKey: &publicKey}, false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := createTestUser(t, database, fmt.Sprintf("revoke%d", i))
+			sessionID := startTestSession(t, database, user)
+
+			if _, err := users.UpdateUser(user.ID, tt.changes); err != nil {
+				t.Fatalf("UpdateUser() error = %v", err)
+			}
+			if got := sessionRevoked(t, database, sessionID); got != tt.revoked {
+				t.Errorf("session revoked = %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestUpdateUserPasswordKeepsCurrentSession(t *testing.T) {
+	database := openTestDB(t)
+	users := NewUserService(database, &recordingNotifications{})
+	user := createTestUser(t, database, "alice")
+	current := startTestSession(t, database, user)
+	other := startTestSession(t, database, user)
+
+	password := "a new Passw0rd!"
+	if _, err := users.UpdateUser(user.ID, UserChanges{Password: &password, KeepSessionID: current}); err != nil {
+		t.Fatalf("UpdateUser() error = %v", err)
+	}
+
+	if sessionRevoked(t, database, current) {
+		t.Error("the session that changed the password was revoked")
+	}
+	if !sessionRevoked(t, database, other) {
+		t.Error("another session survived the password change")
+	}
+}